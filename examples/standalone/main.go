@@ -4,16 +4,33 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/rs/zerolog"
+	"github.com/tb0hdan/go-webfilter/pkg/access"
+	"github.com/tb0hdan/go-webfilter/pkg/admin"
+	"github.com/tb0hdan/go-webfilter/pkg/blocklist"
+	"github.com/tb0hdan/go-webfilter/pkg/ca"
+	"github.com/tb0hdan/go-webfilter/pkg/firewall"
+	"github.com/tb0hdan/go-webfilter/pkg/firewall/iptables"
+	"github.com/tb0hdan/go-webfilter/pkg/firewall/netlink"
+	"github.com/tb0hdan/go-webfilter/pkg/firewall/nft"
 	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+	"github.com/tb0hdan/go-webfilter/pkg/override"
+	"github.com/tb0hdan/go-webfilter/pkg/policy"
+	"github.com/tb0hdan/go-webfilter/pkg/proc"
+	"github.com/tb0hdan/go-webfilter/pkg/reload"
+	"github.com/tb0hdan/go-webfilter/pkg/safesearch"
+	"github.com/tb0hdan/go-webfilter/pkg/schedule"
 	"github.com/tb0hdan/go-webfilter/pkg/server"
 	"github.com/tb0hdan/go-webfilter/pkg/utils"
 	"github.com/ziflex/lecho/v3"
@@ -23,7 +40,30 @@ func main() {
 	var (
 		dump     = flag.Bool("dump", false, "Dump all HTTP requests/responses to stdout")
 		debug    = flag.Bool("debug", false, "Enable debug mode")
-		snakeOil = flag.Bool("snakeoil", true, "Use snakeoil self-signed certificate")
+		caDir    = flag.String("ca-dir", "build/ca", "Directory holding the root CA and minted certificates")
+		exportCA = flag.String("export-ca", "", "Write the root CA certificate to this file for installation into client trust stores and exit")
+		tlsMode  = flag.String("tls-mode", "intercept", "Default handling of HTTPS traffic: intercept or passthrough")
+		tlsHosts = flag.String("tls-exceptions", "", "Comma separated host patterns (e.g. *.bank.com) handled opposite to -tls-mode")
+		procRoot = flag.String("proc-root", proc.DefaultRoot, "Where procfs is mounted, e.g. the host's /proc bind mounted into a container")
+		pageFile = flag.String("block-page", "", "html/template file replacing the built-in block page")
+		polFile  = flag.String("policy", "", "YAML or JSON policy file with ordered allow/block/redirect rules")
+		quotaDB  = flag.String("quota-state", "build/quota.json", "File keeping today's quota usage across restarts")
+		blFiles  = flag.String("blocklists", "", "Comma separated blocklist files in hosts, plain or adblock format, each optionally prefixed with its category, e.g. ads=/etc/lists/ads.txt")
+		pin      = flag.String("override-pin", "", "PIN unlocking blocked sites from the block page")
+		totp     = flag.String("override-totp", "", "Base32 TOTP secret whose codes unlock blocked sites from the block page")
+		maxGrant = flag.Duration("override-max", time.Hour, "Longest time a site can be unlocked for")
+		accessDB = flag.String("access-requests", "", "File keeping access requests made from the block page, the form is hidden if empty")
+		adminAt  = flag.String("admin-listen", "", "Address of the admin API, e.g. 127.0.0.1:8099, disabled if empty")
+		token    = flag.String("admin-token", "", "Bearer token required by the admin API, mandatory with -admin-listen")
+		safe     = flag.Bool("safe-search", false, "Enforce safe search and restricted mode on the built-in list of search engines and video sites")
+		safeFile = flag.String("safe-search-table", "", "YAML table of engines replacing the built-in one, implies -safe-search")
+		fwName   = flag.String("firewall", "auto", "Firewall used to redirect traffic: netlink (nftables without the nft binary), nft, iptables or auto to use nftables when the kernel supports it")
+		cleanup  = flag.Bool("cleanup", false, "Remove firewall rules left by instances that are no longer running and exit")
+		httpPort = flag.String("http-ports", "80", "Comma separated destination ports of HTTP traffic redirected to the proxy")
+		tlsPorts = flag.String("tls-ports", "443", "Comma separated destination ports of HTTPS traffic redirected to the proxy")
+		bypass   = flag.String("bypass", "", "Comma separated CIDRs and addresses, e.g. 10.20.0.0/16, whose traffic is never redirected")
+		noLoop   = flag.Bool("exclude-loopback", false, "Do not redirect traffic to the host itself")
+		interval = flag.Duration("reload-interval", reload.DefaultInterval, "How often policy files are checked for changes, SIGHUP reloads them at once")
 	)
 	flag.Parse()
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
@@ -33,17 +73,187 @@ func main() {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 		logger.Debug().Msg("Debug mode enabled")
 	}
-	serverHooks := hooks.New(logger)
+	if *cleanup {
+		fw, err := newFirewall(logger, *fwName)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Error selecting firewall")
+		}
+		if err := fw.Recover(); err != nil {
+			logger.Fatal().Err(err).Msg("Error removing orphaned firewall rules")
+		}
+		return
+	}
+	if command := strings.Join(flag.Args(), " "); command != "" {
+		if command != "rules print" {
+			logger.Fatal().Msgf("Unknown command %q, the only command is rules print", command)
+		}
+		config, err := firewallConfig(*httpPort, *tlsPorts, *bypass, *noLoop)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Error parsing firewall configuration")
+		}
+		// Logs go to stderr, stdout only holds the rules
+		if err := printRules(logger.Output(os.Stderr), *fwName, config); err != nil {
+			logger.Fatal().Err(err).Msg("Error printing firewall rules")
+		}
+		return
+	}
+	// The admin API decides access requests and overrides, it is never started without a token
+	var adminAuth echo.MiddlewareFunc
+	if *adminAt != "" {
+		var err error
+		if adminAuth, err = admin.Auth(*token); err != nil {
+			logger.Fatal().Err(err).Msg("Error configuring admin API, set -admin-token")
+		}
+		if !admin.Loopback(*adminAt) {
+			logger.Warn().Msgf("Admin API on %s is reachable from other hosts, consider 127.0.0.1", *adminAt)
+		}
+	}
+	// Load or generate the root CA used to mint certificates for intercepted hosts
+	authority, err := ca.New(logger, *caDir)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Error loading or generating root CA")
+	}
+	if *exportCA != "" {
+		if err := os.WriteFile(*exportCA, authority.CertificatePEM(), 0644); err != nil {
+			logger.Fatal().Err(err).Msg("Error exporting root CA")
+		}
+		logger.Info().Msgf("Root CA written to %s", *exportCA)
+		return
+	}
+	// Hooks run in a chain, filters are added to it with their own priority
+	serverHooks := hooks.NewChain(logger)
+	serverHooks.Add("default", hooks.New(logger), 0, 0)
+	// Overrides run first, an unlocked site is allowed whatever the filters say
+	var overrides *override.Store
+	if auth := overrideAuth(logger, *pin, *totp); len(auth) > 0 {
+		overrides = override.NewStore(logger, schedule.SystemClock{})
+		serverHooks.Add("override", override.New(logger, overrides, auth, *maxGrant), -10, 0)
+	}
+	var accessRequests *access.Store
+	if *accessDB != "" {
+		if accessRequests, err = access.NewStore(logger, schedule.SystemClock{}, *accessDB); err != nil {
+			logger.Fatal().Err(err).Msg("Error loading access requests")
+		}
+		if *adminAt == "" {
+			logger.Warn().Msg("Access requests can only be approved through the admin API, see -admin-listen")
+		}
+		serverHooks.Add("access", access.New(logger, accessRequests), -10, 0)
+	}
+	// Changed files are swapped in while serving, a broken file keeps the previous version
+	watcher := reload.New(logger, *interval)
+	var usage *schedule.Tracker
+	if *polFile != "" {
+		p, err := policy.Load(*polFile)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Error loading policy")
+		}
+		logger.Info().Msgf("Loaded %d policy rules from %s", len(p.Rules), *polFile)
+		policyHook := policy.New(logger, p)
+		if usage, err = schedule.NewTracker(logger, schedule.SystemClock{}, *quotaDB); err != nil {
+			logger.Fatal().Err(err).Msg("Error loading quota usage")
+		}
+		policyHook.SetUsage(usage)
+		serverHooks.Add("policy", policyHook, 10, 0)
+		watcher.Add("policy", reload.Load(*polFile, policy.Load, policyHook.SetPolicy), *polFile)
+	}
+	if lists := blocklists(*blFiles); len(lists) > 0 {
+		matcher, err := blocklist.Load(lists)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Error loading blocklists")
+		}
+		logger.Info().Msgf("Loaded %d blocklists with %d domains", len(lists), matcher.Len())
+		// Runs after the policy so its allow rules override the lists
+		blocklistHook := blocklist.New(logger, matcher)
+		serverHooks.Add("blocklist", blocklistHook, 20, 0)
+		files := make([]string, 0, len(lists))
+		for _, list := range lists {
+			files = append(files, list.Path)
+		}
+		watcher.Add("blocklists", func() error {
+			matcher, err := blocklist.Load(lists)
+			if err != nil {
+				return err
+			}
+			blocklistHook.SetMatcher(matcher)
+			return nil
+		}, files...)
+	}
+	if *safe || *safeFile != "" {
+		table := safesearch.Default()
+		if *safeFile != "" {
+			var err error
+			if table, err = safesearch.Load(*safeFile); err != nil {
+				logger.Fatal().Err(err).Msg("Error loading safe search table")
+			}
+		}
+		logger.Info().Msgf("Enforcing safe search on %d engines", len(table.Engines))
+		// Runs first so its rewrites also apply to requests allowed by overrides and access requests
+		safeSearchHook := safesearch.New(logger, table)
+		serverHooks.Add("safesearch", safeSearchHook, -20, 0)
+		if *safeFile != "" {
+			watcher.Add("safe search", reload.Load(*safeFile, safesearch.Load, safeSearchHook.SetTable), *safeFile)
+		}
+	}
 	srv := server.New(logger, *dump)
-	// Get a free port for the server to listen on
-	srv.Setup()
+	if *pageFile != "" {
+		blockPage, err := server.LoadBlockPage(*pageFile)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Error loading block page")
+		}
+		srv.SetBlockPage(blockPage)
+	}
+	fw, err := newFirewall(logger, *fwName)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Error selecting firewall")
+	}
+	config, err := firewallConfig(*httpPort, *tlsPorts, *bypass, *noLoop)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Error parsing firewall configuration")
+	}
+	if err := fw.SetConfig(config); err != nil {
+		logger.Fatal().Err(err).Msg("Error configuring firewall")
+	}
+	switch *tlsMode {
+	case "intercept":
+		srv.SetTLSMode(server.TLSIntercept, splitList(*tlsHosts))
+	case "passthrough":
+		srv.SetTLSMode(server.TLSPassthrough, splitList(*tlsHosts))
+	default:
+		logger.Fatal().Msgf("Unknown TLS mode: %s", *tlsMode)
+	}
+	srv.SetFirewall(fw)
+	// Get free ports for the server to listen on and redirect traffic to them,
+	// without the rules nothing is filtered so failing to install them is fatal
+	if err := srv.Setup(); err != nil {
+		logger.Fatal().Err(err).Msg("Error setting up server")
+	}
+	// Traffic is redirected from here on, exiting without removing the rules would cut the host off the web
+	listen := func(port int) net.Listener {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			srv.Cleanup()
+			logger.Fatal().Err(err).Msgf("Error listening on port %d", port)
+		}
+		return listener
+	}
+	httpListener := listen(srv.Port)
+	httpsListener := listen(srv.HTTPSPort)
 	srv.SetHooks(serverHooks)
+	srv.SetProcRoot(*procRoot)
+	if overrides != nil {
+		srv.SetUnlockPath(override.Path)
+	}
+	if accessRequests != nil {
+		srv.SetRequestAccessPath(access.Path)
+	}
 
 	// HTTP server
 	e := echo.New()
 	e.HideBanner = true
 	e.Logger = lecho.From(logger)
 	e.Use(middleware.Recover())
+	e.Server.ConnContext = srv.ConnContext
+	e.Listener = httpListener
 	srv.RegisterRoutes(e)
 
 	// HTTPS server
@@ -51,16 +261,34 @@ func main() {
 	eHTTPS.HideBanner = true
 	eHTTPS.Logger = lecho.From(logger)
 	eHTTPS.Use(middleware.Recover())
+	eHTTPS.TLSServer.ConnContext = srv.ConnContext
+	eHTTPS.TLSServer.TLSConfig = authority.TLSConfig()
 	srv.RegisterRoutes(eHTTPS)
+	// ClientHellos are peeked first to decide between interception and passthrough
+	eHTTPS.TLSListener = srv.TLSListener(httpsListener, eHTTPS.TLSServer.TLSConfig)
 
-	// Load or generate self-signed certificate
-	cert, key, err := utils.LoadOrGenerateCert(*snakeOil)
-	if err != nil {
-		logger.Fatal().Err(err).Msg("Error loading or generating self-signed certificate")
+	// Admin API
+	eAdmin := echo.New()
+	eAdmin.HideBanner = true
+	eAdmin.Logger = lecho.From(logger)
+	eAdmin.Use(middleware.Recover())
+	api := eAdmin.Group("/api")
+	if adminAuth != nil {
+		api.Use(adminAuth)
+	}
+	if overrides != nil {
+		overrides.RegisterRoutes(api)
+	}
+	if accessRequests != nil {
+		accessRequests.RegisterRoutes(api)
 	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
+	watcher.Start(ctx)
+	if usage != nil {
+		usage.Start(ctx, 30*time.Second)
+	}
 
 	// Start HTTP server
 	go func() {
@@ -74,21 +302,36 @@ func main() {
 	// Start HTTPS server
 	go func() {
 		logger.Info().Msgf("Starting HTTPS server on :%d", srv.HTTPSPort)
-		logger.Info().Msgf("Using self-signed certificate: %s", cert)
-		logger.Info().Msgf("Using self-signed key: %s", key)
-		// Use the self-signed certificate for HTTPS
-		if err := eHTTPS.StartTLS(fmt.Sprintf(":%d", srv.HTTPSPort), cert, key); err != nil && err != http.ErrServerClosed {
+		logger.Info().Msgf("Minting certificates with root CA: %s", authority.CertificatePath())
+		// Certificates are minted per SNI name by the root CA
+		if err := eHTTPS.StartServer(eHTTPS.TLSServer); err != nil && err != http.ErrServerClosed {
 			eHTTPS.Logger.Errorf("Error starting HTTPS server: ", err)
 			stop()
 		}
 	}()
 
+	// Start admin API
+	if *adminAt != "" {
+		go func() {
+			logger.Info().Msgf("Starting admin API on %s", *adminAt)
+			if err := eAdmin.Start(*adminAt); err != nil && err != http.ErrServerClosed {
+				eAdmin.Logger.Errorf("Error starting admin API: ", err)
+				stop()
+			}
+		}()
+	}
+
 	<-ctx.Done()
 	logger.Println("Shutting down servers...")
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	srv.Cleanup()
+	if usage != nil {
+		if err := usage.Save(); err != nil {
+			logger.Error().Err(err).Msg("Error saving quota usage")
+		}
+	}
 
 	// Shutdown both servers
 	if err := e.Shutdown(shutdownCtx); err != nil {
@@ -97,4 +340,122 @@ func main() {
 	if err := eHTTPS.Shutdown(shutdownCtx); err != nil {
 		eHTTPS.Logger.Fatal("Error shutting down HTTPS server: ", err)
 	}
+	if err := eAdmin.Shutdown(shutdownCtx); err != nil {
+		eAdmin.Logger.Fatal("Error shutting down admin API: ", err)
+	}
+}
+
+// splitList splits a comma separated flag value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// overrideAuth returns the authenticators for the unlock form, none disables overrides
+func overrideAuth(logger zerolog.Logger, pin, totpSecret string) override.Any {
+	var auth override.Any
+	if pin != "" {
+		auth = append(auth, override.PIN(pin))
+	}
+	if totpSecret != "" {
+		totp, err := override.NewTOTP(totpSecret, schedule.SystemClock{})
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Error loading override TOTP secret")
+		}
+		auth = append(auth, totp)
+	}
+	return auth
+}
+
+// blocklists parses the -blocklists flag, items are paths optionally prefixed with "category="
+func blocklists(value string) []*blocklist.List {
+	var lists []*blocklist.List
+	for _, item := range splitList(value) {
+		list := &blocklist.List{Path: item}
+		if category, path, ok := strings.Cut(item, "="); ok {
+			list.Category, list.Path = category, path
+		}
+		lists = append(lists, list)
+	}
+	return lists
+}
+
+// firewallConfig parses the -http-ports, -tls-ports and -bypass flags
+func firewallConfig(httpPorts, tlsPorts, bypass string, excludeLoopback bool) (firewall.Config, error) {
+	config := firewall.Config{ExcludeLoopback: excludeLoopback}
+	var err error
+	if config.HTTPPorts, err = firewall.ParsePorts(httpPorts); err != nil {
+		return config, fmt.Errorf("error parsing -http-ports: %w", err)
+	}
+	if config.TLSPorts, err = firewall.ParsePorts(tlsPorts); err != nil {
+		return config, fmt.Errorf("error parsing -tls-ports: %w", err)
+	}
+	if config.Bypass, err = firewall.ParsePrefixes(bypass); err != nil {
+		return config, fmt.Errorf("error parsing -bypass: %w", err)
+	}
+	return config, config.Validate()
+}
+
+// newFirewall returns the firewall called name. Auto talks to nf_tables over netlink if the kernel supports it
+// and falls back to iptables, which is either iptables-legacy or iptables-nft depending on the distribution.
+func newFirewall(logger zerolog.Logger, name string) (firewall.Firewall, error) {
+	if name == "auto" {
+		fw := netlink.New(logger)
+		err := fw.Check()
+		if err == nil {
+			logger.Info().Msg("Using the nftables firewall")
+			return fw, nil
+		}
+		if !commandExists("iptables") {
+			return nil, fmt.Errorf("nftables is not available (%w) and iptables is not installed", err)
+		}
+		logger.Info().Err(err).Msg("nftables is not available, using the iptables firewall")
+		return iptables.New(logger), nil
+	}
+	switch name {
+	case "netlink":
+		return netlink.New(logger), nil
+	case "nft":
+		return nft.New(logger), nil
+	case "iptables":
+		return iptables.New(logger), nil
+	}
+	return nil, fmt.Errorf("unknown firewall %q", name)
+}
+
+// printRules writes the ruleset the firewall would install to stdout without applying it. The server picks free
+// ports when it starts, the ones printed are picked the same way.
+func printRules(logger zerolog.Logger, name string, config firewall.Config) error {
+	if name == "auto" {
+		// Probing the kernel needs CAP_NET_ADMIN, printing the rules shouldn't
+		logger.Info().Msg("Printing the nftables rules, which auto uses whenever the kernel supports nftables, pass -firewall iptables for the iptables ones")
+		name = "netlink"
+	}
+	fw, err := newFirewall(logger, name)
+	if err != nil {
+		return err
+	}
+	if err := fw.SetConfig(config); err != nil {
+		return err
+	}
+	redirectPort, err := utils.GetFreePort()
+	if err != nil {
+		return fmt.Errorf("error getting free port: %w", err)
+	}
+	redirectHTTPSPort, err := utils.GetFreePort()
+	if err != nil {
+		return fmt.Errorf("error getting free port for HTTPS: %w", err)
+	}
+	fmt.Print(fw.Render(redirectPort, redirectHTTPSPort))
+	return nil
+}
+
+func commandExists(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
 }
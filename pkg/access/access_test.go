@@ -0,0 +1,278 @@
+package access_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+	"github.com/tb0hdan/go-webfilter/pkg/access"
+	"github.com/tb0hdan/go-webfilter/pkg/admin"
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+	"github.com/tb0hdan/go-webfilter/pkg/proc"
+)
+
+// fixedClock always returns the same time
+type fixedClock struct {
+	now time.Time
+}
+
+func (c *fixedClock) Now() time.Time {
+	return c.now
+}
+
+var (
+	alice   = &proc.ProcessInfo{PID: "100", Binary: "/usr/lib/firefox/firefox", Cmdline: "firefox", UID: "1000"}
+	aliceSh = &proc.ProcessInfo{PID: "101", Binary: "/usr/bin/curl", UID: "1000"}
+	bob     = &proc.ProcessInfo{PID: "200", Binary: "/usr/lib/firefox/firefox", UID: "1001"}
+)
+
+// AccessTestSuite defines the test suite for access requests
+type AccessTestSuite struct {
+	suite.Suite
+	clock *fixedClock
+	path  string
+	store *access.Store
+	hook  *access.Hook
+	admin *echo.Echo
+}
+
+// SetupTest creates an empty store persisted in a temporary directory
+func (suite *AccessTestSuite) SetupTest() {
+	suite.clock = &fixedClock{now: time.Date(2026, 10, 12, 10, 0, 0, 0, time.UTC)}
+	suite.path = filepath.Join(suite.T().TempDir(), "access", "requests.json")
+	var err error
+	suite.store, err = access.NewStore(zerolog.Nop(), suite.clock, suite.path)
+	suite.Require().NoError(err)
+	suite.hook = access.New(zerolog.Nop(), suite.store)
+	suite.admin = echo.New()
+	suite.store.RegisterRoutes(suite.admin.Group("/api"))
+}
+
+// request runs the hook for a request from process
+func (suite *AccessTestSuite) request(method, target string, form url.Values, process *proc.ProcessInfo) hooks.Decision {
+	req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	if form != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	}
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	if process != nil {
+		hooks.SetRequestInfo(c, &hooks.RequestInfo{Process: process})
+	}
+	decision, err := suite.hook.BeforeRequest(c)
+	suite.Require().NoError(err)
+	return decision
+}
+
+func (suite *AccessTestSuite) submit(reason string, process *proc.ProcessInfo) hooks.Decision {
+	form := url.Values{"url": {"https://blocked.example.com/page"}, "reason": {reason}}
+	return suite.request(http.MethodPost, "https://blocked.example.com"+access.Path, form, process)
+}
+
+func (suite *AccessTestSuite) allowed(process *proc.ProcessInfo) bool {
+	decision := suite.request(http.MethodGet, "https://blocked.example.com/page", nil, process)
+	return decision.Action == hooks.ActionAllow && decision.Final
+}
+
+// api calls the admin API and decodes its JSON answer into out
+func (suite *AccessTestSuite) api(method, target, body string, out any) int {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	rec := httptest.NewRecorder()
+	suite.admin.ServeHTTP(rec, req)
+	if out != nil && rec.Code == http.StatusOK {
+		suite.Require().NoError(json.Unmarshal(rec.Body.Bytes(), out))
+	}
+	return rec.Code
+}
+
+// TestWorkflow tests submitting, listing and approving a request
+func (suite *AccessTestSuite) TestWorkflow() {
+	suite.False(suite.allowed(alice))
+
+	decision := suite.submit("Needed for <b>homework</b>", alice)
+	suite.Equal(hooks.ActionRespond, decision.Action)
+	suite.Equal(http.StatusAccepted, decision.StatusCode)
+	suite.Contains(string(decision.Body), "Your request to access blocked.example.com was sent")
+	suite.NotContains(string(decision.Body), "<b>")
+
+	var pending []access.Request
+	suite.Equal(http.StatusOK, suite.api(http.MethodGet, "/api/access-requests?status=pending", "", &pending))
+	suite.Require().Len(pending, 1)
+	r := pending[0]
+	suite.Equal("https://blocked.example.com/page", r.URL)
+	suite.Equal("blocked.example.com", r.Host)
+	suite.Equal("Needed for <b>homework</b>", r.Reason)
+	suite.Equal("100", r.PID)
+	suite.Equal("firefox", r.Cmdline)
+	suite.Equal("1000", r.UID)
+	suite.Equal(suite.clock.now, r.Created)
+	suite.Contains(string(decision.Body), r.ID)
+
+	// Asking again adds nothing
+	suite.submit("Please", alice)
+	suite.Len(suite.store.List(access.StatusPending), 1)
+	suite.False(suite.allowed(alice))
+
+	var approved access.Request
+	suite.Equal(http.StatusOK, suite.api(http.MethodPost, "/api/access-requests/"+r.ID+"/approve", `{"scope": "uid"}`, &approved))
+	suite.Equal(access.StatusApproved, approved.Status)
+	suite.Equal(access.ScopeUID, approved.Scope)
+	suite.True(suite.allowed(alice))
+	suite.True(suite.allowed(aliceSh))
+	suite.False(suite.allowed(bob))
+	suite.Empty(suite.store.List(access.StatusPending))
+
+	suite.Equal(http.StatusConflict, suite.api(http.MethodPost, "/api/access-requests/"+r.ID+"/deny", "", nil))
+	suite.Equal(http.StatusNoContent, suite.api(http.MethodDelete, "/api/access-requests/"+r.ID, "", nil))
+	suite.False(suite.allowed(alice))
+	suite.Equal(http.StatusNotFound, suite.api(http.MethodDelete, "/api/access-requests/"+r.ID, "", nil))
+}
+
+// TestDecisions tests the scopes of approvals and denials
+func (suite *AccessTestSuite) TestDecisions() {
+	suite.submit("", alice)
+	suite.submit("", bob)
+	suite.submit("", nil)
+	requests := suite.store.List("")
+	suite.Require().Len(requests, 3)
+	byUID := map[string]access.Request{}
+	for _, r := range requests {
+		byUID[r.UID] = r
+	}
+
+	suite.Equal(http.StatusBadRequest, suite.api(http.MethodPost, "/api/access-requests/"+byUID[""].ID+"/approve", `{"scope": "process"}`, nil))
+	suite.Equal(http.StatusBadRequest, suite.api(http.MethodPost, "/api/access-requests/"+byUID["1000"].ID+"/approve", `{"scope": "planet"}`, nil))
+	suite.Equal(http.StatusNotFound, suite.api(http.MethodPost, "/api/access-requests/missing/approve", "", nil))
+
+	var denied access.Request
+	suite.Equal(http.StatusOK, suite.api(http.MethodPost, "/api/access-requests/"+byUID["1001"].ID+"/deny", "", &denied))
+	suite.Equal(access.StatusDenied, denied.Status)
+	suite.Equal(suite.clock.now, denied.Decided)
+	suite.False(suite.allowed(bob))
+
+	_, err := suite.store.Approve(byUID["1000"].ID, access.ScopeProcess)
+	suite.NoError(err)
+	suite.True(suite.allowed(bob))
+	suite.False(suite.allowed(aliceSh))
+
+	_, err = suite.store.Approve(byUID[""].ID, "")
+	suite.NoError(err)
+	suite.True(suite.allowed(aliceSh))
+	suite.True(suite.allowed(nil))
+}
+
+// TestPassthrough tests that approvals let passed through connections of the same scope through
+func (suite *AccessTestSuite) TestPassthrough() {
+	suite.submit("", alice)
+	requests := suite.store.List(access.StatusPending)
+	suite.Require().Len(requests, 1)
+	suite.NoError(suite.hook.BeforeTLS(&hooks.TLSInfo{ServerName: "blocked.example.com", Process: alice}))
+
+	_, err := suite.store.Approve(requests[0].ID, access.ScopeUID)
+	suite.Require().NoError(err)
+	suite.ErrorIs(suite.hook.BeforeTLS(&hooks.TLSInfo{ServerName: "Blocked.Example.COM.", Process: aliceSh}), hooks.ErrPassThrough)
+	suite.NoError(suite.hook.BeforeTLS(&hooks.TLSInfo{ServerName: "blocked.example.com", Process: bob}))
+	suite.NoError(suite.hook.BeforeTLS(&hooks.TLSInfo{ServerName: "other.example.com", Process: alice}))
+}
+
+// TestPersistence tests that requests and approvals survive a restart
+func (suite *AccessTestSuite) TestPersistence() {
+	suite.submit("", alice)
+	r := suite.store.List("")[0]
+	_, err := suite.store.Approve(r.ID, "")
+	suite.Require().NoError(err)
+	suite.submit("", bob)
+
+	restarted, err := access.NewStore(zerolog.Nop(), suite.clock, suite.path)
+	suite.Require().NoError(err)
+	suite.Len(restarted.List(access.StatusPending), 1)
+	suite.NotNil(restarted.Exception("blocked.example.com", nil))
+	suite.Nil(restarted.Exception("other.example.com", nil))
+
+	suite.Require().NoError(os.WriteFile(suite.path, []byte("["), 0o600))
+	_, err = access.NewStore(zerolog.Nop(), suite.clock, suite.path)
+	suite.ErrorContains(err, "error parsing access requests")
+}
+
+// TestPruning tests that denied requests are forgotten after their retention
+func (suite *AccessTestSuite) TestPruning() {
+	suite.submit("", alice)
+	suite.submit("", bob)
+	requests := suite.store.List(access.StatusPending)
+	suite.Require().Len(requests, 2)
+	for _, r := range requests {
+		if r.UID == "1000" {
+			_, err := suite.store.Approve(r.ID, "")
+			suite.Require().NoError(err)
+		} else {
+			_, err := suite.store.Deny(r.ID)
+			suite.Require().NoError(err)
+		}
+	}
+
+	suite.clock.now = suite.clock.now.Add(29 * 24 * time.Hour)
+	suite.submit("", aliceSh)
+	suite.Len(suite.store.List(access.StatusDenied), 1)
+
+	suite.clock.now = suite.clock.now.Add(24 * time.Hour)
+	suite.submit("", bob)
+	suite.Empty(suite.store.List(access.StatusDenied))
+	suite.Len(suite.store.List(access.StatusApproved), 1)
+	data, err := os.ReadFile(suite.path)
+	suite.Require().NoError(err)
+	suite.NotContains(string(data), access.StatusDenied)
+}
+
+// TestAdminAuth tests that the admin API rejects deciding requests without the token
+func (suite *AccessTestSuite) TestAdminAuth() {
+	auth, err := admin.Auth("secret")
+	suite.Require().NoError(err)
+	e := echo.New()
+	suite.store.RegisterRoutes(e.Group("/api", auth))
+	suite.submit("", alice)
+	id := suite.store.List(access.StatusPending)[0].ID
+
+	for _, authorization := range []string{"", "Bearer guess"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/access-requests/"+id+"/approve", nil)
+		if authorization != "" {
+			req.Header.Set(echo.HeaderAuthorization, authorization)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		suite.Contains([]int{http.StatusBadRequest, http.StatusUnauthorized}, rec.Code, authorization)
+		suite.False(suite.allowed(alice))
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/access-requests/"+id+"/approve", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer secret")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	suite.Equal(http.StatusOK, rec.Code)
+	suite.True(suite.allowed(alice))
+}
+
+// TestLimits tests the form method and the length of reasons
+func (suite *AccessTestSuite) TestLimits() {
+	decision := suite.request(http.MethodGet, "https://blocked.example.com"+access.Path, nil, alice)
+	suite.Equal(http.StatusMethodNotAllowed, decision.Status())
+
+	suite.submit(strings.Repeat("é", 600), alice)
+	r := suite.store.List("")[0]
+	suite.Equal(strings.Repeat("é", 500), r.Reason)
+}
+
+// TestAccessTestSuite runs the test suite
+func TestAccessTestSuite(t *testing.T) {
+	suite.Run(t, new(AccessTestSuite))
+}
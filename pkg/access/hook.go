@@ -0,0 +1,100 @@
+package access
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+	"github.com/tb0hdan/go-webfilter/pkg/utils"
+)
+
+const (
+	// Path is where the request access form of the block page posts to, on the blocked host itself
+	Path = "/.well-known/go-webfilter/request-access"
+	// maxReason caps the text users can leave for the admin
+	maxReason = 1000
+)
+
+// Hook allows hosts with an approved access request and records requests posted to Path.
+// It must run before the hooks that block, approvals are final allow decisions.
+type Hook struct {
+	logger zerolog.Logger
+	store  *Store
+}
+
+func (h *Hook) BeforeRequest(c echo.Context) (hooks.Decision, error) {
+	host := utils.HostOnly(c.Request().Host)
+	if c.Request().URL.Path == Path {
+		return h.submit(c, host), nil
+	}
+	if r := h.store.Exception(host, hooks.GetProcess(c)); r != nil {
+		return hooks.Decision{Action: hooks.ActionAllow, Final: true, Reason: "access request " + r.ID}, nil
+	}
+	return hooks.Allow(), nil
+}
+
+func (h *Hook) AfterRequest(c echo.Context, rsp *http.Response) error {
+	return nil
+}
+
+// BeforeTLS passes through connections to hosts with an approved request, so blocking hooks don't reset them
+func (h *Hook) BeforeTLS(info *hooks.TLSInfo) error {
+	if r := h.store.Exception(utils.HostOnly(info.ServerName), info.Process); r != nil {
+		h.logger.Debug().Msgf("Passing through %s with access request %s", info.ServerName, r.ID)
+		return hooks.ErrPassThrough
+	}
+	return nil
+}
+
+// submit records the request posted by the block page and confirms it
+func (h *Hook) submit(c echo.Context, host string) hooks.Decision {
+	if c.Request().Method != http.MethodPost {
+		return hooks.Respond(http.StatusMethodNotAllowed, http.Header{"Allow": {http.MethodPost}}, nil)
+	}
+	reason := strings.TrimSpace(c.FormValue("reason"))
+	if len(reason) > maxReason {
+		reason = reason[:maxReason]
+	}
+	target := c.FormValue("url")
+	if target == "" {
+		target = host
+	}
+	r, err := h.store.Submit(target, host, strings.ToValidUTF8(reason, ""), hooks.GetProcess(c))
+	if errors.Is(err, ErrTooManyPending) {
+		return hooks.Respond(http.StatusTooManyRequests, textHeader(), []byte("Too many access requests are pending, try again later.\n"))
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Msgf("Error recording access request for %s", host)
+		return hooks.Respond(http.StatusInternalServerError, textHeader(), []byte("The access request could not be recorded.\n"))
+	}
+	body := fmt.Sprintf(confirmation, html.EscapeString(r.Host), html.EscapeString(r.ID))
+	return hooks.Respond(http.StatusAccepted, http.Header{
+		echo.HeaderContentType:  {echo.MIMETextHTMLCharsetUTF8},
+		echo.HeaderCacheControl: {"no-store"},
+	}, []byte(body))
+}
+
+const confirmation = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Access requested</title></head>
+<body>
+<h1>Access requested</h1>
+<p>Your request to access %s was sent to the administrator. Once it is approved, reload the page.</p>
+<p>Reference %s</p>
+</body>
+</html>
+`
+
+func textHeader() http.Header {
+	return http.Header{echo.HeaderContentType: {echo.MIMETextPlainCharsetUTF8}}
+}
+
+// New creates a hook recording access requests in store and allowing the approved ones
+func New(logger zerolog.Logger, store *Store) *Hook {
+	return &Hook{logger: logger, store: store}
+}
@@ -0,0 +1,348 @@
+package access
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/tb0hdan/go-webfilter/pkg/proc"
+	"github.com/tb0hdan/go-webfilter/pkg/schedule"
+	"github.com/tb0hdan/go-webfilter/pkg/utils"
+)
+
+// Status of an access request
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusDenied   = "denied"
+)
+
+// Scopes an approval applies to
+const (
+	ScopeHost    = "host"
+	ScopeUID     = "uid"
+	ScopeProcess = "process"
+)
+
+const (
+	// maxPending keeps a flood of requests from filling the disk
+	maxPending = 1000
+	// Denied requests are kept for the admin to look back at, at most maxDenied of them for deniedRetention
+	maxDenied       = 1000
+	deniedRetention = 30 * 24 * time.Hour
+)
+
+var (
+	// ErrNotFound is returned for unknown request IDs
+	ErrNotFound = errors.New("access request not found")
+	// ErrDecided is returned when deciding a request that is no longer pending
+	ErrDecided = errors.New("access request already decided")
+	// ErrTooManyPending is returned when too many requests await a decision
+	ErrTooManyPending = errors.New("too many pending access requests")
+)
+
+// Request asks an admin to allow a blocked host
+type Request struct {
+	ID   string `json:"id"`
+	URL  string `json:"url"`
+	Host string `json:"host"`
+	// Reason is the text the user entered
+	Reason  string `json:"reason,omitempty"`
+	PID     string `json:"pid,omitempty"`
+	Binary  string `json:"binary,omitempty"`
+	Cmdline string `json:"cmdline,omitempty"`
+	UID     string `json:"uid,omitempty"`
+	Status  string `json:"status"`
+	// Scope is what an approval applies to: the host for everyone, or the requester's uid or binary only
+	Scope   string    `json:"scope,omitempty"`
+	Created time.Time `json:"created"`
+	Decided time.Time `json:"decided,omitzero"`
+}
+
+// allows reports whether an approved request is an exception for host and process
+func (r *Request) allows(host string, process *proc.ProcessInfo) bool {
+	if r.Status != StatusApproved || r.Host != host {
+		return false
+	}
+	switch r.Scope {
+	case ScopeUID:
+		return process != nil && process.UID == r.UID
+	case ScopeProcess:
+		return process != nil && process.Binary == r.Binary
+	}
+	return true
+}
+
+// Store keeps access requests and approved exceptions in a JSON file
+type Store struct {
+	logger   zerolog.Logger
+	clock    schedule.Clock
+	path     string
+	mu       sync.RWMutex
+	requests map[string]*Request
+	// exceptions indexes the approved requests by host, requests are checked against it
+	exceptions map[string][]*Request
+}
+
+// Submit records a request for host by process. A pending request of the same user for the same host
+// is returned instead of adding another one.
+func (s *Store) Submit(target, host, reason string, process *proc.ProcessInfo) (*Request, error) {
+	r := &Request{URL: target, Host: host, Reason: reason, Status: StatusPending, Created: s.clock.Now()}
+	if process != nil {
+		r.PID, r.Binary, r.Cmdline, r.UID = process.PID, process.Binary, process.Cmdline, process.UID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := 0
+	for _, existing := range s.requests {
+		if existing.Status != StatusPending {
+			continue
+		}
+		if existing.Host == host && existing.UID == r.UID {
+			return existing, nil
+		}
+		pending++
+	}
+	if pending >= maxPending {
+		return nil, ErrTooManyPending
+	}
+	r.ID = utils.NewID()
+	s.requests[r.ID] = r
+	if err := s.save(); err != nil {
+		delete(s.requests, r.ID)
+		return nil, err
+	}
+	s.logger.Info().Msgf("Access request %s for %s from %s (PID %s, UID %s): %q", r.ID, r.URL, r.Binary, r.PID, r.UID, r.Reason)
+	return r, nil
+}
+
+// Approve turns a pending request into an exception for the given scope, ScopeHost if empty
+func (s *Store) Approve(id, scope string) (*Request, error) {
+	switch scope {
+	case "":
+		scope = ScopeHost
+	case ScopeHost, ScopeUID, ScopeProcess:
+	default:
+		return nil, fmt.Errorf("unknown scope %q", scope)
+	}
+	return s.decide(id, StatusApproved, func(r *Request) error {
+		if scope == ScopeUID && r.UID == "" || scope == ScopeProcess && r.Binary == "" {
+			return fmt.Errorf("the requesting process is unknown, scope %s is not possible", scope)
+		}
+		r.Scope = scope
+		return nil
+	})
+}
+
+// Deny rejects a pending request
+func (s *Store) Deny(id string) (*Request, error) {
+	return s.decide(id, StatusDenied, nil)
+}
+
+func (s *Store) decide(id, status string, prepare func(r *Request) error) (*Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.requests[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if r.Status != StatusPending {
+		return nil, ErrDecided
+	}
+	decided := *r
+	if prepare != nil {
+		if err := prepare(&decided); err != nil {
+			return nil, err
+		}
+	}
+	decided.Status, decided.Decided = status, s.clock.Now()
+	s.requests[id] = &decided
+	if err := s.save(); err != nil {
+		s.requests[id] = r
+		return nil, err
+	}
+	s.reindex()
+	s.logger.Info().Msgf("Access request %s for %s %s (scope %q)", id, r.Host, status, decided.Scope)
+	return &decided, nil
+}
+
+// Revoke deletes a request, which ends the exception of an approved one
+func (s *Store) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.requests[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.requests, id)
+	if err := s.save(); err != nil {
+		s.requests[id] = r
+		return err
+	}
+	s.reindex()
+	s.logger.Info().Msgf("Access request %s for %s deleted", id, r.Host)
+	return nil
+}
+
+// Exception returns the approved request allowing host for process, nil if there is none
+func (s *Store) Exception(host string, process *proc.ProcessInfo) *Request {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, r := range s.exceptions[host] {
+		if r.allows(host, process) {
+			return r
+		}
+	}
+	return nil
+}
+
+// reindex rebuilds the exceptions after a change. Callers hold mu.
+func (s *Store) reindex() {
+	s.exceptions = make(map[string][]*Request)
+	for _, r := range s.requests {
+		if r.Status == StatusApproved {
+			s.exceptions[r.Host] = append(s.exceptions[r.Host], r)
+		}
+	}
+}
+
+// List returns the requests with the given status, or all of them if status is empty, oldest first
+func (s *Store) List(status string) []Request {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	requests := make([]Request, 0, len(s.requests))
+	for _, r := range s.requests {
+		if status == "" || r.Status == status {
+			requests = append(requests, *r)
+		}
+	}
+	slices.SortFunc(requests, func(a, b Request) int {
+		return a.Created.Compare(b.Created)
+	})
+	return requests
+}
+
+// RegisterRoutes adds the admin API for access requests:
+// GET /access-requests?status=pending, POST /access-requests/:id/approve with an optional {"scope": "uid"},
+// POST /access-requests/:id/deny and DELETE /access-requests/:id
+func (s *Store) RegisterRoutes(g *echo.Group) {
+	g.GET("/access-requests", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, s.List(c.QueryParam("status")))
+	})
+	g.POST("/access-requests/:id/approve", func(c echo.Context) error {
+		var body struct {
+			Scope string `json:"scope"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+		r, err := s.Approve(c.Param("id"), body.Scope)
+		if err != nil {
+			return httpError(err)
+		}
+		return c.JSON(http.StatusOK, r)
+	})
+	g.POST("/access-requests/:id/deny", func(c echo.Context) error {
+		r, err := s.Deny(c.Param("id"))
+		if err != nil {
+			return httpError(err)
+		}
+		return c.JSON(http.StatusOK, r)
+	})
+	g.DELETE("/access-requests/:id", func(c echo.Context) error {
+		if err := s.Revoke(c.Param("id")); err != nil {
+			return httpError(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+}
+
+// httpError maps store errors to status codes
+func httpError(err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrDecided):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+}
+
+// prune forgets denied requests past their retention and the oldest ones beyond maxDenied.
+// Approved requests stay until they are revoked. Callers hold mu.
+func (s *Store) prune() {
+	now := s.clock.Now()
+	var denied []*Request
+	for id, r := range s.requests {
+		if r.Status != StatusDenied {
+			continue
+		}
+		if now.Sub(r.Decided) >= deniedRetention {
+			delete(s.requests, id)
+			continue
+		}
+		denied = append(denied, r)
+	}
+	if len(denied) <= maxDenied {
+		return
+	}
+	slices.SortFunc(denied, func(a, b *Request) int {
+		return a.Decided.Compare(b.Decided)
+	})
+	for _, r := range denied[:len(denied)-maxDenied] {
+		delete(s.requests, r.ID)
+	}
+}
+
+// save prunes and writes all requests, the file is replaced atomically. Callers hold mu.
+func (s *Store) save() error {
+	s.prune()
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.requests, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding access requests: %w", err)
+	}
+	if err := utils.WriteFile(s.path, data); err != nil {
+		return fmt.Errorf("error writing access requests: %w", err)
+	}
+	return nil
+}
+
+// load reads the requests saved by an earlier run, a missing file is an empty store
+func (s *Store) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading access requests: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.requests); err != nil {
+		return fmt.Errorf("error parsing access requests: %w", err)
+	}
+	if s.requests == nil {
+		s.requests = make(map[string]*Request)
+	}
+	s.reindex()
+	return nil
+}
+
+// NewStore creates a store persisting to path, which may be empty to keep requests in memory only
+func NewStore(logger zerolog.Logger, clock schedule.Clock, path string) (*Store, error) {
+	s := &Store{logger: logger, clock: clock, path: path, requests: make(map[string]*Request)}
+	if path != "" {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
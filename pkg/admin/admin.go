@@ -0,0 +1,37 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/netip"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// ErrNoToken is returned for an admin API without a token, anyone able to connect could approve access then
+var ErrNoToken = errors.New("the admin API requires a token")
+
+// Auth returns a middleware rejecting requests that don't carry token as bearer token
+func Auth(token string) (echo.MiddlewareFunc, error) {
+	if token == "" {
+		return nil, ErrNoToken
+	}
+	return middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+		return subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1, nil
+	}), nil
+}
+
+// Loopback reports whether the admin API listening on address is only reachable from the host itself
+func Loopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.IsLoopback()
+}
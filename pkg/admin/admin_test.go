@@ -0,0 +1,64 @@
+package admin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/suite"
+	"github.com/tb0hdan/go-webfilter/pkg/admin"
+)
+
+// AdminTestSuite defines the test suite for the admin API helpers
+type AdminTestSuite struct {
+	suite.Suite
+}
+
+// TestAuth tests that only requests with the token get through
+func (suite *AdminTestSuite) TestAuth() {
+	_, err := admin.Auth("")
+	suite.ErrorIs(err, admin.ErrNoToken)
+
+	auth, err := admin.Auth("secret")
+	suite.Require().NoError(err)
+	e := echo.New()
+	e.Group("/api", auth).GET("/ping", func(c echo.Context) error {
+		return c.NoContent(http.StatusNoContent)
+	})
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{name: "no token", status: http.StatusBadRequest},
+		{name: "wrong token", authorization: "Bearer guess", status: http.StatusUnauthorized},
+		{name: "token", authorization: "Bearer secret", status: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			req := httptest.NewRequest(http.MethodGet, "/api/ping", nil)
+			if tt.authorization != "" {
+				req.Header.Set(echo.HeaderAuthorization, tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			suite.Equal(tt.status, rec.Code)
+		})
+	}
+}
+
+// TestLoopback tests telling loopback listen addresses from reachable ones
+func (suite *AdminTestSuite) TestLoopback() {
+	for _, address := range []string{"127.0.0.1:8099", "[::1]:8099", "localhost:8099", "127.0.0.2:8099"} {
+		suite.True(admin.Loopback(address), address)
+	}
+	for _, address := range []string{":8099", "0.0.0.0:8099", "[::]:8099", "192.168.1.10:8099", "admin.example.com:8099", "8099"} {
+		suite.False(admin.Loopback(address), address)
+	}
+}
+
+// TestAdminTestSuite runs the test suite
+func TestAdminTestSuite(t *testing.T) {
+	suite.Run(t, new(AdminTestSuite))
+}
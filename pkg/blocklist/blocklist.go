@@ -0,0 +1,212 @@
+package blocklist
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// List describes a blocklist file
+type List struct {
+	// Name identifies the list in block reasons and logs, the file name if empty
+	Name string
+	// Category tags every domain of the list, e.g. ads or malware
+	Category string
+	Path     string
+	Format   Format
+}
+
+// kind is how a rule applies to a domain
+type kind uint8
+
+const (
+	// kindExact blocks the domain only, as in hosts files
+	kindExact kind = iota
+	// kindSubtree blocks the domain and all of its subdomains
+	kindSubtree
+	// kindException unblocks the domain and all of its subdomains, whatever list blocked them
+	kindException
+)
+
+// node is a domain in the trie, exact and subtree hold the index+1 of the first list blocking it
+type node struct {
+	exact     uint32
+	subtree   uint32
+	exception bool
+}
+
+// edge leads from a node to the child for one more label to the left
+type edge struct {
+	parent uint32
+	label  string
+}
+
+// Matcher is a suffix trie of blocked domains, labels are walked from the TLD so lookups cost one map access per label.
+// It is read-only once built and safe for concurrent use.
+type Matcher struct {
+	lists []*List
+	// nodes[0] is the root, the empty domain
+	nodes []node
+	edges map[edge]uint32
+}
+
+// Match returns the list blocking host (without port), or nil if it is not blocked or excepted
+func (m *Matcher) Match(host string) *List {
+	host = normalize(host)
+	var (
+		current uint32
+		found   uint32
+	)
+	for rest := host; rest != ""; {
+		label := rest
+		if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+			label, rest = rest[i+1:], rest[:i]
+		} else {
+			rest = ""
+		}
+		next, ok := m.edges[edge{parent: current, label: label}]
+		if !ok {
+			break
+		}
+		current = next
+		n := &m.nodes[current]
+		if n.exception {
+			return nil
+		}
+		if found == 0 {
+			found = n.subtree
+		}
+		if found == 0 && rest == "" {
+			found = n.exact
+		}
+	}
+	if found == 0 {
+		return nil
+	}
+	return m.lists[found-1]
+}
+
+// Lists returns the lists the matcher was built from
+func (m *Matcher) Lists() []*List {
+	return m.lists
+}
+
+// Len returns the number of domains in the trie, including intermediate ones
+func (m *Matcher) Len() int {
+	return len(m.nodes) - 1
+}
+
+// Builder adds lists to a new Matcher, the first list blocking a domain gives its category
+type Builder struct {
+	matcher *Matcher
+	// labels shares the storage of labels occurring in many domains, such as TLDs
+	labels map[string]string
+}
+
+// Add parses the rules of list from data and returns how many were added
+func (b *Builder) Add(list *List, data string) int {
+	if list.Name == "" {
+		list.Name = filepath.Base(list.Path)
+	}
+	b.matcher.lists = append(b.matcher.lists, list)
+	index := uint32(len(b.matcher.lists))
+	if len(b.matcher.edges) == 0 {
+		// Most lines add a domain with one new label, sizing for them up front saves rehashing the trie
+		b.matcher.edges = make(map[edge]uint32, strings.Count(data, "\n")+1)
+	}
+	added := 0
+	parse(data, list.Format, func(domain string, k kind) {
+		b.insert(domain, k, index)
+		added++
+	})
+	return added
+}
+
+// AddFile reads list.Path and adds its rules
+func (b *Builder) AddFile(list *List) (int, error) {
+	data, err := os.ReadFile(list.Path)
+	if err != nil {
+		return 0, fmt.Errorf("error reading blocklist: %w", err)
+	}
+	return b.Add(list, string(data)), nil
+}
+
+func (b *Builder) insert(domain string, k kind, list uint32) {
+	m := b.matcher
+	current := uint32(0)
+	for rest := domain; rest != ""; {
+		label := rest
+		if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+			label, rest = rest[i+1:], rest[:i]
+		} else {
+			rest = ""
+		}
+		interned, ok := b.labels[label]
+		if !ok {
+			// Labels are cloned so the matcher doesn't pin the list files in memory
+			interned = strings.Clone(label)
+			b.labels[interned] = interned
+		}
+		key := edge{parent: current, label: interned}
+		next, ok := m.edges[key]
+		if !ok {
+			m.nodes = append(m.nodes, node{})
+			next = uint32(len(m.nodes) - 1)
+			m.edges[key] = next
+		}
+		current = next
+	}
+	n := &m.nodes[current]
+	switch k {
+	case kindException:
+		n.exception = true
+	case kindSubtree:
+		if n.subtree == 0 {
+			n.subtree = list
+		}
+	case kindExact:
+		if n.exact == 0 {
+			n.exact = list
+		}
+	}
+}
+
+// Matcher returns the matcher built so far, the builder must not be used afterwards
+func (b *Builder) Matcher() *Matcher {
+	b.labels = nil
+	// Drop the spare capacity left by growing the nodes
+	b.matcher.nodes = slices.Clone(b.matcher.nodes)
+	return b.matcher
+}
+
+// NewBuilder creates a builder for a new matcher
+func NewBuilder() *Builder {
+	return &Builder{
+		matcher: &Matcher{nodes: []node{{}}, edges: make(map[edge]uint32)},
+		labels:  make(map[string]string),
+	}
+}
+
+// Load builds a matcher from list files
+func Load(lists []*List) (*Matcher, error) {
+	b := NewBuilder()
+	for _, list := range lists {
+		if _, err := b.AddFile(list); err != nil {
+			return nil, fmt.Errorf("blocklist %s: %w", list.Path, err)
+		}
+	}
+	return b.Matcher(), nil
+}
+
+// normalize lowercases host and strips the trailing dot, allocating only for uppercase hosts
+func normalize(host string) string {
+	host = strings.TrimSuffix(host, ".")
+	for i := 0; i < len(host); i++ {
+		if c := host[i]; c >= 'A' && c <= 'Z' {
+			return strings.ToLower(host)
+		}
+	}
+	return host
+}
@@ -0,0 +1,226 @@
+package blocklist_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+	"github.com/tb0hdan/go-webfilter/pkg/blocklist"
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+)
+
+// BlocklistTestSuite defines the test suite for blocklists
+type BlocklistTestSuite struct {
+	suite.Suite
+	matcher *blocklist.Matcher
+}
+
+// SetupTest loads the lists in testdata
+func (suite *BlocklistTestSuite) SetupTest() {
+	var err error
+	suite.matcher, err = blocklist.Load([]*blocklist.List{
+		{Category: "ads", Path: filepath.Join("testdata", "hosts.txt")},
+		{Name: "malware", Category: "malware", Path: filepath.Join("testdata", "adblock.txt"), Format: blocklist.FormatAdblock},
+		{Category: "gambling", Path: filepath.Join("testdata", "plain.txt")},
+	})
+	suite.Require().NoError(err)
+}
+
+// TestMatch tests the semantics of every format
+func (suite *BlocklistTestSuite) TestMatch() {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		// hosts files block the names only
+		{host: "ads.example.com", expected: "ads"},
+		{host: "ADS.example.com.", expected: "ads"},
+		{host: "www.ads.example.com"},
+		{host: "example.com"},
+		{host: "banner.example.net", expected: "ads"},
+		{host: "metrics.example.org", expected: "ads"},
+		{host: "localhost"},
+		{host: "ip6-loopback"},
+		// ||domain^ blocks subdomains, @@ exceptions win over every list
+		{host: "malware.example", expected: "malware"},
+		{host: "a.b.malware.example", expected: "malware"},
+		{host: "safe.malware.example"},
+		{host: "www.safe.malware.example"},
+		{host: "tracker.example.net"},
+		{host: "phishing.example.com", expected: "malware"},
+		{host: "cdn.example.com"},
+		{host: "example.org"},
+		{host: "wild.example"},
+		// plain lists block subdomains
+		{host: "casino.example", expected: "gambling"},
+		{host: "www.casino.example", expected: "gambling"},
+		{host: "poker.example", expected: "gambling"},
+		{host: "bets.example", expected: "gambling"},
+		{host: "words.example"},
+		{host: "example"},
+		{host: ""},
+	}
+
+	for _, tt := range tests {
+		suite.Run(tt.host, func() {
+			list := suite.matcher.Match(tt.host)
+			if tt.expected == "" {
+				suite.Nil(list)
+				return
+			}
+			suite.Require().NotNil(list)
+			suite.Equal(tt.expected, list.Category)
+		})
+	}
+}
+
+// TestLists tests list names and the first list winning a domain
+func (suite *BlocklistTestSuite) TestLists() {
+	lists := suite.matcher.Lists()
+	suite.Require().Len(lists, 3)
+	suite.Equal("hosts.txt", lists[0].Name)
+	suite.Equal("malware", lists[1].Name)
+
+	b := blocklist.NewBuilder()
+	suite.Equal(2, b.Add(&blocklist.List{Name: "first", Category: "ads"}, "example.com\n0.0.0.0 www.example.com"))
+	suite.Equal(1, b.Add(&blocklist.List{Name: "second", Category: "tracking"}, "||example.com^"))
+	suite.Equal(0, b.Add(&blocklist.List{Name: "hosts", Format: blocklist.FormatHosts}, "||example.net^"))
+	m := b.Matcher()
+	suite.Equal("first", m.Match("www.example.com").Name)
+	suite.Equal("first", m.Match("example.com").Name)
+	suite.Equal(3, m.Len())
+
+	_, err := blocklist.Load([]*blocklist.List{{Path: filepath.Join("testdata", "missing.txt")}})
+	suite.ErrorContains(err, "error reading blocklist")
+}
+
+// TestParseFormat tests format names
+func (suite *BlocklistTestSuite) TestParseFormat() {
+	format, err := blocklist.ParseFormat("ABP")
+	suite.NoError(err)
+	suite.Equal(blocklist.FormatAdblock, format)
+	format, err = blocklist.ParseFormat("")
+	suite.NoError(err)
+	suite.Equal(blocklist.FormatAuto, format)
+	_, err = blocklist.ParseFormat("csv")
+	suite.EqualError(err, `unknown blocklist format "csv"`)
+}
+
+// TestHook tests blocking requests and passed through TLS connections
+func (suite *BlocklistTestSuite) TestHook() {
+	hook := blocklist.New(zerolog.Nop(), suite.matcher)
+
+	req := httptest.NewRequest(http.MethodGet, "http://www.casino.example:8080/", nil)
+	decision, err := hook.BeforeRequest(echo.New().NewContext(req, httptest.NewRecorder()))
+	suite.NoError(err)
+	suite.Equal(hooks.ActionBlock, decision.Action)
+	suite.Equal("gambling", decision.Category)
+	suite.Equal("www.casino.example is on the plain.txt blocklist", decision.Reason)
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	decision, err = hook.BeforeRequest(echo.New().NewContext(req, httptest.NewRecorder()))
+	suite.NoError(err)
+	suite.Equal(hooks.ActionAllow, decision.Action)
+
+	suite.EqualError(hook.BeforeTLS(&hooks.TLSInfo{ServerName: "malware.example"}), "malware.example is on blocklist malware")
+	suite.NoError(hook.BeforeTLS(&hooks.TLSInfo{ServerName: "example.com"}))
+
+	hook.SetMatcher(blocklist.NewBuilder().Matcher())
+	suite.NoError(hook.BeforeTLS(&hooks.TLSInfo{ServerName: "malware.example"}))
+}
+
+// TestBlocklistTestSuite runs the test suite
+func TestBlocklistTestSuite(t *testing.T) {
+	suite.Run(t, new(BlocklistTestSuite))
+}
+
+// syntheticDomains returns n distinct domains shaped like public lists: mostly second level, some deeper
+func syntheticDomains(n int) []string {
+	tlds := []string{"com", "net", "org", "io", "info", "xyz", "de", "ru", "co.uk", "com.br"}
+	domains := make([]string, n)
+	for i := range domains {
+		switch i % 4 {
+		case 0:
+			domains[i] = fmt.Sprintf("ads%d.tracker%d.%s", i, i%1000, tlds[i%len(tlds)])
+		default:
+			domains[i] = fmt.Sprintf("site-%x%d.%s", i*2654435761, i, tlds[i%len(tlds)])
+		}
+	}
+	return domains
+}
+
+// syntheticList renders domains as a plain list
+func syntheticList(domains []string) string {
+	return strings.Join(domains, "\n")
+}
+
+const benchmarkDomains = 1_000_000
+
+func BenchmarkBuild(b *testing.B) {
+	data := syntheticList(syntheticDomains(benchmarkDomains))
+	b.ResetTimer()
+	for range b.N {
+		builder := blocklist.NewBuilder()
+		builder.Add(&blocklist.List{Name: "synthetic"}, data)
+		_ = builder.Matcher()
+	}
+}
+
+// BenchmarkMemory reports the heap retained by a matcher of a million domains
+func BenchmarkMemory(b *testing.B) {
+	data := syntheticList(syntheticDomains(benchmarkDomains))
+	var before, after runtime.MemStats
+	for range b.N {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		builder := blocklist.NewBuilder()
+		builder.Add(&blocklist.List{Name: "synthetic"}, data)
+		m := builder.Matcher()
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/(1<<20), "MiB")
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/benchmarkDomains, "B/domain")
+		runtime.KeepAlive(m)
+	}
+}
+
+func benchmarkMatch(b *testing.B, hosts func(domains []string, i int) string, blocked bool) {
+	domains := syntheticDomains(benchmarkDomains)
+	builder := blocklist.NewBuilder()
+	builder.Add(&blocklist.List{Name: "synthetic"}, syntheticList(domains))
+	m := builder.Matcher()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range b.N {
+		if (m.Match(hosts(domains, i%len(domains))) != nil) != blocked {
+			b.Fatal("unexpected match result")
+		}
+	}
+}
+
+func BenchmarkMatchHit(b *testing.B) {
+	benchmarkMatch(b, func(domains []string, i int) string { return domains[i] }, true)
+}
+
+func BenchmarkMatchSubdomain(b *testing.B) {
+	subdomains := syntheticDomains(benchmarkDomains)
+	for i := range subdomains {
+		subdomains[i] = "a.b.c." + subdomains[i]
+	}
+	benchmarkMatch(b, func(domains []string, i int) string { return subdomains[i] }, true)
+}
+
+func BenchmarkMatchMiss(b *testing.B) {
+	misses := syntheticDomains(benchmarkDomains)
+	for i := range misses {
+		misses[i] = "x" + misses[i]
+	}
+	benchmarkMatch(b, func(domains []string, i int) string { return misses[i] }, false)
+}
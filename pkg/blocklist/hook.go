@@ -0,0 +1,60 @@
+package blocklist
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+)
+
+// Hook blocks requests to domains on the blocklists
+type Hook struct {
+	logger  zerolog.Logger
+	matcher atomic.Pointer[Matcher]
+}
+
+// Matcher returns the active matcher
+func (h *Hook) Matcher() *Matcher {
+	return h.matcher.Load()
+}
+
+// SetMatcher replaces the active matcher, requests in flight finish with the old one
+func (h *Hook) SetMatcher(m *Matcher) {
+	h.matcher.Store(m)
+}
+
+func (h *Hook) BeforeRequest(c echo.Context) (hooks.Decision, error) {
+	host := c.Request().Host
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	list := h.Matcher().Match(host)
+	if list == nil {
+		return hooks.Allow(), nil
+	}
+	h.logger.Debug().Msgf("%s is on blocklist %s", host, list.Name)
+	return hooks.Block(fmt.Sprintf("%s is on the %s blocklist", host, list.Name), list.Category), nil
+}
+
+func (h *Hook) AfterRequest(c echo.Context, rsp *http.Response) error {
+	return nil
+}
+
+// BeforeTLS resets passed through connections to blocked server names
+func (h *Hook) BeforeTLS(info *hooks.TLSInfo) error {
+	if list := h.Matcher().Match(info.ServerName); list != nil {
+		return fmt.Errorf("%s is on blocklist %s", info.ServerName, list.Name)
+	}
+	return nil
+}
+
+// New creates a hook blocking the domains matched by m
+func New(logger zerolog.Logger, m *Matcher) *Hook {
+	h := &Hook{logger: logger}
+	h.SetMatcher(m)
+	return h
+}
@@ -0,0 +1,189 @@
+package blocklist
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Format is the syntax of a list file
+type Format int
+
+const (
+	// FormatAuto detects the format of every line, lists mixing formats are common
+	FormatAuto Format = iota
+	// FormatHosts is the hosts file format, "0.0.0.0 example.com", blocking the names only
+	FormatHosts
+	// FormatPlain is one domain per line, blocking the domain and its subdomains
+	FormatPlain
+	// FormatAdblock is the domain subset of Adblock Plus filters, "||example.com^" and "@@||example.com^"
+	FormatAdblock
+)
+
+// ParseFormat parses a format name: auto, hosts, plain or adblock
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "", "auto":
+		return FormatAuto, nil
+	case "hosts":
+		return FormatHosts, nil
+	case "plain", "domains":
+		return FormatPlain, nil
+	case "adblock", "abp":
+		return FormatAdblock, nil
+	}
+	return FormatAuto, fmt.Errorf("unknown blocklist format %q", name)
+}
+
+// hostsBoilerplate are the names every hosts file maps, they are not blocked
+var hostsBoilerplate = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+}
+
+// adblockOptions are the filter options that still mean blocking the whole domain
+var adblockOptions = map[string]bool{
+	"important": true,
+	"all":       true,
+	"document":  true,
+}
+
+// parse calls add for every rule in data, lines that are not valid rules are skipped
+func parse(data string, format Format, add func(domain string, k kind)) {
+	for len(data) > 0 {
+		line := data
+		if i := strings.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = ""
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		lineFormat := format
+		if lineFormat == FormatAuto {
+			lineFormat = detect(line)
+		}
+		switch lineFormat {
+		case FormatHosts:
+			parseHosts(line, add)
+		case FormatAdblock:
+			parseAdblock(line, add)
+		default:
+			parsePlain(line, add)
+		}
+	}
+}
+
+// detect guesses the format of a line
+func detect(line string) Format {
+	switch line[0] {
+	case '|', '@', '!', '[':
+		return FormatAdblock
+	}
+	field := line
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		field = line[:i]
+	}
+	// Parsing allocates, only what could be an address is parsed
+	if (field[0] >= '0' && field[0] <= '9' || strings.IndexByte(field, ':') >= 0) && net.ParseIP(field) != nil {
+		return FormatHosts
+	}
+	return FormatPlain
+}
+
+func parseHosts(line string, add func(domain string, k kind)) {
+	line, _, _ = strings.Cut(line, "#")
+	fields := strings.Fields(line)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return
+	}
+	for _, name := range fields[1:] {
+		if domain, ok := domainName(name); ok && !hostsBoilerplate[domain] {
+			add(domain, kindExact)
+		}
+	}
+}
+
+func parsePlain(line string, add func(domain string, k kind)) {
+	if line[0] == '#' {
+		return
+	}
+	line, _, _ = strings.Cut(line, "#")
+	line = strings.TrimSpace(line)
+	if strings.ContainsAny(line, " \t") {
+		return
+	}
+	// *.example.com and .example.com are spelled out subtrees
+	name := strings.TrimPrefix(strings.TrimPrefix(line, "*"), ".")
+	if domain, ok := domainName(name); ok {
+		add(domain, kindSubtree)
+	}
+}
+
+// parseAdblock accepts ||domain^ rules and @@ exceptions, anything narrower than a whole domain is skipped
+func parseAdblock(line string, add func(domain string, k kind)) {
+	k := kindSubtree
+	if rest, ok := strings.CutPrefix(line, "@@"); ok {
+		k, line = kindException, rest
+	}
+	line, ok := strings.CutPrefix(line, "||")
+	if !ok {
+		return
+	}
+	line, options, _ := strings.Cut(line, "$")
+	if options != "" {
+		for _, option := range strings.Split(options, ",") {
+			if !adblockOptions[option] {
+				return
+			}
+		}
+	}
+	name, ok := strings.CutSuffix(line, "^")
+	if !ok {
+		name, ok = strings.CutSuffix(line, "^|")
+	}
+	if !ok {
+		return
+	}
+	if domain, ok := domainName(name); ok {
+		add(domain, k)
+	}
+}
+
+// domainName lowercases name and reports whether it is a valid domain name
+func domainName(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" || len(name) > 253 {
+		return "", false
+	}
+	label := 0
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case c == '.':
+			if label == 0 {
+				return "", false
+			}
+			label = 0
+			continue
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return "", false
+		}
+		label++
+		if label > 63 {
+			return "", false
+		}
+	}
+	return name, label > 0
+}
@@ -0,0 +1,302 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tb0hdan/go-webfilter/pkg/utils"
+)
+
+const (
+	caCertFile = "ca.crt"
+	caKeyFile  = "ca.key"
+	leavesDir  = "leaves"
+	// caValidity is how long a freshly generated root CA is valid for
+	caValidity = 10 * 365 * 24 * time.Hour
+	// LeafValidity is how long minted leaf certificates are valid for
+	LeafValidity = 30 * 24 * time.Hour
+	// leafRenewBefore makes cached leaves get replaced before clients start rejecting them
+	leafRenewBefore = 24 * time.Hour
+)
+
+// Authority is a local certificate authority that mints leaf certificates
+// for intercepted HTTPS hosts on demand
+type Authority struct {
+	logger  zerolog.Logger
+	dir     string
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+	now     func() time.Time
+
+	mu     sync.Mutex
+	leaves map[string]*tls.Certificate
+}
+
+// CertificatePEM returns the root CA certificate for installation into client trust stores
+func (a *Authority) CertificatePEM() []byte {
+	return a.certPEM
+}
+
+// CertificatePath returns the location of the root CA certificate on disk
+func (a *Authority) CertificatePath() string {
+	return filepath.Join(a.dir, caCertFile)
+}
+
+// TLSConfig returns a server configuration that presents a minted certificate for every SNI name
+func (a *Authority) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: a.GetCertificate,
+		NextProtos:     []string{"http/1.1"},
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate. Clients that don't send SNI
+// get a certificate for the IP address they connected to.
+func (a *Authority) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := hello.ServerName
+	if name == "" && hello.Conn != nil {
+		if dst, err := utils.OriginalDst(hello.Conn); err == nil {
+			name = dst.IP.String()
+		} else if local, ok := hello.Conn.LocalAddr().(*net.TCPAddr); ok {
+			name = local.IP.String()
+		}
+	}
+	if name == "" {
+		return nil, errors.New("unable to determine certificate name")
+	}
+	return a.Certificate(name)
+}
+
+// Certificate returns a leaf certificate for name, from memory, disk or freshly minted
+func (a *Authority) Certificate(name string) (*tls.Certificate, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if !validName(name) {
+		return nil, fmt.Errorf("invalid certificate name %q", name)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if leaf, ok := a.leaves[name]; ok && a.usable(leaf) {
+		return leaf, nil
+	}
+	leafPath := a.leafPath(name)
+	if leaf, err := tls.LoadX509KeyPair(leafPath, leafPath); err == nil && a.usable(&leaf) {
+		a.leaves[name] = &leaf
+		return &leaf, nil
+	}
+
+	leaf, leafPEM, err := a.mint(name)
+	if err != nil {
+		return nil, err
+	}
+	a.leaves[name] = leaf
+	if err := os.WriteFile(leafPath, leafPEM, 0600); err != nil {
+		// The in-memory copy is still fine, it just won't survive a restart
+		a.logger.Warn().Err(err).Msgf("Error saving certificate for %s", name)
+	}
+	a.logger.Debug().Msgf("Minted certificate for %s", name)
+	return leaf, nil
+}
+
+// usable checks that a leaf is signed by this CA and is not about to expire
+func (a *Authority) usable(leaf *tls.Certificate) bool {
+	if leaf.Leaf == nil {
+		parsed, err := x509.ParseCertificate(leaf.Certificate[0])
+		if err != nil {
+			return false
+		}
+		leaf.Leaf = parsed
+	}
+	if a.now().Add(leafRenewBefore).After(leaf.Leaf.NotAfter) {
+		return false
+	}
+	return leaf.Leaf.CheckSignatureFrom(a.cert) == nil
+}
+
+func (a *Authority) leafPath(name string) string {
+	// IPv6 addresses contain colons, which are not welcome in file names
+	return filepath.Join(a.dir, leavesDir, strings.ReplaceAll(name, ":", "_")+".pem")
+}
+
+// mint issues a new leaf certificate and returns it along with its PEM encoding (certificate and key)
+func (a *Authority) mint(name string) (*tls.Certificate, []byte, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := a.now()
+	notAfter := now.Add(LeafValidity)
+	if notAfter.After(a.cert.NotAfter) {
+		notAfter = a.cert.NotAfter
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"go-webfilter"},
+			CommonName:   name,
+		},
+		// Allow for clients with a slightly wrong clock
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, a.cert, &priv.PublicKey, a.key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal key: %w", err)
+	}
+	leafPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	leafPEM = append(leafPEM, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+
+	leaf, err := tls.X509KeyPair(leafPEM, leafPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load minted certificate: %w", err)
+	}
+	return &leaf, leafPEM, nil
+}
+
+// load reads the root CA from disk, generating it on first use
+func (a *Authority) load() error {
+	certPath := filepath.Join(a.dir, caCertFile)
+	keyPath := filepath.Join(a.dir, caKeyFile)
+	if _, err := os.Stat(certPath); errors.Is(err, os.ErrNotExist) {
+		if err := a.generate(certPath, keyPath); err != nil {
+			return err
+		}
+	}
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load CA: %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+	if !cert.IsCA {
+		return fmt.Errorf("%s is not a CA certificate", certPath)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported CA key type %T", pair.PrivateKey)
+	}
+	a.cert = cert
+	a.key = key
+	a.certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	return nil
+}
+
+// generate creates a new root CA and saves it to disk
+func (a *Authority) generate(certPath, keyPath string) error {
+	a.logger.Info().Msgf("Generating root CA in %s", a.dir)
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate CA key: %w", err)
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return err
+	}
+	now := a.now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"go-webfilter"},
+			CommonName:   "go-webfilter Root CA",
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("failed to marshal CA key: %w", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return fmt.Errorf("failed to write CA key: %w", err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644); err != nil {
+		return fmt.Errorf("failed to write CA certificate: %w", err)
+	}
+	return nil
+}
+
+func serialNumber() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial, nil
+}
+
+// validName accepts host names and IP addresses, which also keeps them safe to use as file names
+func validName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	if net.ParseIP(name) != nil {
+		return true
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '.' && r != '_' && r != '*' {
+			return false
+		}
+	}
+	return !strings.Contains(name, "..")
+}
+
+// New loads the CA stored in dir, generating a new one if there is none yet
+func New(logger zerolog.Logger, dir string) (*Authority, error) {
+	if err := os.MkdirAll(filepath.Join(dir, leavesDir), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create CA directory: %w", err)
+	}
+	a := &Authority{
+		logger: logger,
+		dir:    dir,
+		now:    time.Now,
+		leaves: make(map[string]*tls.Certificate),
+	}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
@@ -0,0 +1,123 @@
+package ca
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func verify(t *testing.T, a *Authority, leaf *tls.Certificate, name string) {
+	t.Helper()
+	pool := x509.NewCertPool()
+	require.True(t, pool.AppendCertsFromPEM(a.CertificatePEM()))
+	parsed, err := x509.ParseCertificate(leaf.Certificate[0])
+	require.NoError(t, err)
+	_, err = parsed.Verify(x509.VerifyOptions{DNSName: name, Roots: pool})
+	assert.NoError(t, err)
+}
+
+func TestNew(t *testing.T) {
+	dir := t.TempDir()
+	a, err := New(zerolog.Nop(), dir)
+	require.NoError(t, err)
+	assert.True(t, a.cert.IsCA)
+	assert.NotEmpty(t, a.CertificatePEM())
+
+	t.Run("existing CA is reused", func(t *testing.T) {
+		b, err := New(zerolog.Nop(), dir)
+		require.NoError(t, err)
+		assert.Equal(t, a.CertificatePEM(), b.CertificatePEM())
+	})
+}
+
+func TestCertificate(t *testing.T) {
+	dir := t.TempDir()
+	a, err := New(zerolog.Nop(), dir)
+	require.NoError(t, err)
+
+	t.Run("host name", func(t *testing.T) {
+		leaf, err := a.Certificate("Example.COM.")
+		require.NoError(t, err)
+		verify(t, a, leaf, "example.com")
+	})
+
+	t.Run("IP address", func(t *testing.T) {
+		leaf, err := a.Certificate("2001:db8::1")
+		require.NoError(t, err)
+		verify(t, a, leaf, "2001:db8::1")
+	})
+
+	t.Run("memory cache", func(t *testing.T) {
+		first, err := a.Certificate("cached.example.com")
+		require.NoError(t, err)
+		second, err := a.Certificate("cached.example.com")
+		require.NoError(t, err)
+		assert.Same(t, first, second)
+	})
+
+	t.Run("disk cache", func(t *testing.T) {
+		first, err := a.Certificate("disk.example.com")
+		require.NoError(t, err)
+		b, err := New(zerolog.Nop(), dir)
+		require.NoError(t, err)
+		second, err := b.Certificate("disk.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, first.Certificate, second.Certificate)
+	})
+
+	t.Run("expiring certificate is replaced", func(t *testing.T) {
+		first, err := a.Certificate("expiry.example.com")
+		require.NoError(t, err)
+		a.now = func() time.Time { return time.Now().Add(LeafValidity) }
+		defer func() { a.now = time.Now }()
+		second, err := a.Certificate("expiry.example.com")
+		require.NoError(t, err)
+		assert.NotEqual(t, first.Certificate, second.Certificate)
+	})
+
+	t.Run("invalid names", func(t *testing.T) {
+		for _, name := range []string{"", "../../etc/passwd", "bad/name", "a..b"} {
+			_, err := a.Certificate(name)
+			assert.Error(t, err, name)
+		}
+	})
+}
+
+func TestTLSConfig(t *testing.T) {
+	a, err := New(zerolog.Nop(), t.TempDir())
+	require.NoError(t, err)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", a.TLSConfig())
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_ = conn.(*tls.Conn).Handshake()
+		_ = conn.Close()
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(a.CertificatePEM())
+
+	t.Run("SNI", func(t *testing.T) {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{ServerName: "intercepted.example.com", RootCAs: pool})
+		require.NoError(t, err)
+		_ = conn.Close()
+	})
+}
+
+func TestValidName(t *testing.T) {
+	assert.True(t, validName("example.com"))
+	assert.True(t, validName("127.0.0.1"))
+	assert.True(t, validName("::1"))
+	assert.False(t, validName("exa mple.com"))
+	assert.False(t, validName(string(make([]byte, 300))))
+}
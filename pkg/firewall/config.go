@@ -0,0 +1,129 @@
+package firewall
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Config selects the traffic the firewall redirects
+type Config struct {
+	// HTTPPorts are redirected to the HTTP listener, TLSPorts to the HTTPS one
+	HTTPPorts []int
+	TLSPorts  []int
+	// Bypass holds destinations that are never redirected, e.g. monitoring networks
+	Bypass []netip.Prefix
+	// ExcludeLoopback leaves traffic to the host itself alone
+	ExcludeLoopback bool
+}
+
+// DefaultConfig redirects the standard HTTP and HTTPS ports
+func DefaultConfig() Config {
+	return Config{HTTPPorts: []int{80}, TLSPorts: []int{443}}
+}
+
+// Validate checks the ports and that none of them is both an HTTP and a TLS port
+func (c Config) Validate() error {
+	if len(c.HTTPPorts)+len(c.TLSPorts) == 0 {
+		return errors.New("no ports to redirect")
+	}
+	for _, port := range slices.Concat(c.HTTPPorts, c.TLSPorts) {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	for _, port := range c.HTTPPorts {
+		if slices.Contains(c.TLSPorts, port) {
+			return fmt.Errorf("port %d is both an HTTP and a TLS port", port)
+		}
+	}
+	for _, prefix := range c.Bypass {
+		if !prefix.IsValid() {
+			return fmt.Errorf("invalid bypass destination %s", prefix)
+		}
+	}
+	return nil
+}
+
+// Ports returns ports sorted and without duplicates
+func Ports(ports []int) []int {
+	sorted := slices.Clone(ports)
+	slices.Sort(sorted)
+	return slices.Compact(sorted)
+}
+
+// BypassIPv4 returns the IPv4 bypass destinations, sorted and without the ones covered by another
+func (c Config) BypassIPv4() []netip.Prefix {
+	return bypass(c.Bypass, true)
+}
+
+// BypassIPv6 returns the IPv6 bypass destinations, sorted and without the ones covered by another
+func (c Config) BypassIPv6() []netip.Prefix {
+	return bypass(c.Bypass, false)
+}
+
+func bypass(prefixes []netip.Prefix, is4 bool) []netip.Prefix {
+	var family []netip.Prefix
+	for _, prefix := range prefixes {
+		if prefix.Addr().Is4() == is4 {
+			family = append(family, prefix.Masked())
+		}
+	}
+	// Covering prefixes sort right before the prefixes they cover
+	slices.SortFunc(family, func(a, b netip.Prefix) int {
+		return cmp.Or(a.Addr().Compare(b.Addr()), cmp.Compare(a.Bits(), b.Bits()))
+	})
+	var merged []netip.Prefix
+	for _, prefix := range family {
+		if len(merged) > 0 && merged[len(merged)-1].Overlaps(prefix) {
+			continue
+		}
+		merged = append(merged, prefix)
+	}
+	return merged
+}
+
+// ParsePorts parses a comma separated list of ports
+func ParsePorts(value string) ([]int, error) {
+	var ports []int
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		port, err := strconv.Atoi(item)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// ParsePrefixes parses a comma separated list of CIDRs and addresses, an address stands for itself alone
+func ParsePrefixes(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing destination %q: %w", item, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing destination %q: %w", item, err)
+		}
+		addr = addr.Unmap().WithZone("")
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,63 @@
+package firewall_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/tb0hdan/go-webfilter/pkg/firewall"
+)
+
+// ConfigTestSuite defines the test suite for the firewall configuration
+type ConfigTestSuite struct {
+	suite.Suite
+}
+
+// TestParse tests parsing port and destination lists
+func (suite *ConfigTestSuite) TestParse() {
+	ports, err := firewall.ParsePorts(" 80, 8080,,3128 ")
+	suite.Require().NoError(err)
+	suite.Equal([]int{80, 8080, 3128}, ports)
+	for _, invalid := range []string{"http", "0", "65536", "80-90"} {
+		_, err := firewall.ParsePorts(invalid)
+		suite.Error(err, invalid)
+	}
+
+	prefixes, err := firewall.ParsePrefixes("10.1.2.3/8, 192.0.2.7, ::ffff:198.51.100.1, 2001:db8::1")
+	suite.Require().NoError(err)
+	suite.Equal([]netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.7/32"),
+		netip.MustParsePrefix("198.51.100.1/32"),
+		netip.MustParsePrefix("2001:db8::1/128"),
+	}, prefixes)
+	for _, invalid := range []string{"10.0.0.0/33", "example.com", "10.0.0"} {
+		_, err := firewall.ParsePrefixes(invalid)
+		suite.Error(err, invalid)
+	}
+}
+
+// TestBypass tests that destinations are split by family with the covered ones dropped
+func (suite *ConfigTestSuite) TestBypass() {
+	bypass, err := firewall.ParsePrefixes("192.0.2.7, 10.20.30.0/24, 10.0.0.0/8, 2001:db8::/32, 2001:db8:1::/48, ::1, 10.0.0.0/8")
+	suite.Require().NoError(err)
+	config := firewall.Config{Bypass: bypass}
+	suite.Equal([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.0.2.7/32")}, config.BypassIPv4())
+	suite.Equal([]netip.Prefix{netip.MustParsePrefix("::1/128"), netip.MustParsePrefix("2001:db8::/32")}, config.BypassIPv6())
+	suite.Equal([]int{80, 3128, 8080}, firewall.Ports([]int{8080, 80, 3128, 80}))
+}
+
+// TestValidate tests the checks of a configuration
+func (suite *ConfigTestSuite) TestValidate() {
+	suite.NoError(firewall.DefaultConfig().Validate())
+	suite.NoError(firewall.Config{TLSPorts: []int{443}}.Validate())
+	suite.EqualError(firewall.Config{}.Validate(), "no ports to redirect")
+	suite.EqualError(firewall.Config{HTTPPorts: []int{80, 70000}}.Validate(), "invalid port 70000")
+	suite.EqualError(firewall.Config{HTTPPorts: []int{80, 8443}, TLSPorts: []int{8443}}.Validate(), "port 8443 is both an HTTP and a TLS port")
+	suite.EqualError(firewall.Config{HTTPPorts: []int{80}, Bypass: []netip.Prefix{{}}}.Validate(), "invalid bypass destination invalid Prefix")
+}
+
+// TestConfigTestSuite runs the test suite
+func TestConfigTestSuite(t *testing.T) {
+	suite.Run(t, new(ConfigTestSuite))
+}
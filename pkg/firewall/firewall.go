@@ -1,6 +1,12 @@
 package firewall
 
 type Firewall interface {
+	// SetConfig selects the ports and destinations redirected by InstallRules, DefaultConfig until it is called
+	SetConfig(config Config) error
 	InstallRules(redirectPort int, redirectHTTPSPort int) error
 	UninstallRules() error
+	// Render returns the complete ruleset InstallRules would install for the ports, without applying it
+	Render(redirectPort int, redirectHTTPSPort int) string
+	// Recover removes rules left behind by an instance that is no longer running
+	Recover() error
 }
@@ -0,0 +1,27 @@
+// Package golden compares the rendered firewall rules in tests with the files in testdata
+package golden
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// update rewrites the golden files in testdata instead of comparing with them
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Assert compares rendered with the file name in testdata, rewriting it first when tests run with -update
+func Assert(t testing.TB, name string, rendered string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		require.NoError(t, os.WriteFile(path, []byte(rendered), 0o644))
+	}
+	expected, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), rendered)
+}
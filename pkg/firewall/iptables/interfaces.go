@@ -0,0 +1,9 @@
+package iptables
+
+// Runner runs iptables commands, tests record them instead
+type Runner interface {
+	// Run runs the command and returns its combined output
+	Run(name string, args ...string) ([]byte, error)
+	// RunWithInput runs the command with input on stdin and returns its combined output
+	RunWithInput(input []byte, name string, args ...string) ([]byte, error)
+}
@@ -0,0 +1,297 @@
+package iptables
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/tb0hdan/go-webfilter/pkg/firewall"
+)
+
+// Chain is the nat chain holding the redirects, OUTPUT jumps to it
+const Chain = "GO_WEBFILTER"
+
+// maxJumps bounds the removal of duplicated jumps to Chain
+const maxJumps = 16
+
+// maxMultiport is the number of ports the multiport match takes
+const maxMultiport = 15
+
+// commentPattern finds the owner comment in the output of iptables -S
+var commentPattern = regexp.MustCompile(`--comment "?([^"]*)"?`)
+
+// noChain is what iptables prints for a chain that doesn't exist
+const noChain = "No chain/target/match by that name"
+
+// ExecRunner runs commands with os/exec
+type ExecRunner struct{}
+
+func (ExecRunner) Run(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+func (ExecRunner) RunWithInput(input []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	return cmd.CombinedOutput()
+}
+
+// IPTablesFirewall redirects traffic with iptables (legacy or nft based), for hosts without nftables.
+// Rules are installed for every command, iptables for IPv4 and ip6tables for IPv6.
+type IPTablesFirewall struct {
+	logger   zerolog.Logger
+	runner   Runner
+	commands []string
+	config   firewall.Config
+}
+
+func (f *IPTablesFirewall) SetConfig(config firewall.Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	f.config = config
+	return nil
+}
+
+// rules returns the rules of Chain for command: root's traffic, the loopback interface and the bypassed destinations
+// of the command's family are not redirected, the HTTP and TLS ports go to the local ports.
+// The first rule carries the owner comment. Without ipset every destination takes a rule.
+func (f *IPTablesFirewall) rules(command string, owner firewall.Owner) [][]string {
+	rules := [][]string{{"-m", "owner", "--uid-owner", "0", "-m", "comment", "--comment", owner.String(), "-j", "RETURN"}}
+	if f.config.ExcludeLoopback {
+		rules = append(rules, []string{"-o", "lo", "-j", "RETURN"})
+	}
+	bypass := f.config.BypassIPv4()
+	if strings.HasPrefix(filepath.Base(command), "ip6") {
+		bypass = f.config.BypassIPv6()
+	}
+	for _, prefix := range bypass {
+		rules = append(rules, []string{"-d", prefix.String(), "-j", "RETURN"})
+	}
+	redirect := func(ports []int, to int) {
+		ports = firewall.Ports(ports)
+		if len(ports) == 1 {
+			rules = append(rules, []string{"-p", "tcp", "--dport", strconv.Itoa(ports[0]), "-j", "REDIRECT", "--to-ports", strconv.Itoa(to)})
+			return
+		}
+		for i := 0; i < len(ports); i += maxMultiport {
+			dports := make([]string, 0, maxMultiport)
+			for _, port := range ports[i:min(i+maxMultiport, len(ports))] {
+				dports = append(dports, strconv.Itoa(port))
+			}
+			rules = append(rules, []string{"-p", "tcp", "-m", "multiport", "--dports", strings.Join(dports, ","), "-j", "REDIRECT", "--to-ports", strconv.Itoa(to)})
+		}
+	}
+	redirect(f.config.HTTPPorts, owner.HTTPPort)
+	redirect(f.config.TLSPorts, owner.HTTPSPort)
+	return rules
+}
+
+// InstallRules applies the ruleset of each command with a single iptables-restore, so the chain is never
+// seen half installed. A chain left by an earlier instance is replaced in the same transaction.
+func (f *IPTablesFirewall) InstallRules(redirectPort int, redirectHTTPSPort int) error {
+	// Another running instance is checked for everywhere before anything changes
+	comments := make(map[string]string)
+	for _, command := range f.commands {
+		comment, exists, err := f.comment(command)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := firewall.InUse(comment); err != nil {
+				return err
+			}
+			comments[command] = comment
+		}
+	}
+	owner := firewall.NewOwner(redirectPort, redirectHTTPSPort)
+	for _, command := range f.commands {
+		jumps := 0
+		if comment, exists := comments[command]; exists {
+			f.logger.Warn().Msgf("Replacing %s chain %s left by %q", command, Chain, comment)
+			var err error
+			if jumps, err = f.jumps(command); err != nil {
+				return err
+			}
+		}
+		if err := f.restore(command, f.ruleset(command, owner, jumps)); err != nil {
+			// Each family is installed atomically, the ones before it have to be removed
+			if cleanupErr := f.UninstallRules(); cleanupErr != nil {
+				f.logger.Error().Err(cleanupErr).Msg("Error removing partially installed rules")
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Render returns the rules InstallRules adds to the nat table of each command, in iptables-save syntax
+func (f *IPTablesFirewall) Render(redirectPort int, redirectHTTPSPort int) string {
+	var b strings.Builder
+	owner := firewall.NewOwner(redirectPort, redirectHTTPSPort)
+	for _, command := range f.commands {
+		fmt.Fprintf(&b, "# %s\n%s", command, f.ruleset(command, owner, 0))
+	}
+	return b.String()
+}
+
+// ruleset returns the nat table input of iptables-restore for command. Declaring Chain flushes it if it
+// exists, the given number of jumps to it are removed from OUTPUT before the new one is added.
+func (f *IPTablesFirewall) ruleset(command string, owner firewall.Owner, jumps int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*nat\n:%s - [0:0]\n", Chain)
+	for range jumps {
+		b.WriteString(save([]string{"-D", "OUTPUT", "-j", Chain}))
+	}
+	for _, rule := range f.rules(command, owner) {
+		b.WriteString(save(append([]string{"-A", Chain}, rule...)))
+	}
+	b.WriteString(save([]string{"-A", "OUTPUT", "-j", Chain}))
+	b.WriteString("COMMIT\n")
+	return b.String()
+}
+
+// save writes a rule the way iptables-save does, quoting arguments with spaces
+func save(rule []string) string {
+	args := make([]string, 0, len(rule))
+	for _, arg := range rule {
+		if strings.Contains(arg, " ") {
+			arg = strconv.Quote(arg)
+		}
+		args = append(args, arg)
+	}
+	return strings.Join(args, " ") + "\n"
+}
+
+// restore applies ruleset with the iptables-restore of command, e.g. ip6tables-legacy-restore for ip6tables-legacy,
+// keeping every chain it doesn't mention
+func (f *IPTablesFirewall) restore(command string, ruleset string) error {
+	name, args := command+"-restore", []string{"-w", "--noflush"}
+	out, err := f.runner.RunWithInput([]byte(ruleset), name, args...)
+	if err != nil {
+		return fmt.Errorf("error running command %s %s: %w, output: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	f.logger.Debug().Msgf("Command %s %s executed successfully", name, strings.Join(args, " "))
+	return nil
+}
+
+// jumps counts the jumps from OUTPUT to Chain
+func (f *IPTablesFirewall) jumps(command string) (int, error) {
+	out, err := f.runner.Run(command, "-w", "-t", "nat", "-S", "OUTPUT")
+	if err != nil {
+		return 0, fmt.Errorf("error running command %s -w -t nat -S OUTPUT: %w, output: %s", command, err, strings.TrimSpace(string(out)))
+	}
+	jumps := 0
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) == "-A OUTPUT -j "+Chain {
+			jumps++
+		}
+	}
+	return jumps, nil
+}
+
+// UninstallRules removes the jump from OUTPUT and Chain, leaving every other rule alone
+func (f *IPTablesFirewall) UninstallRules() error {
+	var errs []error
+	for _, command := range f.commands {
+		_, exists, err := f.comment(command)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !exists {
+			continue
+		}
+		if err := f.uninstall(command); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Recover removes Chain where the instance that installed it is gone
+func (f *IPTablesFirewall) Recover() error {
+	var errs []error
+	for _, command := range f.commands {
+		comment, exists, err := f.comment(command)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !exists || !firewall.Orphaned(comment) {
+			continue
+		}
+		f.logger.Warn().Msgf("Removing orphaned %s chain %s left by %q", command, Chain, comment)
+		if err := f.uninstall(command); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f *IPTablesFirewall) uninstall(command string) error {
+	f.logger.Debug().Msgf("Cleaning up %s chain %s...", command, Chain)
+	// Deleting fails once no jump is left
+	for range maxJumps {
+		if f.nat(command, "-D", "OUTPUT", "-j", Chain) != nil {
+			break
+		}
+	}
+	if err := f.nat(command, "-F", Chain); err != nil {
+		return err
+	}
+	return f.nat(command, "-X", Chain)
+}
+
+// comment returns the owner comment of Chain, exists is false if Chain is not in the nat table
+func (f *IPTablesFirewall) comment(command string) (comment string, exists bool, err error) {
+	out, err := f.runner.Run(command, "-w", "-t", "nat", "-S", Chain)
+	if err != nil {
+		if bytes.Contains(out, []byte(noChain)) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("error running command %s -w -t nat -S %s: %w, output: %s", command, Chain, err, strings.TrimSpace(string(out)))
+	}
+	if match := commentPattern.FindSubmatch(out); match != nil {
+		comment = string(match[1])
+	}
+	return comment, true, nil
+}
+
+// nat runs command on the nat table, waiting for the xtables lock
+func (f *IPTablesFirewall) nat(command string, args ...string) error {
+	args = append([]string{"-w", "-t", "nat"}, args...)
+	out, err := f.runner.Run(command, args...)
+	if err != nil {
+		return fmt.Errorf("error running command %s %s: %w, output: %s", command, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	f.logger.Debug().Msgf("Command %s %s executed successfully", command, strings.Join(args, " "))
+	return nil
+}
+
+// New creates a firewall using iptables, and ip6tables if it is installed
+func New(logger zerolog.Logger) *IPTablesFirewall {
+	commands := []string{"iptables"}
+	if _, err := exec.LookPath("ip6tables"); err == nil {
+		commands = append(commands, "ip6tables")
+	} else {
+		logger.Warn().Msg("ip6tables not found, IPv6 traffic will not be filtered")
+	}
+	return NewWithRunner(logger, ExecRunner{}, commands...)
+}
+
+// NewWithRunner creates a firewall running commands, e.g. iptables-legacy and ip6tables-legacy, with runner
+func NewWithRunner(logger zerolog.Logger, runner Runner, commands ...string) *IPTablesFirewall {
+	return &IPTablesFirewall{
+		logger:   logger,
+		runner:   runner,
+		commands: commands,
+		config:   firewall.DefaultConfig(),
+	}
+}
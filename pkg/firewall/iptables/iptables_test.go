@@ -0,0 +1,263 @@
+package iptables_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+	"github.com/tb0hdan/go-webfilter/pkg/firewall"
+	"github.com/tb0hdan/go-webfilter/pkg/firewall/internal/golden"
+	"github.com/tb0hdan/go-webfilter/pkg/firewall/iptables"
+)
+
+// deadPID is above the largest pid_max, no process ever has it
+const deadPID = 99999999
+
+// fakeTables simulates the nat table of each command, rules are kept as their argument strings
+type fakeTables struct {
+	chains map[string]map[string][]string
+	calls  []string
+	// fail makes commands containing it fail
+	fail string
+}
+
+func newFakeTables(commands ...string) *fakeTables {
+	f := &fakeTables{chains: make(map[string]map[string][]string)}
+	for _, command := range commands {
+		f.chains[command] = map[string][]string{"OUTPUT": {"-j OTHER"}, "OTHER": nil}
+	}
+	return f
+}
+
+func (f *fakeTables) Run(name string, args ...string) ([]byte, error) {
+	call := name + " " + strings.Join(args, " ")
+	f.calls = append(f.calls, call)
+	if f.fail != "" && strings.Contains(call, f.fail) {
+		return []byte("iptables: failure injected"), errors.New("exit status 1")
+	}
+	if len(args) < 5 || args[0] != "-w" || args[1] != "-t" || args[2] != "nat" {
+		return nil, errors.New("exit status 2")
+	}
+	chains, chain, rule := f.chains[name], args[4], strings.Join(args[5:], " ")
+	_, exists := chains[chain]
+	switch args[3] {
+	case "-S":
+		if !exists {
+			return []byte("iptables: No chain/target/match by that name."), errors.New("exit status 1")
+		}
+		out := "-N " + chain + "\n"
+		for _, rule := range chains[chain] {
+			// iptables quotes the comment
+			rule = regexp.MustCompile(`--comment (.*) -j`).ReplaceAllString(rule, `--comment "$1" -j`)
+			out += "-A " + chain + " " + rule + "\n"
+		}
+		return []byte(out), nil
+	case "-D":
+		i := slices.Index(chains[chain], rule)
+		if i < 0 {
+			return []byte("iptables: Bad rule."), errors.New("exit status 1")
+		}
+		chains[chain] = slices.Delete(chains[chain], i, i+1)
+	case "-F":
+		chains[chain] = nil
+	case "-X":
+		for _, rules := range chains {
+			if slices.Contains(rules, "-j "+chain) {
+				return []byte("iptables: Too many links."), errors.New("exit status 1")
+			}
+		}
+		delete(chains, chain)
+	}
+	return nil, nil
+}
+
+// RunWithInput applies iptables-restore input to a copy of the nat table, which replaces it only if every line succeeds
+func (f *fakeTables) RunWithInput(input []byte, name string, args ...string) ([]byte, error) {
+	call := name + " " + strings.Join(args, " ")
+	f.calls = append(f.calls, call)
+	if f.fail != "" && strings.Contains(call+"\n"+string(input), f.fail) {
+		return []byte("iptables-restore: failure injected"), errors.New("exit status 1")
+	}
+	command, ok := strings.CutSuffix(name, "-restore")
+	if !ok || call != name+" -w --noflush" {
+		return nil, errors.New("exit status 2")
+	}
+	chains := make(map[string][]string)
+	for chain, rules := range f.chains[command] {
+		chains[chain] = slices.Clone(rules)
+	}
+	for line := range strings.Lines(string(input)) {
+		fields := strings.Fields(strings.ReplaceAll(line, `"`, ""))
+		switch {
+		case len(fields) == 0 || strings.HasPrefix(fields[0], "#") || fields[0] == "*nat" || fields[0] == "COMMIT":
+		case strings.HasPrefix(fields[0], ":"):
+			// Declared chains are created or flushed
+			chains[strings.TrimPrefix(fields[0], ":")] = nil
+		case len(fields) > 2 && fields[0] == "-A":
+			chains[fields[1]] = append(chains[fields[1]], strings.Join(fields[2:], " "))
+		case len(fields) > 2 && fields[0] == "-D":
+			i := slices.Index(chains[fields[1]], strings.Join(fields[2:], " "))
+			if i < 0 {
+				return []byte("iptables-restore: line failed: " + line), errors.New("exit status 1")
+			}
+			chains[fields[1]] = slices.Delete(chains[fields[1]], i, i+1)
+		default:
+			return []byte("iptables-restore: line failed: " + line), errors.New("exit status 1")
+		}
+	}
+	f.chains[command] = chains
+	return nil, nil
+}
+
+// IPTablesTestSuite defines the test suite for the iptables firewall
+type IPTablesTestSuite struct {
+	suite.Suite
+	tables   *fakeTables
+	firewall *iptables.IPTablesFirewall
+}
+
+// SetupTest creates a firewall for IPv4 and IPv6 on empty tables
+func (suite *IPTablesTestSuite) SetupTest() {
+	suite.tables = newFakeTables("iptables", "ip6tables")
+	suite.firewall = iptables.NewWithRunner(zerolog.Nop(), suite.tables, "iptables", "ip6tables")
+}
+
+// pristine checks that only the rules present before installing are left
+func (suite *IPTablesTestSuite) pristine() {
+	for _, command := range []string{"iptables", "ip6tables"} {
+		suite.Equal(map[string][]string{"OUTPUT": {"-j OTHER"}, "OTHER": nil}, suite.tables.chains[command], command)
+	}
+}
+
+// stale puts a chain of an earlier instance with the owner comment into the iptables nat table
+func (suite *IPTablesTestSuite) stale(comment string) {
+	chains := suite.tables.chains["iptables"]
+	chains["OUTPUT"] = append(chains["OUTPUT"], "-j GO_WEBFILTER", "-j GO_WEBFILTER")
+	chains[iptables.Chain] = []string{
+		"-m owner --uid-owner 0 -m comment --comment " + comment + " -j RETURN",
+		"-p tcp --dport 80 -j REDIRECT --to-ports 1000",
+	}
+}
+
+func owned(pid int) string {
+	started, err := firewall.ProcessStarted(pid)
+	if err != nil {
+		// Dead processes started whenever
+		started = time.Date(2026, 10, 15, 8, 30, 0, 0, time.UTC)
+	}
+	return firewall.Owner{PID: pid, HTTPPort: 1000, HTTPSPort: 1001, Started: started}.String()
+}
+
+// TestInstall tests the rules installed for both families and their removal
+func (suite *IPTablesTestSuite) TestInstall() {
+	suite.Require().NoError(suite.firewall.InstallRules(8080, 8443))
+	for _, command := range []string{"iptables", "ip6tables"} {
+		chains := suite.tables.chains[command]
+		suite.Equal([]string{"-j OTHER", "-j GO_WEBFILTER"}, chains["OUTPUT"])
+		suite.Require().Len(chains[iptables.Chain], 3)
+		suite.Regexp(fmt.Sprintf("^-m owner --uid-owner 0 -m comment --comment go-webfilter pid=%d http=8080 https=8443 started=[0-9TZ:-]+ -j RETURN$", os.Getpid()), chains[iptables.Chain][0])
+		suite.Equal([]string{
+			"-p tcp --dport 80 -j REDIRECT --to-ports 8080",
+			"-p tcp --dport 443 -j REDIRECT --to-ports 8443",
+		}, chains[iptables.Chain][1:])
+	}
+	suite.Contains(suite.tables.calls, "iptables-restore -w --noflush")
+
+	suite.Require().NoError(suite.firewall.UninstallRules())
+	suite.pristine()
+	// Nothing left to remove
+	suite.NoError(suite.firewall.UninstallRules())
+}
+
+// render compares the rendered rules with a file in testdata, the owner of this process replaced by a fixed one
+func (suite *IPTablesTestSuite) render(name string, redirectPort int, redirectHTTPSPort int) {
+	fixed := firewall.Owner{PID: 4242, HTTPPort: redirectPort, HTTPSPort: redirectHTTPSPort, Started: time.Date(2026, 10, 16, 8, 30, 0, 0, time.UTC)}
+	rendered := strings.ReplaceAll(suite.firewall.Render(redirectPort, redirectHTTPSPort), firewall.NewOwner(redirectPort, redirectHTTPSPort).String(), fixed.String())
+	golden.Assert(suite.T(), name, rendered)
+}
+
+// TestRender tests the rules against the golden files, without running any command
+func (suite *IPTablesTestSuite) TestRender() {
+	suite.render("ruleset.txt", 8080, 8443)
+
+	bypass, err := firewall.ParsePrefixes("10.20.0.0/16, 192.0.2.7, 10.20.30.0/24, 2001:db8::/32, ::1")
+	suite.Require().NoError(err)
+	ports := []int{80, 3128, 8000}
+	// More ports than one multiport match takes
+	for port := 9000; port < 9016; port++ {
+		ports = append(ports, port)
+	}
+	suite.Require().NoError(suite.firewall.SetConfig(firewall.Config{HTTPPorts: ports, TLSPorts: []int{443, 8443}, Bypass: bypass, ExcludeLoopback: true}))
+	suite.render("ruleset-custom.txt", 9080, 9443)
+	suite.Empty(suite.tables.calls)
+
+	suite.Error(suite.firewall.SetConfig(firewall.Config{HTTPPorts: []int{0}}))
+}
+
+// TestStale tests replacing the chain left by a crashed run, including duplicated jumps
+func (suite *IPTablesTestSuite) TestStale() {
+	for _, comment := range []string{owned(deadPID), "some other comment"} {
+		suite.Run(comment, func() {
+			suite.SetupTest()
+			suite.stale(comment)
+			suite.Require().NoError(suite.firewall.InstallRules(2000, 2001))
+			chains := suite.tables.chains["iptables"]
+			suite.Equal([]string{"-j OTHER", "-j GO_WEBFILTER"}, chains["OUTPUT"])
+			suite.Contains(chains[iptables.Chain], "-p tcp --dport 80 -j REDIRECT --to-ports 2000")
+			suite.Len(chains[iptables.Chain], 3)
+
+			// This process is running, its chains are left alone
+			suite.Require().NoError(suite.firewall.Recover())
+			suite.Len(chains[iptables.Chain], 3)
+		})
+	}
+}
+
+// TestRecover tests removing the chain of an instance that is gone
+func (suite *IPTablesTestSuite) TestRecover() {
+	suite.stale(owned(deadPID))
+	suite.Require().NoError(suite.firewall.Recover())
+	suite.pristine()
+	suite.Require().NoError(suite.firewall.Recover())
+}
+
+// TestInUse tests that the chain of another running instance is left alone
+func (suite *IPTablesTestSuite) TestInUse() {
+	suite.stale(owned(os.Getppid()))
+	err := suite.firewall.InstallRules(8080, 8443)
+	suite.True(errors.Is(err, firewall.ErrInUse))
+	suite.Require().NoError(suite.firewall.Recover())
+	suite.Len(suite.tables.chains["iptables"][iptables.Chain], 2)
+	suite.NotContains(suite.tables.chains["ip6tables"], iptables.Chain)
+}
+
+// TestFailure tests that a failed installation leaves nothing behind
+func (suite *IPTablesTestSuite) TestFailure() {
+	suite.tables.fail = "ip6tables-restore"
+	err := suite.firewall.InstallRules(8080, 8443)
+	suite.ErrorContains(err, "error running command ip6tables-restore -w --noflush")
+	suite.ErrorContains(err, "output: iptables-restore: failure injected")
+	suite.pristine()
+}
+
+// TestListFailure tests that only a missing chain counts as not installed, other errors stop everything
+func (suite *IPTablesTestSuite) TestListFailure() {
+	suite.stale(owned(deadPID))
+	suite.tables.fail = "iptables -w -t nat -S GO_WEBFILTER"
+	suite.ErrorContains(suite.firewall.InstallRules(8080, 8443), "output: iptables: failure injected")
+	suite.ErrorContains(suite.firewall.Recover(), "output: iptables: failure injected")
+	suite.NotContains(suite.tables.chains["ip6tables"], iptables.Chain)
+	suite.Len(suite.tables.chains["iptables"][iptables.Chain], 2)
+}
+
+// TestIPTablesTestSuite runs the test suite
+func TestIPTablesTestSuite(t *testing.T) {
+	suite.Run(t, new(IPTablesTestSuite))
+}
@@ -0,0 +1,45 @@
+package netlink
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// socket is a NETLINK_NETFILTER socket
+type socket struct {
+	fd int
+}
+
+// Dial opens a NETLINK_NETFILTER socket
+func Dial() (Conn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, fmt.Errorf("error opening netfilter netlink socket: %w", err)
+	}
+	// Never hang on a kernel that doesn't answer
+	timeout := unix.Timeval{Sec: 5}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("error setting netfilter netlink timeout: %w", err)
+	}
+	return &socket{fd: fd}, nil
+}
+
+func (s *socket) Send(data []byte) error {
+	return unix.Sendto(s.fd, data, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+}
+
+func (s *socket) Receive() ([]byte, error) {
+	// Dumps are sent in datagrams of up to a page pair, 64 KiB is plenty
+	buf := make([]byte, 1<<16)
+	n, _, err := unix.Recvfrom(s.fd, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (s *socket) Close() error {
+	return unix.Close(s.fd)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package netlink
+
+import "errors"
+
+// Dial is only supported on Linux
+func Dial() (Conn, error) {
+	return nil, errors.New("nf_tables netlink is not supported on this platform")
+}
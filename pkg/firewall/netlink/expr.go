@@ -0,0 +1,342 @@
+package netlink
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Expression attributes and values from linux/netfilter/nf_tables.h
+const (
+	nftaMetaDreg = 1
+	nftaMetaKey  = 2
+
+	nftaCmpSreg = 1
+	nftaCmpOp   = 2
+	nftaCmpData = 3
+
+	nftaPayloadDreg   = 1
+	nftaPayloadBase   = 2
+	nftaPayloadOffset = 3
+	nftaPayloadLen    = 4
+
+	nftaImmediateDreg = 1
+	nftaImmediateData = 2
+
+	nftaDataValue    = 1
+	nftaDataVerdict  = 2
+	nftaVerdictCode  = 1
+	nftaVerdictChain = 2
+
+	nftaLookupSet   = 1
+	nftaLookupSreg  = 2
+	nftaLookupSetID = 4
+
+	nftaRedirRegProtoMin = 1
+	nftaRedirRegProtoMax = 2
+	nftaRedirFlags       = 3
+
+	nftRegVerdict = 0
+	nftReg1       = 1
+
+	nftMetaOifname = 7
+	nftMetaSkuid   = 10
+	nftMetaNfproto = 15
+	nftMetaL4proto = 16
+
+	nftCmpEq = 0
+
+	nftPayloadNetworkHeader   = 1
+	nftPayloadTransportHeader = 2
+
+	nfAccept  = 1
+	nftJump   = -3
+	nftReturn = -5
+
+	nfNATRangeProtoSpecified = 2
+)
+
+// expr is an nf_tables expression. String matches the output of nft --debug=netlink,
+// decoded kernel dumps are compared with the installed rules through it.
+type expr interface {
+	fmt.Stringer
+	name() string
+	encode() [][]byte
+}
+
+type meta struct {
+	key  uint32
+	dreg uint32
+}
+
+func (e *meta) name() string {
+	return "meta"
+}
+
+func (e *meta) encode() [][]byte {
+	return [][]byte{encodeUint32(nftaMetaDreg, e.dreg), encodeUint32(nftaMetaKey, e.key)}
+}
+
+func (e *meta) String() string {
+	key := fmt.Sprintf("%d", e.key)
+	switch e.key {
+	case nftMetaOifname:
+		key = "oifname"
+	case nftMetaSkuid:
+		key = "skuid"
+	case nftMetaNfproto:
+		key = "nfproto"
+	case nftMetaL4proto:
+		key = "l4proto"
+	}
+	return fmt.Sprintf("[ meta load %s => reg %d ]", key, e.dreg)
+}
+
+type cmp struct {
+	sreg uint32
+	op   uint32
+	data []byte
+}
+
+func (e *cmp) name() string {
+	return "cmp"
+}
+
+func (e *cmp) encode() [][]byte {
+	return [][]byte{
+		encodeUint32(nftaCmpSreg, e.sreg),
+		encodeUint32(nftaCmpOp, e.op),
+		encodeNested(nftaCmpData, encodeAttr(nftaDataValue, e.data)),
+	}
+}
+
+func (e *cmp) String() string {
+	op := fmt.Sprintf("op%d", e.op)
+	if e.op == nftCmpEq {
+		op = "eq"
+	}
+	return fmt.Sprintf("[ cmp %s reg %d 0x%s ]", op, e.sreg, hex.EncodeToString(e.data))
+}
+
+type payload struct {
+	dreg   uint32
+	base   uint32
+	offset uint32
+	len    uint32
+}
+
+func (e *payload) name() string {
+	return "payload"
+}
+
+func (e *payload) encode() [][]byte {
+	return [][]byte{
+		encodeUint32(nftaPayloadDreg, e.dreg),
+		encodeUint32(nftaPayloadBase, e.base),
+		encodeUint32(nftaPayloadOffset, e.offset),
+		encodeUint32(nftaPayloadLen, e.len),
+	}
+}
+
+func (e *payload) String() string {
+	base := fmt.Sprintf("base %d", e.base)
+	switch e.base {
+	case nftPayloadNetworkHeader:
+		base = "network header"
+	case nftPayloadTransportHeader:
+		base = "transport header"
+	}
+	return fmt.Sprintf("[ payload load %db @ %s + %d => reg %d ]", e.len, base, e.offset, e.dreg)
+}
+
+// immediate loads data, or a verdict into the verdict register
+type immediate struct {
+	dreg    uint32
+	data    []byte
+	verdict int32
+	chain   string
+}
+
+func (e *immediate) name() string {
+	return "immediate"
+}
+
+func (e *immediate) encode() [][]byte {
+	if e.dreg != nftRegVerdict {
+		return [][]byte{
+			encodeUint32(nftaImmediateDreg, e.dreg),
+			encodeNested(nftaImmediateData, encodeAttr(nftaDataValue, e.data)),
+		}
+	}
+	verdict := [][]byte{encodeUint32(nftaVerdictCode, uint32(e.verdict))}
+	if e.chain != "" {
+		verdict = append(verdict, encodeString(nftaVerdictChain, e.chain))
+	}
+	return [][]byte{
+		encodeUint32(nftaImmediateDreg, e.dreg),
+		encodeNested(nftaImmediateData, encodeNested(nftaDataVerdict, verdict...)),
+	}
+}
+
+func (e *immediate) String() string {
+	if e.dreg != nftRegVerdict {
+		return fmt.Sprintf("[ immediate reg %d 0x%s ]", e.dreg, hex.EncodeToString(e.data))
+	}
+	switch e.verdict {
+	case nftJump:
+		return fmt.Sprintf("[ immediate reg 0 jump -> %s ]", e.chain)
+	case nftReturn:
+		return "[ immediate reg 0 return ]"
+	}
+	return fmt.Sprintf("[ immediate reg 0 verdict %d ]", e.verdict)
+}
+
+// lookup matches if the register holds an element of a set, the set is found by id in the transaction creating it
+type lookup struct {
+	sreg  uint32
+	set   string
+	setID uint32
+}
+
+func (e *lookup) name() string {
+	return "lookup"
+}
+
+func (e *lookup) encode() [][]byte {
+	return [][]byte{
+		encodeString(nftaLookupSet, e.set),
+		encodeUint32(nftaLookupSreg, e.sreg),
+		encodeUint32(nftaLookupSetID, e.setID),
+	}
+}
+
+func (e *lookup) String() string {
+	return fmt.Sprintf("[ lookup reg %d set %s ]", e.sreg, e.set)
+}
+
+type redir struct {
+	protoMin uint32
+	flags    uint32
+}
+
+func (e *redir) name() string {
+	return "redir"
+}
+
+func (e *redir) encode() [][]byte {
+	return [][]byte{encodeUint32(nftaRedirRegProtoMin, e.protoMin), encodeUint32(nftaRedirFlags, e.flags)}
+}
+
+func (e *redir) String() string {
+	return fmt.Sprintf("[ redir proto_min reg %d flags 0x%x ]", e.protoMin, e.flags)
+}
+
+// encodeExprs encodes the NFTA_RULE_EXPRESSIONS list of a rule
+func encodeExprs(exprs []expr) []byte {
+	elems := make([][]byte, 0, len(exprs))
+	for _, e := range exprs {
+		elems = append(elems, encodeNested(nftaListElem,
+			encodeString(nftaExprName, e.name()),
+			encodeNested(nftaExprData, e.encode()...),
+		))
+	}
+	return encodeNested(nftaRuleExpressions, elems...)
+}
+
+// decodeExprs decodes the NFTA_RULE_EXPRESSIONS list of a dumped rule
+func decodeExprs(data []byte) ([]expr, error) {
+	elems, err := parseAttrs(data)
+	if err != nil {
+		return nil, err
+	}
+	exprs := make([]expr, 0, len(elems))
+	for _, elem := range elems {
+		attrs, err := parseAttrs(elem.data)
+		if err != nil {
+			return nil, err
+		}
+		name := findString(attrs, nftaExprName)
+		exprData, _ := find(attrs, nftaExprData)
+		if attrs, err = parseAttrs(exprData); err != nil {
+			return nil, err
+		}
+		e, err := decodeExpr(name, attrs)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s expression: %w", name, err)
+		}
+		exprs = append(exprs, e)
+	}
+	return exprs, nil
+}
+
+func decodeExpr(name string, attrs []attr) (expr, error) {
+	u32 := func(typ uint16) uint32 {
+		v, _ := findUint32(attrs, typ)
+		return v
+	}
+	switch name {
+	case "meta":
+		return &meta{key: u32(nftaMetaKey), dreg: u32(nftaMetaDreg)}, nil
+	case "cmp":
+		value, err := decodeValue(attrs, nftaCmpData)
+		return &cmp{sreg: u32(nftaCmpSreg), op: u32(nftaCmpOp), data: value}, err
+	case "payload":
+		return &payload{dreg: u32(nftaPayloadDreg), base: u32(nftaPayloadBase), offset: u32(nftaPayloadOffset), len: u32(nftaPayloadLen)}, nil
+	case "immediate":
+		e := &immediate{dreg: u32(nftaImmediateDreg)}
+		if e.dreg != nftRegVerdict {
+			value, err := decodeValue(attrs, nftaImmediateData)
+			e.data = value
+			return e, err
+		}
+		data, _ := find(attrs, nftaImmediateData)
+		dataAttrs, err := parseAttrs(data)
+		if err != nil {
+			return nil, err
+		}
+		verdict, _ := find(dataAttrs, nftaDataVerdict)
+		verdictAttrs, err := parseAttrs(verdict)
+		if err != nil {
+			return nil, err
+		}
+		code, _ := findUint32(verdictAttrs, nftaVerdictCode)
+		e.verdict, e.chain = int32(code), findString(verdictAttrs, nftaVerdictChain)
+		return e, nil
+	case "lookup":
+		return &lookup{sreg: u32(nftaLookupSreg), set: findString(attrs, nftaLookupSet)}, nil
+	case "redir":
+		// The kernel dumps the maximum too, it is the minimum when not given
+		return &redir{protoMin: u32(nftaRedirRegProtoMin), flags: u32(nftaRedirFlags)}, nil
+	}
+	return nil, errors.New("unknown expression")
+}
+
+// decodeValue returns the NFTA_DATA_VALUE nested in attribute typ
+func decodeValue(attrs []attr, typ uint16) ([]byte, error) {
+	data, _ := find(attrs, typ)
+	dataAttrs, err := parseAttrs(data)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := find(dataAttrs, nftaDataValue)
+	if !ok {
+		return nil, errors.New("missing value")
+	}
+	return value, nil
+}
+
+// describe renders expressions one per line
+func describe(exprs []expr) string {
+	lines := make([]string, 0, len(exprs))
+	for _, e := range exprs {
+		lines = append(lines, e.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// port returns a port as register data, in network byte order
+func port(p int) []byte {
+	return binary.BigEndian.AppendUint16(nil, uint16(p))
+}
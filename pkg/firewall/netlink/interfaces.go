@@ -0,0 +1,10 @@
+package netlink
+
+// Conn exchanges datagrams with nf_tables over a NETLINK_NETFILTER socket
+type Conn interface {
+	// Send sends netlink messages to the kernel
+	Send(data []byte) error
+	// Receive returns the next datagram from the kernel
+	Receive() ([]byte, error)
+	Close() error
+}
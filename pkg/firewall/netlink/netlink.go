@@ -0,0 +1,527 @@
+package netlink
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rs/zerolog"
+	"github.com/tb0hdan/go-webfilter/pkg/firewall"
+)
+
+const (
+	// Table is the inet table holding the chains, it is deleted as a whole on cleanup
+	Table = "go_webfilter"
+	// natChain holds the redirects, OUTPUT jumps to it
+	natChain = "go_webfilter_nat"
+	// outputChain is the nat chain on the output hook
+	outputChain = "OUTPUT"
+
+	nfprotoIPv4    = 2
+	nfprotoIPv6    = 10
+	nfInetLocalOut = 3
+	// nfIPPriNATDst is the dstnat priority
+	nfIPPriNATDst = -100
+	ipprotoTCP    = 6
+)
+
+// chain is a chain of Table with its rules, a base chain if hook is set
+type chain struct {
+	name     string
+	hook     bool
+	rules    []rule
+	priority int32
+}
+
+// rule is a rule as nft writes it and the expressions it compiles to
+type rule struct {
+	statement string
+	exprs     []expr
+}
+
+// ruleset returns the sets and chains installed for the ports and config, the same ruleset the nft backend creates.
+// Sets without elements and the rules using them are left out.
+func ruleset(redirectPort int, redirectHTTPSPort int, config firewall.Config) ([]set, []chain) {
+	var sets []set
+	for _, s := range []set{
+		portSet("http_ports", firewall.Ports(config.HTTPPorts)),
+		portSet("tls_ports", firewall.Ports(config.TLSPorts)),
+		prefixSet("bypass_ipv4", config.BypassIPv4(), true),
+		prefixSet("bypass_ipv6", config.BypassIPv6(), false),
+	} {
+		if len(s.elements) > 0 {
+			s.id = uint32(len(sets) + 1)
+			sets = append(sets, s)
+		}
+	}
+	// in returns the expression matching reg 1 against a set, nil if the set is left out
+	in := func(name string) expr {
+		for _, s := range sets {
+			if s.name == name {
+				return &lookup{sreg: nftReg1, set: s.name, setID: s.id}
+			}
+		}
+		return nil
+	}
+	returned := &immediate{dreg: nftRegVerdict, verdict: nftReturn}
+
+	rules := []rule{
+		// Do not redirect root's traffic, the proxy itself runs as root
+		{
+			statement: "meta skuid root return",
+			exprs: []expr{
+				&meta{key: nftMetaSkuid, dreg: nftReg1},
+				&cmp{sreg: nftReg1, op: nftCmpEq, data: []byte{0, 0, 0, 0}},
+				returned,
+			},
+		},
+	}
+	if config.ExcludeLoopback {
+		// Interface names are compared as IFNAMSIZ bytes padded with NULs
+		rules = append(rules, rule{
+			statement: `oifname "lo" return`,
+			exprs: []expr{
+				&meta{key: nftMetaOifname, dreg: nftReg1},
+				&cmp{sreg: nftReg1, op: nftCmpEq, data: append([]byte("lo"), make([]byte, 14)...)},
+				returned,
+			},
+		})
+	}
+	bypass := func(statement string, nfproto byte, offset, length uint32, set expr) {
+		if set == nil {
+			return
+		}
+		rules = append(rules, rule{
+			statement: statement,
+			exprs: []expr{
+				&meta{key: nftMetaNfproto, dreg: nftReg1},
+				&cmp{sreg: nftReg1, op: nftCmpEq, data: []byte{nfproto}},
+				&payload{dreg: nftReg1, base: nftPayloadNetworkHeader, offset: offset, len: length},
+				set,
+				returned,
+			},
+		})
+	}
+	// The destination address is at offset 16 of the IPv4 header and 24 of the IPv6 one
+	bypass("ip daddr @bypass_ipv4 return", nfprotoIPv4, 16, 4, in("bypass_ipv4"))
+	bypass("ip6 daddr @bypass_ipv6 return", nfprotoIPv6, 24, 16, in("bypass_ipv6"))
+	redirect := func(name string, to int) {
+		set := in(name)
+		if set == nil {
+			return
+		}
+		rules = append(rules, rule{
+			statement: fmt.Sprintf("tcp dport @%s redirect to :%d", name, to),
+			exprs: []expr{
+				&meta{key: nftMetaL4proto, dreg: nftReg1},
+				&cmp{sreg: nftReg1, op: nftCmpEq, data: []byte{ipprotoTCP}},
+				&payload{dreg: nftReg1, base: nftPayloadTransportHeader, offset: 2, len: 2},
+				set,
+				&immediate{dreg: nftReg1, data: port(to)},
+				&redir{protoMin: nftReg1, flags: nfNATRangeProtoSpecified},
+			},
+		})
+	}
+	redirect("http_ports", redirectPort)
+	redirect("tls_ports", redirectHTTPSPort)
+
+	return sets, []chain{
+		{name: natChain, rules: rules},
+		{
+			name:     outputChain,
+			hook:     true,
+			priority: nfIPPriNATDst,
+			rules: []rule{{
+				statement: "jump " + natChain,
+				exprs:     []expr{&immediate{dreg: nftRegVerdict, verdict: nftJump, chain: natChain}},
+			}},
+		},
+	}
+}
+
+// render writes the sets and chains as the nft script replacing Table, the same script the nft backend runs.
+// The expressions of each rule follow it as comments, in nft --debug=netlink notation.
+func render(owner firewall.Owner, sets []set, chains []chain) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %[1]s\ndelete table inet %[1]s\ntable inet %[1]s {\n\tcomment %q\n", Table, owner.String())
+	for _, s := range sets {
+		b.WriteString(s.String())
+	}
+	for _, c := range chains {
+		fmt.Fprintf(&b, "\tchain %s {\n", c.name)
+		if c.hook {
+			// The only hook used is output, dstnat is the name nft gives priority -100
+			priority := strconv.Itoa(int(c.priority))
+			if c.priority == nfIPPriNATDst {
+				priority = "dstnat"
+			}
+			fmt.Fprintf(&b, "\t\ttype nat hook output priority %s; policy accept;\n", priority)
+		}
+		for _, r := range c.rules {
+			fmt.Fprintf(&b, "\t\t%s\n", r.statement)
+			for _, e := range r.exprs {
+				fmt.Fprintf(&b, "\t\t# %s\n", e)
+			}
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// batch collects the messages of one nf_tables transaction, the kernel applies all of them or none
+type batch struct {
+	data []byte
+	// ops describes the messages by sequence number for errors
+	ops map[uint32]string
+	seq uint32
+}
+
+func newBatch(seq uint32) *batch {
+	b := &batch{ops: make(map[uint32]string), seq: seq}
+	b.data = encodeMessage(nfnlMsgBatchBegin, nlmFRequest, seq, afUnspec)
+	return b
+}
+
+// add appends a message the kernel acknowledges
+func (b *batch) add(op string, typ, flags uint16, attrs ...[]byte) {
+	b.seq++
+	b.ops[b.seq] = op
+	b.data = append(b.data, encodeMessage(nftType(typ), nlmFRequest|nlmFAck|flags, b.seq, nfprotoInet, attrs...)...)
+}
+
+// end closes the batch and returns it
+func (b *batch) end() []byte {
+	b.seq++
+	return append(b.data, encodeMessage(nfnlMsgBatchEnd, nlmFRequest, b.seq, afUnspec)...)
+}
+
+// installBatch replaces Table with the sets and chains in a single transaction, like nft -f does: the table is
+// added so that deleting it never fails, deleted and created again with the owner comment
+func installBatch(seq uint32, owner firewall.Owner, sets []set, chains []chain) *batch {
+	b := newBatch(seq)
+	b.add("add table "+Table, nftMsgNewTable, nlmFCreate, encodeString(nftaTableName, Table))
+	b.add("delete table "+Table, nftMsgDelTable, 0, encodeString(nftaTableName, Table))
+	b.add("add table "+Table, nftMsgNewTable, nlmFCreate, encodeString(nftaTableName, Table), encodeComment(owner.String()))
+	for _, s := range sets {
+		b.add("add set "+s.name, nftMsgNewSet, nlmFCreate, s.encode()...)
+		for _, elements := range s.encodeElements() {
+			b.add("add elements to set "+s.name, nftMsgNewSetElem, nlmFCreate, elements...)
+		}
+	}
+	for _, c := range chains {
+		attrs := [][]byte{encodeString(nftaChainTable, Table), encodeString(nftaChainName, c.name)}
+		if c.hook {
+			attrs = append(attrs,
+				encodeNested(nftaChainHook,
+					encodeUint32(nftaHookHooknum, nfInetLocalOut),
+					encodeUint32(nftaHookPriority, uint32(c.priority)),
+				),
+				encodeUint32(nftaChainPolicy, nfAccept),
+				encodeString(nftaChainType, "nat"),
+			)
+		}
+		b.add("add chain "+c.name, nftMsgNewChain, nlmFCreate, attrs...)
+		for i, r := range c.rules {
+			b.add(fmt.Sprintf("add rule %d to chain %s", i+1, c.name), nftMsgNewRule, nlmFCreate|nlmFAppend,
+				encodeString(nftaRuleTable, Table),
+				encodeString(nftaRuleChain, c.name),
+				encodeExprs(r.exprs),
+			)
+		}
+	}
+	return b
+}
+
+// NetlinkFirewall redirects traffic with nf_tables rules it sends over netlink, without the nft binary.
+// Rules are installed and removed by one caller at a time.
+type NetlinkFirewall struct {
+	logger zerolog.Logger
+	dial   func() (Conn, error)
+	// owner is recorded in the table comment
+	owner  func(redirectPort int, redirectHTTPSPort int) firewall.Owner
+	config firewall.Config
+	// seq is the last sequence number used
+	seq uint32
+}
+
+func (n *NetlinkFirewall) SetConfig(config firewall.Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	n.config = config
+	return nil
+}
+
+func (n *NetlinkFirewall) InstallRules(redirectPort int, redirectHTTPSPort int) error {
+	comment, exists, err := n.comment()
+	if err != nil {
+		return err
+	}
+	if exists {
+		if err := firewall.InUse(comment); err != nil {
+			return err
+		}
+		n.logger.Warn().Msgf("Replacing table inet %s left by %q", Table, comment)
+	}
+	sets, chains := ruleset(redirectPort, redirectHTTPSPort, n.config)
+	b := installBatch(n.seq+1, n.owner(redirectPort, redirectHTTPSPort), sets, chains)
+	if err := n.transact(b); err != nil {
+		return err
+	}
+	n.logger.Debug().Msgf("Table inet %s installed", Table)
+	if err := n.verify(chains); err != nil {
+		if cleanupErr := n.UninstallRules(); cleanupErr != nil {
+			n.logger.Error().Err(cleanupErr).Msg("Error removing unverified rules")
+		}
+		return fmt.Errorf("error verifying table inet %s: %w", Table, err)
+	}
+	return nil
+}
+
+func (n *NetlinkFirewall) UninstallRules() error {
+	n.logger.Debug().Msg("Cleaning up nftables table...")
+	return n.deleteTable()
+}
+
+// Render returns the nft script of the table InstallRules would install, with the expressions sent for each rule
+func (n *NetlinkFirewall) Render(redirectPort int, redirectHTTPSPort int) string {
+	sets, chains := ruleset(redirectPort, redirectHTTPSPort, n.config)
+	return render(n.owner(redirectPort, redirectHTTPSPort), sets, chains)
+}
+
+// Recover deletes the table if the instance that installed it is gone
+func (n *NetlinkFirewall) Recover() error {
+	comment, exists, err := n.comment()
+	if err != nil || !exists || !firewall.Orphaned(comment) {
+		return err
+	}
+	n.logger.Warn().Msgf("Deleting orphaned table inet %s left by %q", Table, comment)
+	return n.deleteTable()
+}
+
+func (n *NetlinkFirewall) deleteTable() error {
+	b := newBatch(n.seq + 1)
+	b.add("delete table "+Table, nftMsgDelTable, 0, encodeString(nftaTableName, Table))
+	err := n.transact(b)
+	if errors.Is(err, syscall.ENOENT) {
+		// Nothing installed
+		return nil
+	}
+	return err
+}
+
+// transact sends a batch and waits for the acknowledgement of each of its messages
+func (n *NetlinkFirewall) transact(b *batch) error {
+	conn, err := n.dial()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	data := b.end()
+	n.seq = b.seq
+	if err := conn.Send(data); err != nil {
+		return fmt.Errorf("error sending nf_tables batch: %w", err)
+	}
+	for pending := len(b.ops); pending > 0; {
+		reply, err := conn.Receive()
+		if err != nil {
+			return fmt.Errorf("error receiving nf_tables acknowledgement: %w", err)
+		}
+		messages, err := parseMessages(reply)
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			op, ok := b.ops[m.seq]
+			if m.typ != nlmsgError || !ok {
+				continue
+			}
+			if err := m.errno(); err != nil {
+				return fmt.Errorf("error in nf_tables transaction, %s: %w", op, err)
+			}
+			pending--
+		}
+	}
+	return nil
+}
+
+// dump sends a dump request for the inet family and returns the nf_tables messages of the reply
+func (n *NetlinkFirewall) dump(typ uint16, attrs ...[]byte) ([]message, error) {
+	conn, err := n.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	n.seq++
+	seq := n.seq
+	if err := conn.Send(encodeMessage(nftType(typ), nlmFRequest|nlmFDump, seq, nfprotoInet, attrs...)); err != nil {
+		return nil, fmt.Errorf("error sending nf_tables dump request: %w", err)
+	}
+	var messages []message
+	for {
+		reply, err := conn.Receive()
+		if err != nil {
+			return nil, fmt.Errorf("error receiving nf_tables dump: %w", err)
+		}
+		parsed, err := parseMessages(reply)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range parsed {
+			if m.seq != seq {
+				continue
+			}
+			switch m.typ {
+			case nlmsgDone:
+				return messages, nil
+			case nlmsgError:
+				if err := m.errno(); err != nil {
+					return nil, fmt.Errorf("error dumping nf_tables: %w", err)
+				}
+			default:
+				messages = append(messages, m)
+			}
+		}
+	}
+}
+
+// Check lists the nf_tables tables, which fails without kernel support or CAP_NET_ADMIN
+func (n *NetlinkFirewall) Check() error {
+	_, err := n.dump(nftMsgGetTable)
+	return err
+}
+
+// comment returns the comment of Table, exists is false if there is no table
+func (n *NetlinkFirewall) comment() (comment string, exists bool, err error) {
+	tables, err := n.dump(nftMsgGetTable)
+	if err != nil {
+		return "", false, err
+	}
+	for _, m := range tables {
+		attrs, err := m.attrs()
+		if err != nil {
+			return "", false, err
+		}
+		if findString(attrs, nftaTableName) != Table {
+			continue
+		}
+		userdata, _ := find(attrs, nftaTableUserdata)
+		return decodeComment(userdata), true, nil
+	}
+	return "", false, nil
+}
+
+// installed is a chain of Table as read back from the kernel
+type installed struct {
+	name     string
+	typ      string
+	hooknum  uint32
+	priority int32
+	hook     bool
+	rules    []string
+}
+
+// readRuleset dumps the chains and rules of Table
+func (n *NetlinkFirewall) readRuleset() (map[string]*installed, error) {
+	chainMessages, err := n.dump(nftMsgGetChain)
+	if err != nil {
+		return nil, err
+	}
+	chains := make(map[string]*installed)
+	for _, m := range chainMessages {
+		attrs, err := m.attrs()
+		if err != nil {
+			return nil, err
+		}
+		if findString(attrs, nftaChainTable) != Table {
+			continue
+		}
+		c := &installed{name: findString(attrs, nftaChainName), typ: findString(attrs, nftaChainType)}
+		if hook, ok := find(attrs, nftaChainHook); ok {
+			hookAttrs, err := parseAttrs(hook)
+			if err != nil {
+				return nil, err
+			}
+			priority, _ := findUint32(hookAttrs, nftaHookPriority)
+			c.hook, c.priority = true, int32(priority)
+			c.hooknum, _ = findUint32(hookAttrs, nftaHookHooknum)
+		}
+		chains[c.name] = c
+	}
+
+	ruleMessages, err := n.dump(nftMsgGetRule, encodeString(nftaRuleTable, Table))
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range ruleMessages {
+		attrs, err := m.attrs()
+		if err != nil {
+			return nil, err
+		}
+		if findString(attrs, nftaRuleTable) != Table {
+			continue
+		}
+		c, ok := chains[findString(attrs, nftaRuleChain)]
+		if !ok {
+			continue
+		}
+		data, _ := find(attrs, nftaRuleExpressions)
+		exprs, err := decodeExprs(data)
+		if err != nil {
+			return nil, err
+		}
+		c.rules = append(c.rules, describe(exprs))
+	}
+	return chains, nil
+}
+
+// verify reads Table back and compares it with the chains that were sent
+func (n *NetlinkFirewall) verify(chains []chain) error {
+	read, err := n.readRuleset()
+	if err != nil {
+		return err
+	}
+	if len(read) != len(chains) {
+		return fmt.Errorf("expected %d chains, found %d", len(chains), len(read))
+	}
+	for _, c := range chains {
+		got, ok := read[c.name]
+		if !ok {
+			return fmt.Errorf("chain %s is missing", c.name)
+		}
+		if c.hook && (!got.hook || got.typ != "nat" || got.hooknum != nfInetLocalOut || got.priority != c.priority) {
+			return fmt.Errorf("chain %s is not a nat chain on the output hook with priority %d", c.name, c.priority)
+		}
+		expected := make([]string, 0, len(c.rules))
+		for _, r := range c.rules {
+			expected = append(expected, describe(r.exprs))
+		}
+		if !slices.Equal(expected, got.rules) {
+			return fmt.Errorf("rules of chain %s differ:\n%v\ninstead of\n%v", c.name, got.rules, expected)
+		}
+	}
+	return nil
+}
+
+// New creates a firewall talking to nf_tables over netlink
+func New(logger zerolog.Logger) *NetlinkFirewall {
+	return NewWithDialer(logger, Dial)
+}
+
+// NewWithDialer creates a firewall using connections opened by dial
+func NewWithDialer(logger zerolog.Logger, dial func() (Conn, error)) *NetlinkFirewall {
+	return &NetlinkFirewall{
+		logger: logger,
+		dial:   dial,
+		owner:  firewall.NewOwner,
+		config: firewall.DefaultConfig(),
+	}
+}
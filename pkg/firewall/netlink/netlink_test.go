@@ -0,0 +1,292 @@
+package netlink
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+	"github.com/tb0hdan/go-webfilter/pkg/firewall"
+	"github.com/tb0hdan/go-webfilter/pkg/firewall/internal/golden"
+)
+
+// replayConn plays back datagrams recorded from the kernel and records what is sent
+type replayConn struct {
+	sent     [][]byte
+	received [][]byte
+}
+
+func (c *replayConn) Send(data []byte) error {
+	c.sent = append(c.sent, data)
+	return nil
+}
+
+func (c *replayConn) Receive() ([]byte, error) {
+	if len(c.received) == 0 {
+		return nil, syscall.EAGAIN
+	}
+	data := c.received[0]
+	c.received = c.received[1:]
+	return data, nil
+}
+
+func (c *replayConn) Close() error {
+	return nil
+}
+
+// NetlinkTestSuite defines the test suite for the netlink firewall
+type NetlinkTestSuite struct {
+	suite.Suite
+	conn     *replayConn
+	firewall *NetlinkFirewall
+}
+
+// SetupTest creates a firewall on a connection without replies, owned by PID 4242 like the transcripts
+func (suite *NetlinkTestSuite) SetupTest() {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		suite.T().Skip("Recorded bytes are from a little-endian host")
+	}
+	suite.conn = &replayConn{}
+	suite.firewall = NewWithDialer(zerolog.Nop(), func() (Conn, error) {
+		return suite.conn, nil
+	})
+	suite.firewall.owner = func(redirectPort int, redirectHTTPSPort int) firewall.Owner {
+		return firewall.Owner{PID: 4242, HTTPPort: redirectPort, HTTPSPort: redirectHTTPSPort, Started: time.Date(2026, 10, 16, 8, 30, 0, 0, time.UTC)}
+	}
+}
+
+// load reads a transcript from testdata, returning the sent and the received datagrams
+func (suite *NetlinkTestSuite) load(name string) ([][]byte, [][]byte) {
+	f, err := os.Open("testdata/" + name)
+	suite.Require().NoError(err)
+	defer func() { _ = f.Close() }()
+	var sent, received [][]byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		direction, data, _ := strings.Cut(scanner.Text(), " ")
+		datagram, err := hex.DecodeString(data)
+		switch direction {
+		case ">":
+			suite.Require().NoError(err)
+			sent = append(sent, datagram)
+		case "<":
+			suite.Require().NoError(err)
+			received = append(received, datagram)
+		}
+	}
+	suite.Require().NoError(scanner.Err())
+	return sent, received
+}
+
+// reply builds an NLMSG_ERROR message, an acknowledgement if errno is 0
+func reply(seq uint32, errno syscall.Errno) []byte {
+	b := make([]byte, nlmsgHdrLen+4+nlmsgHdrLen)
+	binary.NativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	binary.NativeEndian.PutUint16(b[4:6], nlmsgError)
+	binary.NativeEndian.PutUint32(b[8:12], seq)
+	binary.NativeEndian.PutUint32(b[16:20], uint32(-int32(errno)))
+	return b
+}
+
+// done builds the NLMSG_DONE message ending a dump
+func done(seq uint32) []byte {
+	b := make([]byte, nlmsgHdrLen+4)
+	binary.NativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	binary.NativeEndian.PutUint16(b[4:6], nlmsgDone)
+	binary.NativeEndian.PutUint32(b[8:12], seq)
+	return b
+}
+
+// tables builds the reply to a table dump listing Table with comment
+func tables(seq uint32, comment string) []byte {
+	table := encodeMessage(nftType(nftMsgNewTable), 0, seq, nfprotoInet, encodeString(nftaTableName, Table), encodeComment(comment))
+	return append(table, done(seq)...)
+}
+
+// TestEncode tests the encoding of single messages and expressions
+func (suite *NetlinkTestSuite) TestEncode() {
+	table := encodeMessage(nftType(nftMsgNewTable), nlmFRequest|nlmFAck|nlmFCreate, 2, nfprotoInet, encodeString(nftaTableName, Table))
+	suite.Equal("28000000"+"000a"+"0504"+"02000000"+"00000000"+ // nlmsghdr: NFT_MSG_NEWTABLE, request|ack|create
+		"01"+"00"+"0000"+ // nfgenmsg: inet, version 0
+		"1100"+"0100"+"676f5f77656266696c74657200"+"000000", // NFTA_TABLE_NAME "go_webfilter\0", padding
+		hex.EncodeToString(table))
+
+	suite.Equal("0800"+"0200"+"000001bb", hex.EncodeToString(encodeUint32(nftaMetaKey, 443)))
+	suite.Equal("0c00"+"0380"+"0600"+"0100"+"01bb0000", hex.EncodeToString(encodeNested(nftaCmpData, encodeAttr(nftaDataValue, port(443)))))
+
+	jump := encodeExprs([]expr{&immediate{dreg: nftRegVerdict, verdict: nftJump, chain: natChain}})
+	suite.Equal("4c000480"+"48000180"+ // NFTA_RULE_EXPRESSIONS, NFTA_LIST_ELEM
+		"0e000100"+"696d6d65646961746500"+"0000"+ // NFTA_EXPR_NAME "immediate\0"
+		"34000280"+"08000100"+"00000000"+ // NFTA_EXPR_DATA, NFTA_IMMEDIATE_DREG 0
+		"28000280"+"24000280"+"08000100"+"fffffffd"+ // NFTA_IMMEDIATE_DATA, NFTA_DATA_VERDICT, NFTA_VERDICT_CODE NFT_JUMP
+		"15000200"+"676f5f77656266696c7465725f6e617400"+"000000", // NFTA_VERDICT_CHAIN "go_webfilter_nat\0"
+		hex.EncodeToString(jump))
+
+	comment := encodeComment("go-webfilter pid=1")
+	suite.Equal("1900"+"0600"+ // NFTA_TABLE_USERDATA
+		"00"+"13"+"676f2d77656266696c746572207069643d3100"+"000000", // comment of length 19 "go-webfilter pid=1\0", padding
+		hex.EncodeToString(comment))
+	suite.Equal("go-webfilter pid=1", decodeComment(comment[nlaHdrLen:]))
+	suite.Empty(decodeComment([]byte{1, 2, 0, 0, 0, 40}))
+}
+
+// custom is the configuration of the install-custom.txt transcript
+func (suite *NetlinkTestSuite) custom() firewall.Config {
+	bypass, err := firewall.ParsePrefixes("10.20.0.0/16, 192.0.2.7, 10.20.30.0/24, 10.21.0.0/16, 2001:db8::/32, ::1, 255.255.255.0/24")
+	suite.Require().NoError(err)
+	return firewall.Config{HTTPPorts: []int{80, 8000, 3128}, TLSPorts: []int{443, 8443}, Bypass: bypass, ExcludeLoopback: true}
+}
+
+// TestInstall tests the installation against transcripts recorded from the kernel
+func (suite *NetlinkTestSuite) TestInstall() {
+	tests := []struct {
+		transcript string
+		config     firewall.Config
+		ports      [2]int
+	}{
+		{transcript: "install.txt", config: firewall.DefaultConfig(), ports: [2]int{8080, 8443}},
+		{transcript: "install-custom.txt", config: suite.custom(), ports: [2]int{9080, 9443}},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.transcript, func() {
+			suite.SetupTest()
+			sent, received := suite.load(tt.transcript)
+			suite.conn.received = received
+			suite.Require().NoError(suite.firewall.SetConfig(tt.config))
+			suite.Require().NoError(suite.firewall.InstallRules(tt.ports[0], tt.ports[1]))
+			suite.Require().Len(suite.conn.sent, len(sent))
+			for i := range sent {
+				suite.Equal(hex.EncodeToString(sent[i]), hex.EncodeToString(suite.conn.sent[i]), "datagram %d", i)
+			}
+			suite.Empty(suite.conn.received)
+		})
+	}
+}
+
+// TestSets tests the interval elements of address sets
+func (suite *NetlinkTestSuite) TestSets() {
+	bypass, err := firewall.ParsePrefixes("10.0.0.0/25, 10.0.0.128/25, 192.0.2.7, 0.0.0.0/0")
+	suite.Require().NoError(err)
+	s := prefixSet("bypass_ipv4", bypass[:3], true)
+	suite.Equal([]string{"10.0.0.0/25", "10.0.0.128/25", "192.0.2.7"}, s.text)
+	// Adjacent intervals are merged, each interval ends with the address after it
+	suite.Equal([]element{
+		{key: []byte{10, 0, 0, 0}},
+		{key: []byte{10, 0, 1, 0}, end: true},
+		{key: []byte{192, 0, 2, 7}},
+		{key: []byte{192, 0, 2, 8}, end: true},
+	}, s.elements)
+	// An interval reaching the last address has no end
+	suite.Equal([]element{{key: []byte{0, 0, 0, 0}}}, prefixSet("bypass_ipv4", bypass[3:], true).elements)
+	suite.Equal([]element{{key: []byte{0, 80}}, {key: []byte{1, 187}}}, portSet("http_ports", []int{80, 443}).elements)
+}
+
+// TestUninstall tests deleting the table, then deleting it again
+func (suite *NetlinkTestSuite) TestUninstall() {
+	sent, received := suite.load("uninstall.txt")
+	suite.conn.received = received
+	suite.Require().NoError(suite.firewall.UninstallRules())
+	suite.Require().NoError(suite.firewall.UninstallRules())
+	suite.Equal(sent, suite.conn.sent)
+}
+
+// TestRender tests the scripts against the golden files, the sets, chains and expressions are the ones of the
+// install transcripts
+func (suite *NetlinkTestSuite) TestRender() {
+	golden.Assert(suite.T(), "ruleset.nft", suite.firewall.Render(8080, 8443))
+	suite.Require().NoError(suite.firewall.SetConfig(suite.custom()))
+	golden.Assert(suite.T(), "ruleset-custom.nft", suite.firewall.Render(9080, 9443))
+	suite.Empty(suite.conn.sent)
+
+	suite.Error(suite.firewall.SetConfig(firewall.Config{}))
+}
+
+// TestRecover tests deleting the table of a dead instance, then finding no table
+func (suite *NetlinkTestSuite) TestRecover() {
+	sent, received := suite.load("recover.txt")
+	suite.conn.received = received
+	suite.Require().NoError(suite.firewall.Recover())
+	suite.Require().NoError(suite.firewall.Recover())
+	suite.Equal(sent, suite.conn.sent)
+}
+
+// TestInUse tests that the table of another running instance is left alone
+func (suite *NetlinkTestSuite) TestInUse() {
+	comment := firewall.Owner{PID: os.Getppid(), HTTPPort: 1000, HTTPSPort: 1001}.String()
+	suite.conn.received = [][]byte{tables(1, comment), tables(2, comment)}
+	err := suite.firewall.InstallRules(8080, 8443)
+	suite.True(errors.Is(err, firewall.ErrInUse))
+	suite.Require().NoError(suite.firewall.Recover())
+	// Only the table dumps were sent
+	suite.Len(suite.conn.sent, 2)
+}
+
+// TestReadRuleset tests decoding the recorded dumps
+func (suite *NetlinkTestSuite) TestReadRuleset() {
+	_, received := suite.load("install.txt")
+	// Skip the table dump and the acknowledgements of the batch
+	suite.firewall.seq = 16
+	suite.conn.received = received[len(received)-4:]
+	chains, err := suite.firewall.readRuleset()
+	suite.Require().NoError(err)
+	suite.Require().Len(chains, 2)
+	output := chains[outputChain]
+	suite.True(output.hook)
+	suite.Equal("nat", output.typ)
+	suite.Equal(int32(nfIPPriNATDst), output.priority)
+	suite.Equal([]string{"[ immediate reg 0 jump -> go_webfilter_nat ]"}, output.rules)
+	suite.Equal([]string{
+		"[ meta load skuid => reg 1 ]\n" +
+			"[ cmp eq reg 1 0x00000000 ]\n" +
+			"[ immediate reg 0 return ]",
+		"[ meta load l4proto => reg 1 ]\n" +
+			"[ cmp eq reg 1 0x06 ]\n" +
+			"[ payload load 2b @ transport header + 2 => reg 1 ]\n" +
+			"[ lookup reg 1 set http_ports ]\n" +
+			"[ immediate reg 1 0x1f90 ]\n" +
+			"[ redir proto_min reg 1 flags 0x2 ]",
+		"[ meta load l4proto => reg 1 ]\n" +
+			"[ cmp eq reg 1 0x06 ]\n" +
+			"[ payload load 2b @ transport header + 2 => reg 1 ]\n" +
+			"[ lookup reg 1 set tls_ports ]\n" +
+			"[ immediate reg 1 0x20fb ]\n" +
+			"[ redir proto_min reg 1 flags 0x2 ]",
+	}, chains[natChain].rules)
+}
+
+// TestVerifyMismatch tests that rules read back differently are removed again
+func (suite *NetlinkTestSuite) TestVerifyMismatch() {
+	_, received := suite.load("install.txt")
+	// The kernel holds the rules for 8080 and 8443, not the ones sent
+	suite.conn.received = append(received, reply(20, 0))
+	err := suite.firewall.InstallRules(8081, 8443)
+	suite.ErrorContains(err, "error verifying table inet go_webfilter: rules of chain go_webfilter_nat differ")
+	suite.Len(suite.conn.sent, 5)
+}
+
+// TestTransactionError tests that the failing message is named
+func (suite *NetlinkTestSuite) TestTransactionError() {
+	acks := append(reply(3, 0), reply(4, 0)...)
+	acks = append(acks, append(reply(5, 0), append(reply(6, 0), reply(7, syscall.EOPNOTSUPP)...)...)...)
+	suite.conn.received = [][]byte{done(1), acks}
+	err := suite.firewall.InstallRules(8080, 8443)
+	suite.EqualError(err, "error in nf_tables transaction, add elements to set http_ports: operation not supported")
+	suite.True(errors.Is(err, syscall.EOPNOTSUPP))
+
+	suite.SetupTest()
+	_, err = parseMessages([]byte{0xff, 0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0})
+	suite.EqualError(err, "invalid netlink message length 255")
+}
+
+// TestNetlinkTestSuite runs the test suite
+func TestNetlinkTestSuite(t *testing.T) {
+	suite.Run(t, new(NetlinkTestSuite))
+}
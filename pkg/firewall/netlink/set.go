@@ -0,0 +1,152 @@
+package netlink
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Set attributes and values from linux/netfilter/nf_tables.h, key types are the ones of nft's datatype.h
+const (
+	nftaSetTable   = 1
+	nftaSetName    = 2
+	nftaSetFlags   = 3
+	nftaSetKeyType = 4
+	nftaSetKeyLen  = 5
+	nftaSetID      = 10
+
+	nftaSetElemListTable    = 1
+	nftaSetElemListSet      = 2
+	nftaSetElemListElements = 3
+	nftaSetElemListSetID    = 4
+
+	nftaSetElemKey   = 1
+	nftaSetElemFlags = 3
+
+	nftSetInterval        = 0x4
+	nftSetElemIntervalEnd = 0x1
+
+	typeIPAddr      = 7
+	typeIP6Addr     = 8
+	typeInetService = 13
+
+	// maxElements bounds the elements of one message, their nested attribute has a 16 bit length
+	maxElements = 1024
+)
+
+// element is a set key, the end of an interval if end is set
+type element struct {
+	key []byte
+	end bool
+}
+
+// set is a named set of Table, its elements as nft writes them and as they are sent
+type set struct {
+	name     string
+	typ      string
+	keyType  uint32
+	keyLen   uint32
+	interval bool
+	// id refers to the set in the transaction creating it
+	id       uint32
+	text     []string
+	elements []element
+}
+
+// portSet returns a set of ports
+func portSet(name string, ports []int) set {
+	s := set{name: name, typ: "inet_service", keyType: typeInetService, keyLen: 2}
+	for _, p := range ports {
+		s.text = append(s.text, strconv.Itoa(p))
+		s.elements = append(s.elements, element{key: port(p)})
+	}
+	return s
+}
+
+// prefixSet returns an interval set of addresses. The kernel takes each interval as its first address and the
+// address after its last one, flagged as the end. Adjacent prefixes are merged since they share that address.
+func prefixSet(name string, prefixes []netip.Prefix, is4 bool) set {
+	s := set{name: name, typ: "ipv6_addr", keyType: typeIP6Addr, keyLen: 16, interval: true}
+	if is4 {
+		s.typ, s.keyType, s.keyLen = "ipv4_addr", typeIPAddr, 4
+	}
+	for _, prefix := range prefixes {
+		if prefix.IsSingleIP() {
+			s.text = append(s.text, prefix.Addr().String())
+		} else {
+			s.text = append(s.text, prefix.String())
+		}
+		start := prefix.Addr().AsSlice()
+		if n := len(s.elements); n > 0 && s.elements[n-1].end && bytes.Equal(s.elements[n-1].key, start) {
+			s.elements = s.elements[:n-1]
+		} else {
+			s.elements = append(s.elements, element{key: start})
+		}
+		// The interval reaching the last address has no end
+		if next := last(prefix).Next(); next.IsValid() {
+			s.elements = append(s.elements, element{key: next.AsSlice(), end: true})
+		}
+	}
+	return s
+}
+
+// last returns the last address of prefix
+func last(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// encode returns the attributes of the NFT_MSG_NEWSET message creating the set
+func (s set) encode() [][]byte {
+	var flags uint32
+	if s.interval {
+		flags = nftSetInterval
+	}
+	return [][]byte{
+		encodeString(nftaSetTable, Table),
+		encodeString(nftaSetName, s.name),
+		encodeUint32(nftaSetFlags, flags),
+		encodeUint32(nftaSetKeyType, s.keyType),
+		encodeUint32(nftaSetKeyLen, s.keyLen),
+		encodeUint32(nftaSetID, s.id),
+	}
+}
+
+// encodeElements returns the attributes of the NFT_MSG_NEWSETELEM messages adding the elements, maxElements each
+func (s set) encodeElements() [][][]byte {
+	var messages [][][]byte
+	for i := 0; i < len(s.elements); i += maxElements {
+		var elems [][]byte
+		for _, e := range s.elements[i:min(i+maxElements, len(s.elements))] {
+			attrs := [][]byte{encodeNested(nftaSetElemKey, encodeAttr(nftaDataValue, e.key))}
+			if e.end {
+				attrs = append(attrs, encodeUint32(nftaSetElemFlags, nftSetElemIntervalEnd))
+			}
+			elems = append(elems, encodeNested(nftaListElem, attrs...))
+		}
+		messages = append(messages, [][]byte{
+			encodeString(nftaSetElemListTable, Table),
+			encodeString(nftaSetElemListSet, s.name),
+			encodeNested(nftaSetElemListElements, elems...),
+			encodeUint32(nftaSetElemListSetID, s.id),
+		})
+	}
+	return messages
+}
+
+// String returns the set as nft writes it
+func (s set) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "\tset %s {\n\t\ttype %s\n", s.name, s.typ)
+	if s.interval {
+		b.WriteString("\t\tflags interval\n")
+	}
+	fmt.Fprintf(&b, "\t\telements = { %s }\n\t}\n", strings.Join(s.text, ", "))
+	return b.String()
+}
@@ -0,0 +1,241 @@
+package netlink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Netlink and nf_tables constants from linux/netlink.h, linux/netfilter/nfnetlink.h and linux/netfilter/nf_tables.h
+const (
+	nlmsgHdrLen = 16
+	nfgenmsgLen = 4
+	nlaHdrLen   = 4
+	nlaFNested  = 0x8000
+	nlmsgError  = 2
+	nlmsgDone   = 3
+
+	nlmFRequest = 0x1
+	nlmFAck     = 0x4
+	nlmFDump    = 0x300
+	nlmFCreate  = 0x400
+	nlmFAppend  = 0x800
+
+	nfnlMsgBatchBegin  = 0x10
+	nfnlMsgBatchEnd    = 0x11
+	nfnlSubsysNFTables = 10
+	afUnspec           = 0
+	nfprotoInet        = 1
+
+	nftMsgNewTable   = 0
+	nftMsgGetTable   = 1
+	nftMsgDelTable   = 2
+	nftMsgNewChain   = 3
+	nftMsgGetChain   = 4
+	nftMsgNewRule    = 6
+	nftMsgGetRule    = 7
+	nftMsgNewSet     = 9
+	nftMsgNewSetElem = 12
+
+	nftaTableName     = 1
+	nftaTableUserdata = 6
+
+	// nftnlUdataTableComment is the type of the comment in table userdata, as libnftnl and nft write it
+	nftnlUdataTableComment = 0
+
+	nftaChainTable  = 1
+	nftaChainName   = 3
+	nftaChainHook   = 4
+	nftaChainPolicy = 5
+	nftaChainType   = 7
+
+	nftaHookHooknum  = 1
+	nftaHookPriority = 2
+
+	nftaRuleTable       = 1
+	nftaRuleChain       = 2
+	nftaRuleExpressions = 4
+
+	nftaListElem = 1
+	nftaExprName = 1
+	nftaExprData = 2
+)
+
+// attr is a decoded netlink attribute, type without the nested flag
+type attr struct {
+	typ  uint16
+	data []byte
+}
+
+// message is a decoded netlink message
+type message struct {
+	typ     uint16
+	flags   uint16
+	seq     uint32
+	payload []byte
+}
+
+// align4 rounds n up to the netlink alignment
+func align4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// encodeAttr encodes an attribute with its padding
+func encodeAttr(typ uint16, data []byte) []byte {
+	b := make([]byte, align4(nlaHdrLen+len(data)))
+	binary.NativeEndian.PutUint16(b[0:2], uint16(nlaHdrLen+len(data)))
+	binary.NativeEndian.PutUint16(b[2:4], typ)
+	copy(b[nlaHdrLen:], data)
+	return b
+}
+
+// encodeNested encodes attributes nested in one attribute of type typ
+func encodeNested(typ uint16, attrs ...[]byte) []byte {
+	var data []byte
+	for _, a := range attrs {
+		data = append(data, a...)
+	}
+	return encodeAttr(typ|nlaFNested, data)
+}
+
+// encodeString encodes a NUL terminated string attribute
+func encodeString(typ uint16, s string) []byte {
+	return encodeAttr(typ, append([]byte(s), 0))
+}
+
+// encodeUint32 encodes a 32 bit attribute, nf_tables expects them in network byte order
+func encodeUint32(typ uint16, v uint32) []byte {
+	return encodeAttr(typ, binary.BigEndian.AppendUint32(nil, v))
+}
+
+// encodeMessage builds a message of the nf_tables subsystem, or a batch control message, with the nfgenmsg header
+func encodeMessage(typ, flags uint16, seq uint32, family uint8, attrs ...[]byte) []byte {
+	b := make([]byte, nlmsgHdrLen+nfgenmsgLen)
+	for _, a := range attrs {
+		b = append(b, a...)
+	}
+	binary.NativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	binary.NativeEndian.PutUint16(b[4:6], typ)
+	binary.NativeEndian.PutUint16(b[6:8], flags)
+	binary.NativeEndian.PutUint32(b[8:12], seq)
+	// struct nfgenmsg: family, version 0 and the resource id, the subsystem for batch messages
+	b[nlmsgHdrLen] = family
+	if typ == nfnlMsgBatchBegin || typ == nfnlMsgBatchEnd {
+		binary.BigEndian.PutUint16(b[nlmsgHdrLen+2:nlmsgHdrLen+4], nfnlSubsysNFTables)
+	}
+	return b
+}
+
+// encodeComment encodes the userdata of a table holding only a NUL terminated comment
+func encodeComment(comment string) []byte {
+	data := append([]byte{nftnlUdataTableComment, byte(len(comment) + 1)}, comment...)
+	return encodeAttr(nftaTableUserdata, append(data, 0))
+}
+
+// decodeComment returns the comment in the userdata of a table
+func decodeComment(data []byte) string {
+	// Userdata is a list of type, length, value entries
+	for len(data) >= 2 && len(data) >= 2+int(data[1]) {
+		typ, value := data[0], data[2:2+int(data[1])]
+		if typ == nftnlUdataTableComment {
+			if i := bytes.IndexByte(value, 0); i >= 0 {
+				value = value[:i]
+			}
+			return string(value)
+		}
+		data = data[2+len(value):]
+	}
+	return ""
+}
+
+// nftType returns the netlink message type of an nf_tables message
+func nftType(msg uint16) uint16 {
+	return nfnlSubsysNFTables<<8 | msg
+}
+
+// parseMessages splits a datagram from the kernel into messages
+func parseMessages(data []byte) ([]message, error) {
+	var messages []message
+	for len(data) >= nlmsgHdrLen {
+		msgLen := int(binary.NativeEndian.Uint32(data[0:4]))
+		if msgLen < nlmsgHdrLen || msgLen > len(data) {
+			return nil, fmt.Errorf("invalid netlink message length %d", msgLen)
+		}
+		messages = append(messages, message{
+			typ:     binary.NativeEndian.Uint16(data[4:6]),
+			flags:   binary.NativeEndian.Uint16(data[6:8]),
+			seq:     binary.NativeEndian.Uint32(data[8:12]),
+			payload: data[nlmsgHdrLen:msgLen],
+		})
+		data = data[min(align4(msgLen), len(data)):]
+	}
+	return messages, nil
+}
+
+// errno returns the error carried by an NLMSG_ERROR message, nil for an acknowledgement
+func (m message) errno() error {
+	if len(m.payload) < 4 {
+		return errors.New("truncated netlink error")
+	}
+	if code := -int32(binary.NativeEndian.Uint32(m.payload[0:4])); code != 0 {
+		return syscall.Errno(code)
+	}
+	return nil
+}
+
+// attrs decodes the attributes of an nf_tables message, after its nfgenmsg header
+func (m message) attrs() ([]attr, error) {
+	if len(m.payload) < nfgenmsgLen {
+		return nil, errors.New("truncated nf_tables message")
+	}
+	return parseAttrs(m.payload[nfgenmsgLen:])
+}
+
+// parseAttrs decodes a list of attributes
+func parseAttrs(data []byte) ([]attr, error) {
+	var attrs []attr
+	for len(data) >= nlaHdrLen {
+		attrLen := int(binary.NativeEndian.Uint16(data[0:2]))
+		if attrLen < nlaHdrLen || attrLen > len(data) {
+			return nil, fmt.Errorf("invalid netlink attribute length %d", attrLen)
+		}
+		attrs = append(attrs, attr{
+			typ:  binary.NativeEndian.Uint16(data[2:4]) &^ nlaFNested,
+			data: data[nlaHdrLen:attrLen],
+		})
+		data = data[min(align4(attrLen), len(data)):]
+	}
+	return attrs, nil
+}
+
+// find returns the data of the first attribute of type typ
+func find(attrs []attr, typ uint16) ([]byte, bool) {
+	for _, a := range attrs {
+		if a.typ == typ {
+			return a.data, true
+		}
+	}
+	return nil, false
+}
+
+// findString returns a string attribute without its NUL terminator
+func findString(attrs []attr, typ uint16) string {
+	data, _ := find(attrs, typ)
+	for i, c := range data {
+		if c == 0 {
+			return string(data[:i])
+		}
+	}
+	return string(data)
+}
+
+// findUint32 returns a 32 bit attribute in network byte order
+func findUint32(attrs []attr, typ uint16) (uint32, bool) {
+	data, ok := find(attrs, typ)
+	if !ok || len(data) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(data), true
+}
@@ -0,0 +1,7 @@
+package nft
+
+// Runner runs the nft command, tests record it instead
+type Runner interface {
+	// Run runs nft with args, feeding it input, and returns its combined output
+	Run(input []byte, args ...string) ([]byte, error)
+}
@@ -3,48 +3,201 @@ package nft
 import (
 	"bytes"
 	"fmt"
+	"net/netip"
 	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/rs/zerolog"
+	"github.com/tb0hdan/go-webfilter/pkg/firewall"
 )
 
+// Table is the inet table holding the chains, it is replaced and deleted as a whole
+const Table = "go_webfilter"
+
+// commentPattern finds the comment in the output of nft list table
+var commentPattern = regexp.MustCompile(`(?m)^\s*comment "([^"]*)"`)
+
+// ExecRunner runs the nft binary
+type ExecRunner struct{}
+
+func (ExecRunner) Run(input []byte, args ...string) ([]byte, error) {
+	command := exec.Command("nft", args...)
+	var out bytes.Buffer
+	command.Stdin = bytes.NewReader(input)
+	command.Stdout = &out
+	command.Stderr = &out
+	err := command.Run()
+	return out.Bytes(), err
+}
+
 type NFTFirewall struct {
 	logger zerolog.Logger
+	runner Runner
+	// owner is recorded in the table comment
+	owner  func(redirectPort int, redirectHTTPSPort int) firewall.Owner
+	config firewall.Config
+}
+
+func (n *NFTFirewall) SetConfig(config firewall.Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	n.config = config
+	return nil
+}
+
+// ruleset returns the nft script replacing the table in one transaction: the table is added so that deleting it
+// never fails, deleted and created again. The kernel applies all of it or nothing.
+func ruleset(owner firewall.Owner, config firewall.Config) string {
+	// inet tables handle both IPv4 and IPv6 traffic
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %[1]s\ndelete table inet %[1]s\ntable inet %[1]s {\n\tcomment \"%[2]s\"\n", Table, owner)
+	// Named sets keep one rule per purpose however long the lists get
+	var ports [][]string
+	for _, p := range [][]int{config.HTTPPorts, config.TLSPorts} {
+		var elements []string
+		for _, port := range firewall.Ports(p) {
+			elements = append(elements, strconv.Itoa(port))
+		}
+		ports = append(ports, elements)
+	}
+	set(&b, "http_ports", "inet_service", false, ports[0])
+	set(&b, "tls_ports", "inet_service", false, ports[1])
+	set(&b, "bypass_ipv4", "ipv4_addr", true, prefixes(config.BypassIPv4()))
+	set(&b, "bypass_ipv6", "ipv6_addr", true, prefixes(config.BypassIPv6()))
+
+	b.WriteString("\tchain go_webfilter_nat {\n")
+	// meta skuid root return; - Do not process packets coming from user uid == 0 (root)
+	b.WriteString("\t\tmeta skuid root return\n")
+	if config.ExcludeLoopback {
+		b.WriteString("\t\toifname \"lo\" return\n")
+	}
+	if len(config.BypassIPv4()) > 0 {
+		b.WriteString("\t\tip daddr @bypass_ipv4 return\n")
+	}
+	if len(config.BypassIPv6()) > 0 {
+		b.WriteString("\t\tip6 daddr @bypass_ipv6 return\n")
+	}
+	// tcp dport @http_ports redirect to :<redirectPort>; - Redirect HTTP traffic to the specified port
+	if len(ports[0]) > 0 {
+		fmt.Fprintf(&b, "\t\ttcp dport @http_ports redirect to :%d\n", owner.HTTPPort)
+	}
+	// tcp dport @tls_ports redirect to :<redirectHTTPSPort>; - Redirect HTTPS traffic to the specified port
+	if len(ports[1]) > 0 {
+		fmt.Fprintf(&b, "\t\ttcp dport @tls_ports redirect to :%d\n", owner.HTTPSPort)
+	}
+	b.WriteString("\t}\n")
+
+	// https://wiki.nftables.org/wiki-nftables/index.php/Netfilter_hooks
+	// priority dstnat equals to -100
+	b.WriteString("\tchain OUTPUT {\n\t\ttype nat hook output priority dstnat; policy accept;\n\t\tjump go_webfilter_nat\n\t}\n}\n")
+	return b.String()
+}
+
+// set writes a named set, sets without elements are left out
+func set(b *strings.Builder, name, typ string, interval bool, elements []string) {
+	if len(elements) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "\tset %s {\n\t\ttype %s\n", name, typ)
+	if interval {
+		b.WriteString("\t\tflags interval\n")
+	}
+	fmt.Fprintf(b, "\t\telements = { %s }\n\t}\n", strings.Join(elements, ", "))
+}
+
+// prefixes returns set elements, a single address without its prefix length
+func prefixes(bypass []netip.Prefix) []string {
+	elements := make([]string, 0, len(bypass))
+	for _, prefix := range bypass {
+		if prefix.IsSingleIP() {
+			elements = append(elements, prefix.Addr().String())
+		} else {
+			elements = append(elements, prefix.String())
+		}
+	}
+	return elements
 }
 
 func (n *NFTFirewall) InstallRules(redirectPort int, redirectHTTPSPort int) error {
-	commands := [][]string{
-		{"nft", "add", "table", "ip", "go_webfilter"},
-		{"nft", "add", "chain", "ip", "go_webfilter", "go_webfilter_nat",
-			// meta skuid root return; - Do not process packets coming from user uid == 0 (root)
-			// tcp dport 80 redirect to :<redirectPort>; - Redirect HTTP traffic to the specified port
-			// tcp dport 443 redirect to :<redirectHTTPSPort>; - Redirect HTTPS traffic to the specified port
-			fmt.Sprintf("{meta skuid root return; tcp dport 80 redirect to :%d; tcp dport 443 redirect to :%d;}", redirectPort, redirectHTTPSPort)},
-		// https://wiki.nftables.org/wiki-nftables/index.php/Netfilter_hooks
-		// priority dstnat equals to -100
-		{"nft", "add", "chain", "ip", "go_webfilter", "OUTPUT", "{type nat hook output priority dstnat; policy accept; jump go_webfilter_nat; }"},
-	}
-
-	for _, cmd := range commands {
-		command := exec.Command(cmd[0], cmd[1:]...)
-		var out bytes.Buffer
-		command.Stdout = &out
-		command.Stderr = &out
-		if err := command.Run(); err != nil {
-			return fmt.Errorf("error running command %s: %v, output: %s", cmd, err, out.String())
+	comment, exists, err := n.comment()
+	if err != nil {
+		return err
+	}
+	if exists {
+		if err := firewall.InUse(comment); err != nil {
+			return err
 		}
-		n.logger.Debug().Msgf("Command %s executed successfully\n", cmd)
+		n.logger.Warn().Msgf("Replacing table inet %s left by %q", Table, comment)
+	}
+	if err := n.run(n.Render(redirectPort, redirectHTTPSPort), "-f", "-"); err != nil {
+		return err
 	}
+	n.logger.Debug().Msgf("Table inet %s installed", Table)
 	return nil
 }
 
+// Render returns the nft script InstallRules runs
+func (n *NFTFirewall) Render(redirectPort int, redirectHTTPSPort int) string {
+	return ruleset(n.owner(redirectPort, redirectHTTPSPort), n.config)
+}
+
 func (n *NFTFirewall) UninstallRules() error {
 	n.logger.Debug().Msg("Cleaning up nftables table...")
-	return exec.Command("nft", "delete", "table", "go_webfilter").Run()
+	_, exists, err := n.comment()
+	if err != nil || !exists {
+		return err
+	}
+	return n.run("", "delete", "table", "inet", Table)
+}
+
+// Recover deletes the table if the instance that installed it is gone
+func (n *NFTFirewall) Recover() error {
+	comment, exists, err := n.comment()
+	if err != nil || !exists || !firewall.Orphaned(comment) {
+		return err
+	}
+	n.logger.Warn().Msgf("Deleting orphaned table inet %s left by %q", Table, comment)
+	return n.run("", "delete", "table", "inet", Table)
+}
+
+// comment returns the comment of the table, exists is false if there is no table
+func (n *NFTFirewall) comment() (comment string, exists bool, err error) {
+	out, err := n.runner.Run(nil, "list", "table", "inet", Table)
+	if err != nil {
+		if bytes.Contains(out, []byte("No such file or directory")) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("error listing table inet %s: %w, output: %s", Table, err, strings.TrimSpace(string(out)))
+	}
+	if match := commentPattern.FindSubmatch(out); match != nil {
+		comment = string(match[1])
+	}
+	return comment, true, nil
+}
+
+// run runs nft with args, input is the script for nft -f -
+func (n *NFTFirewall) run(input string, args ...string) error {
+	out, err := n.runner.Run([]byte(input), args...)
+	if err != nil {
+		return fmt.Errorf("error running command nft %s: %w, output: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	n.logger.Debug().Msgf("Command nft %s executed successfully", strings.Join(args, " "))
+	return nil
 }
 
 func New(logger zerolog.Logger) *NFTFirewall {
+	return NewWithRunner(logger, ExecRunner{})
+}
+
+// NewWithRunner creates a firewall running nft with runner
+func NewWithRunner(logger zerolog.Logger, runner Runner) *NFTFirewall {
 	return &NFTFirewall{
 		logger: logger,
+		runner: runner,
+		owner:  firewall.NewOwner,
+		config: firewall.DefaultConfig(),
 	}
 }
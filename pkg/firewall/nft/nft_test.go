@@ -0,0 +1,187 @@
+package nft
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+	"github.com/tb0hdan/go-webfilter/pkg/firewall"
+	"github.com/tb0hdan/go-webfilter/pkg/firewall/internal/golden"
+)
+
+// deadPID is above the largest pid_max, no process ever has it
+const deadPID = 99999999
+
+// fakeNFT keeps the comment of the table the way nft would, exists is false without a table
+type fakeNFT struct {
+	exists  bool
+	comment string
+	calls   []string
+	scripts []string
+}
+
+func (f *fakeNFT) Run(input []byte, args ...string) ([]byte, error) {
+	call := strings.Join(args, " ")
+	f.calls = append(f.calls, call)
+	switch call {
+	case "list table inet go_webfilter":
+		if !f.exists {
+			return []byte("Error: No such file or directory\nlist table inet go_webfilter\n                 ^^^^^^^^^^^^"), errors.New("exit status 1")
+		}
+		out := "table inet go_webfilter {\n"
+		if f.comment != "" {
+			out += fmt.Sprintf("\tcomment %q\n", f.comment)
+		}
+		return []byte(out + "\tchain OUTPUT {\n\t}\n}\n"), nil
+	case "delete table inet go_webfilter":
+		if !f.exists {
+			return []byte("Error: No such file or directory"), errors.New("exit status 1")
+		}
+		f.exists, f.comment = false, ""
+	case "-f -":
+		f.scripts = append(f.scripts, string(input))
+		f.exists, f.comment = true, regexp.MustCompile(`comment "([^"]*)"`).FindStringSubmatch(string(input))[1]
+	default:
+		return nil, errors.New("exit status 2")
+	}
+	return nil, nil
+}
+
+// NFTTestSuite defines the test suite for the nft firewall
+type NFTTestSuite struct {
+	suite.Suite
+	nft      *fakeNFT
+	firewall *NFTFirewall
+}
+
+// SetupTest creates a firewall without a table, owned by this process since a fixed time
+func (suite *NFTTestSuite) SetupTest() {
+	suite.nft = &fakeNFT{}
+	suite.firewall = NewWithRunner(zerolog.Nop(), suite.nft)
+	suite.firewall.owner = func(redirectPort int, redirectHTTPSPort int) firewall.Owner {
+		return firewall.Owner{PID: os.Getpid(), HTTPPort: redirectPort, HTTPSPort: redirectHTTPSPort, Started: time.Date(2026, 10, 16, 8, 30, 0, 0, time.UTC)}
+	}
+}
+
+func (suite *NFTTestSuite) owned(pid int) string {
+	started, err := firewall.ProcessStarted(pid)
+	if err != nil {
+		// Dead processes started whenever
+		started = time.Date(2026, 10, 15, 8, 30, 0, 0, time.UTC)
+	}
+	return firewall.Owner{PID: pid, HTTPPort: 1000, HTTPSPort: 1001, Started: started}.String()
+}
+
+// TestInstall tests that the table is replaced in a single transaction
+func (suite *NFTTestSuite) TestInstall() {
+	suite.Require().NoError(suite.firewall.InstallRules(8080, 8443))
+	suite.Equal([]string{"list table inet go_webfilter", "-f -"}, suite.nft.calls)
+	suite.Equal(fmt.Sprintf(`table inet go_webfilter
+delete table inet go_webfilter
+table inet go_webfilter {
+	comment "go-webfilter pid=%d http=8080 https=8443 started=2026-10-16T08:30:00Z"
+	set http_ports {
+		type inet_service
+		elements = { 80 }
+	}
+	set tls_ports {
+		type inet_service
+		elements = { 443 }
+	}
+	chain go_webfilter_nat {
+		meta skuid root return
+		tcp dport @http_ports redirect to :8080
+		tcp dport @tls_ports redirect to :8443
+	}
+	chain OUTPUT {
+		type nat hook output priority dstnat; policy accept;
+		jump go_webfilter_nat
+	}
+}
+`, os.Getpid()), suite.nft.scripts[0])
+
+	// Installing again replaces this process's own table
+	suite.Require().NoError(suite.firewall.InstallRules(9080, 9443))
+	suite.Len(suite.nft.scripts, 2)
+	suite.Contains(suite.nft.comment, "http=9080 https=9443")
+
+	suite.Require().NoError(suite.firewall.UninstallRules())
+	suite.False(suite.nft.exists)
+	suite.Require().NoError(suite.firewall.UninstallRules())
+}
+
+// TestRender tests the script against the golden files and that it is the one installed
+func (suite *NFTTestSuite) TestRender() {
+	suite.firewall.owner = func(redirectPort int, redirectHTTPSPort int) firewall.Owner {
+		return firewall.Owner{PID: 4242, HTTPPort: redirectPort, HTTPSPort: redirectHTTPSPort, Started: time.Date(2026, 10, 16, 8, 30, 0, 0, time.UTC)}
+	}
+	rendered := suite.firewall.Render(8080, 8443)
+	golden.Assert(suite.T(), "ruleset.nft", rendered)
+	suite.Empty(suite.nft.calls)
+	suite.Require().NoError(suite.firewall.InstallRules(8080, 8443))
+	suite.Equal([]string{rendered}, suite.nft.scripts)
+
+	bypass, err := firewall.ParsePrefixes("10.20.0.0/16, 192.0.2.7, 10.20.30.0/24, 2001:db8::/32, ::1")
+	suite.Require().NoError(err)
+	suite.Require().NoError(suite.firewall.SetConfig(firewall.Config{
+		HTTPPorts:       []int{8080, 80, 3128, 8000, 80},
+		TLSPorts:        []int{443, 8443},
+		Bypass:          bypass,
+		ExcludeLoopback: true,
+	}))
+	golden.Assert(suite.T(), "ruleset-custom.nft", suite.firewall.Render(9080, 9443))
+
+	suite.Error(suite.firewall.SetConfig(firewall.Config{HTTPPorts: []int{443}, TLSPorts: []int{443}}))
+}
+
+// TestStale tests replacing and recovering tables of instances that are gone
+func (suite *NFTTestSuite) TestStale() {
+	for _, comment := range []string{suite.owned(deadPID), ""} {
+		suite.Run(comment, func() {
+			suite.SetupTest()
+			suite.nft.exists, suite.nft.comment = true, comment
+			suite.Require().NoError(suite.firewall.InstallRules(8080, 8443))
+			suite.Contains(suite.nft.comment, "http=8080")
+
+			suite.nft.comment = comment
+			suite.Require().NoError(suite.firewall.Recover())
+			suite.False(suite.nft.exists)
+			suite.Require().NoError(suite.firewall.Recover())
+		})
+	}
+}
+
+// TestInUse tests that the table of another running instance is left alone
+func (suite *NFTTestSuite) TestInUse() {
+	suite.nft.exists, suite.nft.comment = true, suite.owned(os.Getppid())
+	err := suite.firewall.InstallRules(8080, 8443)
+	suite.True(errors.Is(err, firewall.ErrInUse))
+	suite.Require().NoError(suite.firewall.Recover())
+	suite.True(suite.nft.exists)
+	suite.Empty(suite.nft.scripts)
+}
+
+// TestError tests that nft output ends up in errors
+func (suite *NFTTestSuite) TestError() {
+	suite.firewall.runner = runnerFunc(func(input []byte, args ...string) ([]byte, error) {
+		return []byte("Error: Could not process rule: Operation not permitted\n"), errors.New("exit status 1")
+	})
+	suite.EqualError(suite.firewall.InstallRules(8080, 8443), "error listing table inet go_webfilter: exit status 1, output: Error: Could not process rule: Operation not permitted")
+}
+
+type runnerFunc func(input []byte, args ...string) ([]byte, error)
+
+func (f runnerFunc) Run(input []byte, args ...string) ([]byte, error) {
+	return f(input, args...)
+}
+
+// TestNFTTestSuite runs the test suite
+func TestNFTTestSuite(t *testing.T) {
+	suite.Run(t, new(NFTTestSuite))
+}
@@ -0,0 +1,171 @@
+package firewall
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrInUse is returned when installing over the rules of another running instance
+var ErrInUse = errors.New("firewall rules are in use by another running instance")
+
+// ownerPrefix starts every comment written by Owner.String
+const ownerPrefix = "go-webfilter"
+
+const (
+	// clockTicks is USER_HZ, the unit of start times in /proc/<pid>/stat, it is 100 on every architecture
+	clockTicks = 100
+	// startSlack absorbs rounding and the drift of the boot time reported by the kernel
+	startSlack = 2 * time.Second
+)
+
+// started is when this process started, as far as the rules are concerned
+var started = func() time.Time {
+	if t, err := ProcessStarted(os.Getpid()); err == nil {
+		return t
+	}
+	return time.Now().UTC().Truncate(time.Second)
+}()
+
+// Owner is the instance that installed the rules, recorded in a comment next to them
+type Owner struct {
+	PID       int
+	HTTPPort  int
+	HTTPSPort int
+	Started   time.Time
+}
+
+// NewOwner returns this process as the owner of rules redirecting to the ports
+func NewOwner(redirectPort int, redirectHTTPSPort int) Owner {
+	return Owner{PID: os.Getpid(), HTTPPort: redirectPort, HTTPSPort: redirectHTTPSPort, Started: started}
+}
+
+// String returns the comment recorded with the rules
+func (o Owner) String() string {
+	return fmt.Sprintf("%s pid=%d http=%d https=%d started=%s", ownerPrefix, o.PID, o.HTTPPort, o.HTTPSPort, o.Started.UTC().Format(time.RFC3339))
+}
+
+// ParseOwner parses a comment written by Owner.String, ok is false for any other comment
+func ParseOwner(comment string) (owner Owner, ok bool) {
+	fields := strings.Fields(comment)
+	if len(fields) == 0 || fields[0] != ownerPrefix {
+		return Owner{}, false
+	}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		var err error
+		switch key {
+		case "pid":
+			owner.PID, err = strconv.Atoi(value)
+		case "http":
+			owner.HTTPPort, err = strconv.Atoi(value)
+		case "https":
+			owner.HTTPSPort, err = strconv.Atoi(value)
+		case "started":
+			owner.Started, err = time.Parse(time.RFC3339, value)
+		}
+		if err != nil {
+			return Owner{}, false
+		}
+	}
+	return owner, owner.PID > 0
+}
+
+// Running reports whether the owner process still exists. Its PID may have been reused since, or belong
+// to another PID namespace, so the process with that PID has to have started when the owner did.
+func (o Owner) Running() bool {
+	if o.PID <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(o.PID)
+	if err != nil {
+		return false
+	}
+	// Signal 0 only checks the process, EPERM means it exists but belongs to someone else
+	if err := process.Signal(syscall.Signal(0)); err != nil && !errors.Is(err, syscall.EPERM) {
+		return false
+	}
+	if o.Started.IsZero() {
+		return true
+	}
+	start, err := ProcessStarted(o.PID)
+	if err != nil {
+		// The start time is hidden, e.g. procfs is mounted with hidepid, unless the process just exited
+		return !errors.Is(err, os.ErrNotExist)
+	}
+	return start.Sub(o.Started).Abs() <= startSlack
+}
+
+// ProcessStarted returns when the process pid started, to the second
+func ProcessStarted(pid int) (time.Time, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error reading process status: %w", err)
+	}
+	// The command may contain spaces and parentheses, the fields after it start with the third one
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return time.Time{}, fmt.Errorf("error parsing status of process %d", pid)
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	// starttime is the 22nd field, in clock ticks since boot
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("error parsing status of process %d", pid)
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error parsing start time of process %d: %w", pid, err)
+	}
+	boot, err := bootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return boot.Add(time.Duration(ticks) * time.Second / clockTicks).UTC().Truncate(time.Second), nil
+}
+
+// bootTime returns when the system booted, from the btime line of /proc/stat
+func bootTime() (time.Time, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error reading boot time: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "btime "); ok {
+			seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("error parsing boot time: %w", err)
+			}
+			return time.Unix(seconds, 0), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, fmt.Errorf("error reading boot time: %w", err)
+	}
+	return time.Time{}, errors.New("boot time not found")
+}
+
+// InUse returns ErrInUse if rules recorded with comment belong to another instance that is still running
+func InUse(comment string) error {
+	owner, ok := ParseOwner(comment)
+	if !ok || owner.PID == os.Getpid() || !owner.Running() {
+		return nil
+	}
+	return fmt.Errorf("%w: PID %d redirecting to ports %d and %d since %s", ErrInUse, owner.PID, owner.HTTPPort, owner.HTTPSPort, owner.Started.Format(time.RFC3339))
+}
+
+// Orphaned reports whether rules recorded with comment were left by an instance that is no longer running.
+// Rules without an owner are from a version that didn't record it and are orphaned as well.
+func Orphaned(comment string) bool {
+	owner, ok := ParseOwner(comment)
+	return !ok || !owner.Running()
+}
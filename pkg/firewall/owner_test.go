@@ -0,0 +1,79 @@
+package firewall_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/tb0hdan/go-webfilter/pkg/firewall"
+)
+
+// deadPID is above the largest pid_max, no process ever has it
+const deadPID = 99999999
+
+// OwnerTestSuite defines the test suite for rule ownership
+type OwnerTestSuite struct {
+	suite.Suite
+}
+
+func comment(pid int) string {
+	return firewall.Owner{PID: pid, HTTPPort: 8080, HTTPSPort: 8443, Started: time.Date(2026, 10, 16, 8, 30, 0, 0, time.UTC)}.String()
+}
+
+// running returns the comment of the running process pid
+func (suite *OwnerTestSuite) running(pid int) string {
+	start, err := firewall.ProcessStarted(pid)
+	suite.Require().NoError(err)
+	return firewall.Owner{PID: pid, HTTPPort: 8080, HTTPSPort: 8443, Started: start}.String()
+}
+
+// TestString tests the comment format and parsing it back
+func (suite *OwnerTestSuite) TestString() {
+	suite.Equal("go-webfilter pid=42 http=8080 https=8443 started=2026-10-16T08:30:00Z", comment(42))
+	owner, ok := firewall.ParseOwner(comment(42))
+	suite.True(ok)
+	suite.Equal(firewall.Owner{PID: 42, HTTPPort: 8080, HTTPSPort: 8443, Started: time.Date(2026, 10, 16, 8, 30, 0, 0, time.UTC)}, owner)
+
+	for _, invalid := range []string{"", "some other table", "go-webfilter pid=x", "go-webfilter http=80"} {
+		_, ok := firewall.ParseOwner(invalid)
+		suite.False(ok, invalid)
+	}
+
+	current := firewall.NewOwner(1, 2)
+	suite.Equal(os.Getpid(), current.PID)
+	suite.True(current.Running())
+	suite.WithinDuration(time.Now(), current.Started, time.Minute)
+}
+
+// TestOwnership tests which rules are replaced and which are recovered
+func (suite *OwnerTestSuite) TestOwnership() {
+	tests := []struct {
+		name     string
+		comment  string
+		inUse    bool
+		orphaned bool
+	}{
+		{name: "this process", comment: suite.running(os.Getpid())},
+		{name: "another running process", comment: suite.running(os.Getppid()), inUse: true},
+		{name: "reused pid", comment: comment(os.Getppid()), orphaned: true},
+		{name: "unknown start", comment: fmt.Sprintf("go-webfilter pid=%d", os.Getppid()), inUse: true},
+		{name: "dead process", comment: comment(deadPID), orphaned: true},
+		{name: "no owner", comment: "", orphaned: true},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			err := firewall.InUse(tt.comment)
+			suite.Equal(tt.inUse, errors.Is(err, firewall.ErrInUse), fmt.Sprint(err))
+			suite.Equal(tt.orphaned, firewall.Orphaned(tt.comment))
+		})
+	}
+	suite.ErrorContains(firewall.InUse(suite.running(os.Getppid())), fmt.Sprintf("PID %d redirecting to ports 8080 and 8443 since", os.Getppid()))
+}
+
+// TestOwnerTestSuite runs the test suite
+func TestOwnerTestSuite(t *testing.T) {
+	suite.Run(t, new(OwnerTestSuite))
+}
@@ -0,0 +1,254 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+)
+
+// DefaultHookTimeout is how long a hook in a Chain may run unless registered with its own timeout
+const DefaultHookTimeout = 5 * time.Second
+
+type chainEntry struct {
+	name     string
+	hook     Hook
+	priority int
+	timeout  time.Duration
+}
+
+// Chain runs several hooks as one. Hooks run by ascending priority, in registration order
+// for equal priorities, until one of them makes a terminal or final decision.
+// Rewrites of modify decisions are collected and applied in order.
+// A hook that panics or runs out of time fails the request like a hook returning an error.
+type Chain struct {
+	logger  zerolog.Logger
+	mu      sync.RWMutex
+	entries []chainEntry
+}
+
+// Add registers hook under name. A zero timeout means DefaultHookTimeout, a negative one disables it.
+// Hooks should stop working once c.Request().Context() is done, a timed out hook is not waited for.
+func (ch *Chain) Add(name string, hook Hook, priority int, timeout time.Duration) {
+	if timeout == 0 {
+		timeout = DefaultHookTimeout
+	}
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	// Requests in flight keep iterating over the old slice
+	entries := append(append([]chainEntry{}, ch.entries...), chainEntry{name: name, hook: hook, priority: priority, timeout: timeout})
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].priority < entries[j].priority
+	})
+	ch.entries = entries
+}
+
+// Names returns the registered hooks in the order they run
+func (ch *Chain) Names() []string {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	names := make([]string, 0, len(ch.entries))
+	for _, entry := range ch.entries {
+		names = append(names, entry.name)
+	}
+	return names
+}
+
+func (ch *Chain) snapshot() []chainEntry {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.entries
+}
+
+func (ch *Chain) BeforeRequest(c echo.Context) (Decision, error) {
+	var rewrites []func(req *http.Request) error
+	for _, entry := range ch.snapshot() {
+		var decision Decision
+		err := ch.run(c, entry, func(hc echo.Context) error {
+			var err error
+			decision, err = entry.hook.BeforeRequest(hc)
+			return err
+		})
+		if err != nil {
+			return Decision{}, err
+		}
+		decision.Hook = entry.name
+		if decision.Action == ActionModify && decision.Rewrite != nil {
+			rewrites = append(rewrites, decision.Rewrite)
+		}
+		if decision.Terminal() || decision.Final {
+			ch.logger.Debug().Msgf("Hook %s decided to %s %s", entry.name, decision.Action, c.Request().Host)
+			return withRewrites(decision, rewrites), nil
+		}
+	}
+	// Nobody objected
+	return withRewrites(Allow(), rewrites), nil
+}
+
+func (ch *Chain) AfterRequest(c echo.Context, rsp *http.Response) error {
+	var errs []error
+	for _, entry := range ch.snapshot() {
+		err := ch.run(c, entry, func(hc echo.Context) error {
+			return entry.hook.AfterRequest(hc, rsp)
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// BeforeTLS runs the hooks implementing TLSHook until one returns ErrPassThrough,
+// the first other error resets the connection
+func (ch *Chain) BeforeTLS(info *TLSInfo) error {
+	for _, entry := range ch.snapshot() {
+		tlsHook, ok := entry.hook.(TLSHook)
+		if !ok {
+			continue
+		}
+		err := ch.call(context.Background(), entry, func(context.Context) error {
+			return tlsHook.BeforeTLS(info)
+		})
+		if errors.Is(err, ErrPassThrough) {
+			ch.logger.Debug().Msgf("Hook %s decided to pass through %s", entry.name, info.ServerName)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run calls fn with a detached copy of c whose request expires after the timeout of entry.
+// A timed out hook keeps its copy, echo recycles c once the request is done.
+// The request of a hook that succeeds is handed on to the next hooks without that deadline.
+func (ch *Chain) run(c echo.Context, entry chainEntry, fn func(hc echo.Context) error) error {
+	parent := c.Request().Context()
+	var hc *hookContext
+	err := ch.call(parent, entry, func(ctx context.Context) error {
+		hc = detach(c, c.Request().Clone(ctx))
+		return fn(hc)
+	})
+	if err != nil {
+		return err
+	}
+	if hc.replaced {
+		c.SetRequest(hc.Request().WithContext(valuesContext{Context: parent, values: hc.Request().Context()}))
+	} else {
+		c.SetRequest(hc.Request().WithContext(parent))
+	}
+	return nil
+}
+
+// call runs fn in its own goroutine, turning panics and timeouts into errors
+func (ch *Chain) call(parent context.Context, entry chainEntry, fn func(ctx context.Context) error) error {
+	ctx, cancel := parent, context.CancelFunc(func() {})
+	if entry.timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, entry.timeout)
+	}
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				ch.logger.Error().Msgf("Hook %s panicked: %v\n%s", entry.name, r, debug.Stack())
+				done <- fmt.Errorf("hook %s panicked: %v", entry.name, r)
+			}
+		}()
+		if err := fn(ctx); err != nil {
+			done <- fmt.Errorf("hook %s: %w", entry.name, err)
+			return
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			ch.logger.Error().Msgf("Hook %s timed out after %s", entry.name, entry.timeout)
+			return fmt.Errorf("hook %s timed out after %s", entry.name, entry.timeout)
+		}
+		return fmt.Errorf("hook %s: %w", entry.name, ctx.Err())
+	}
+}
+
+// withRewrites makes decision apply all rewrites collected along the chain
+func withRewrites(decision Decision, rewrites []func(req *http.Request) error) Decision {
+	if len(rewrites) == 0 || decision.Terminal() {
+		return decision
+	}
+	decision.Action = ActionModify
+	decision.Rewrite = func(req *http.Request) error {
+		for _, rewrite := range rewrites {
+			if err := rewrite(req); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return decision
+}
+
+// hookContext hands a hook a context of its own with the request deadline of that hook
+type hookContext struct {
+	echo.Context
+	replaced bool
+}
+
+// detach returns a context sharing nothing with c but the route, req replaces its request.
+// Hooks make decisions instead of responding, so the response is discarded.
+func detach(c echo.Context, req *http.Request) *hookContext {
+	dc := c.Echo().NewContext(req, discardResponse{header: http.Header{}})
+	dc.SetPath(c.Path())
+	dc.SetParamNames(c.ParamNames()...)
+	dc.SetParamValues(c.ParamValues()...)
+	return &hookContext{Context: dc}
+}
+
+func (hc *hookContext) SetRequest(r *http.Request) {
+	hc.Context.SetRequest(r)
+	hc.replaced = true
+}
+
+// discardResponse is the response writer of detached contexts
+type discardResponse struct {
+	header http.Header
+}
+
+func (d discardResponse) Header() http.Header {
+	return d.header
+}
+
+func (d discardResponse) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (d discardResponse) WriteHeader(int) {}
+
+// valuesContext has the deadline and cancellation of Context and the values of values
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (vc valuesContext) Value(key any) any {
+	return vc.values.Value(key)
+}
+
+// NewChain creates an empty chain, it allows every request until hooks are added
+func NewChain(logger zerolog.Logger) *Chain {
+	return &Chain{
+		logger: logger,
+	}
+}
@@ -0,0 +1,294 @@
+package hooks_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+	"github.com/tb0hdan/go-webfilter/pkg/proc"
+)
+
+// funcHook adapts functions to hooks.Hook and records that it ran
+type funcHook struct {
+	name   string
+	calls  *[]string
+	mu     *sync.Mutex
+	before func(c echo.Context) (hooks.Decision, error)
+	after  func(c echo.Context, rsp *http.Response) error
+}
+
+func (h *funcHook) record() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	*h.calls = append(*h.calls, h.name)
+}
+
+func (h *funcHook) BeforeRequest(c echo.Context) (hooks.Decision, error) {
+	h.record()
+	if h.before == nil {
+		return hooks.Allow(), nil
+	}
+	return h.before(c)
+}
+
+func (h *funcHook) AfterRequest(c echo.Context, rsp *http.Response) error {
+	h.record()
+	if h.after == nil {
+		return nil
+	}
+	return h.after(c, rsp)
+}
+
+// tlsFuncHook is a funcHook that also inspects TLS connections
+type tlsFuncHook struct {
+	funcHook
+	err error
+}
+
+func (h *tlsFuncHook) BeforeTLS(info *hooks.TLSInfo) error {
+	h.record()
+	return h.err
+}
+
+// ChainTestSuite defines the test suite for hooks.Chain
+type ChainTestSuite struct {
+	suite.Suite
+	chain *hooks.Chain
+	calls []string
+	mu    sync.Mutex
+}
+
+// SetupTest sets up the test suite before each test
+func (suite *ChainTestSuite) SetupTest() {
+	suite.chain = hooks.NewChain(zerolog.Nop())
+	suite.mu.Lock()
+	suite.calls = nil
+	suite.mu.Unlock()
+}
+
+func (suite *ChainTestSuite) hook(name string, before func(c echo.Context) (hooks.Decision, error)) *funcHook {
+	return &funcHook{name: name, calls: &suite.calls, mu: &suite.mu, before: before}
+}
+
+// recorded returns the names of the hooks that ran so far
+func (suite *ChainTestSuite) recorded() []string {
+	suite.mu.Lock()
+	defer suite.mu.Unlock()
+	return append([]string{}, suite.calls...)
+}
+
+func (suite *ChainTestSuite) context() echo.Context {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/path", nil)
+	return echo.New().NewContext(req, httptest.NewRecorder())
+}
+
+func decide(decision hooks.Decision) func(c echo.Context) (hooks.Decision, error) {
+	return func(c echo.Context) (hooks.Decision, error) {
+		return decision, nil
+	}
+}
+
+// TestOrdering tests that hooks run by priority and then in registration order
+func (suite *ChainTestSuite) TestOrdering() {
+	suite.chain.Add("logger", suite.hook("logger", nil), 100, 0)
+	suite.chain.Add("blocklist", suite.hook("blocklist", nil), 10, 0)
+	suite.chain.Add("policy", suite.hook("policy", nil), 0, 0)
+	suite.chain.Add("rewriter", suite.hook("rewriter", nil), 10, 0)
+
+	decision, err := suite.chain.BeforeRequest(suite.context())
+	suite.NoError(err)
+	suite.Equal(hooks.ActionAllow, decision.Action)
+	suite.Empty(decision.Hook)
+	suite.Equal([]string{"policy", "blocklist", "rewriter", "logger"}, suite.recorded())
+	suite.Equal(suite.recorded(), suite.chain.Names())
+}
+
+// TestShortCircuit tests that the first terminal or final decision stops the chain
+func (suite *ChainTestSuite) TestShortCircuit() {
+	tests := []struct {
+		name     string
+		decision hooks.Decision
+		expected hooks.Action
+	}{
+		{name: "block", decision: hooks.Block("ads", "ads"), expected: hooks.ActionBlock},
+		{name: "redirect", decision: hooks.Redirect("https://safe.example.com/"), expected: hooks.ActionRedirect},
+		{name: "respond", decision: hooks.Respond(http.StatusNoContent, nil, nil), expected: hooks.ActionRespond},
+		{name: "final allow", decision: hooks.Decision{Final: true}, expected: hooks.ActionAllow},
+	}
+
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			suite.SetupTest()
+			suite.chain.Add("first", suite.hook("first", nil), 0, 0)
+			suite.chain.Add("decider", suite.hook("decider", decide(tt.decision)), 1, 0)
+			suite.chain.Add("last", suite.hook("last", decide(hooks.Block("never", "never"))), 2, 0)
+
+			decision, err := suite.chain.BeforeRequest(suite.context())
+			suite.NoError(err)
+			suite.Equal(tt.expected, decision.Action)
+			suite.Equal("decider", decision.Hook)
+			suite.Equal([]string{"first", "decider"}, suite.recorded())
+		})
+	}
+}
+
+// TestRewrites tests that rewrites of all modifying hooks are applied in order
+func (suite *ChainTestSuite) TestRewrites() {
+	appendHeader := func(value string) func(c echo.Context) (hooks.Decision, error) {
+		return decide(hooks.Modify(func(req *http.Request) error {
+			req.Header.Add("X-Rewrite", value)
+			return nil
+		}))
+	}
+	suite.chain.Add("one", suite.hook("one", appendHeader("one")), 0, 0)
+	suite.chain.Add("allow", suite.hook("allow", nil), 1, 0)
+	suite.chain.Add("two", suite.hook("two", appendHeader("two")), 2, 0)
+
+	decision, err := suite.chain.BeforeRequest(suite.context())
+	suite.NoError(err)
+	suite.Equal(hooks.ActionModify, decision.Action)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	suite.NoError(decision.Rewrite(req))
+	suite.Equal([]string{"one", "two"}, req.Header.Values("X-Rewrite"))
+
+	// A block after a rewrite drops the rewrite
+	suite.chain.Add("block", suite.hook("block", decide(hooks.Block("no", "no"))), 3, 0)
+	decision, err = suite.chain.BeforeRequest(suite.context())
+	suite.NoError(err)
+	suite.Equal(hooks.ActionBlock, decision.Action)
+	suite.Nil(decision.Rewrite)
+}
+
+// TestErrors tests that errors, panics and timeouts fail the request and name the hook
+func (suite *ChainTestSuite) TestErrors() {
+	tests := []struct {
+		name     string
+		before   func(c echo.Context) (hooks.Decision, error)
+		expected string
+	}{
+		{
+			name: "error",
+			before: func(c echo.Context) (hooks.Decision, error) {
+				return hooks.Decision{}, errors.New("database down")
+			},
+			expected: "hook broken: database down",
+		},
+		{
+			name: "panic",
+			before: func(c echo.Context) (hooks.Decision, error) {
+				panic("nil map")
+			},
+			expected: "hook broken panicked: nil map",
+		},
+		{
+			name: "timeout",
+			before: func(c echo.Context) (hooks.Decision, error) {
+				<-c.Request().Context().Done()
+				time.Sleep(50 * time.Millisecond)
+				return hooks.Allow(), nil
+			},
+			expected: "hook broken timed out after 20ms",
+		},
+	}
+
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			suite.SetupTest()
+			suite.chain.Add("broken", suite.hook("broken", tt.before), 0, 20*time.Millisecond)
+			suite.chain.Add("next", suite.hook("next", nil), 1, 0)
+
+			_, err := suite.chain.BeforeRequest(suite.context())
+			suite.EqualError(err, tt.expected)
+			suite.Equal([]string{"broken"}, suite.recorded())
+		})
+	}
+}
+
+// TestTimedOutHookDetached tests that a hook still running after its timeout doesn't touch the request context
+func (suite *ChainTestSuite) TestTimedOutHookDetached() {
+	finished := make(chan struct{})
+	suite.chain.Add("slow", suite.hook("slow", func(c echo.Context) (hooks.Decision, error) {
+		defer close(finished)
+		<-c.Request().Context().Done()
+		c.Set("slow", true)
+		c.Request().Header.Set("X-Slow", "1")
+		c.SetRequest(c.Request().WithContext(context.Background()))
+		return hooks.Allow(), nil
+	}), 0, 10*time.Millisecond)
+
+	c := suite.context()
+	_, err := suite.chain.BeforeRequest(c)
+	suite.EqualError(err, "hook slow timed out after 10ms")
+	<-finished
+	suite.Nil(c.Get("slow"))
+	suite.Empty(c.Request().Header.Get("X-Slow"))
+}
+
+// TestRequestHandOver tests that a request replaced by a hook reaches the next hooks without its deadline
+func (suite *ChainTestSuite) TestRequestHandOver() {
+	process := &proc.ProcessInfo{PID: "42"}
+	suite.chain.Add("identify", suite.hook("identify", func(c echo.Context) (hooks.Decision, error) {
+		hooks.SetRequestInfo(c, &hooks.RequestInfo{Process: process})
+		return hooks.Allow(), nil
+	}), 0, 10*time.Millisecond)
+	var seen *proc.ProcessInfo
+	suite.chain.Add("consumer", suite.hook("consumer", func(c echo.Context) (hooks.Decision, error) {
+		seen = hooks.GetProcess(c)
+		return hooks.Allow(), nil
+	}), 1, 0)
+
+	c := suite.context()
+	_, err := suite.chain.BeforeRequest(c)
+	suite.NoError(err)
+	suite.Same(process, seen)
+	suite.Same(process, hooks.GetProcess(c))
+
+	time.Sleep(20 * time.Millisecond)
+	suite.NoError(c.Request().Context().Err())
+}
+
+// TestAfterRequest tests that every hook runs after the request and errors are collected
+func (suite *ChainTestSuite) TestAfterRequest() {
+	failing := suite.hook("failing", nil)
+	failing.after = func(c echo.Context, rsp *http.Response) error {
+		return errors.New("log full")
+	}
+	suite.chain.Add("failing", failing, 0, 0)
+	suite.chain.Add("logger", suite.hook("logger", nil), 1, 0)
+
+	err := suite.chain.AfterRequest(suite.context(), &http.Response{StatusCode: http.StatusOK})
+	suite.EqualError(err, "hook failing: log full")
+	suite.Equal([]string{"failing", "logger"}, suite.recorded())
+}
+
+// TestBeforeTLS tests that only TLS hooks see passed through connections
+func (suite *ChainTestSuite) TestBeforeTLS() {
+	suite.chain.Add("http only", suite.hook("http only", nil), 0, 0)
+	suite.chain.Add("tls", &tlsFuncHook{funcHook: *suite.hook("tls", nil)}, 1, 0)
+	suite.chain.Add("reset", &tlsFuncHook{funcHook: *suite.hook("reset", nil), err: errors.New("pinned")}, 2, 0)
+	suite.chain.Add("never", &tlsFuncHook{funcHook: *suite.hook("never", nil)}, 3, 0)
+
+	err := suite.chain.BeforeTLS(&hooks.TLSInfo{ServerName: "example.com"})
+	suite.EqualError(err, "hook reset: pinned")
+	suite.Equal([]string{"tls", "reset"}, suite.recorded())
+
+	// Passing through skips the hooks after it
+	suite.SetupTest()
+	suite.chain.Add("exception", &tlsFuncHook{funcHook: *suite.hook("exception", nil), err: hooks.ErrPassThrough}, 0, 0)
+	suite.chain.Add("reset", &tlsFuncHook{funcHook: *suite.hook("reset", nil), err: errors.New("pinned")}, 1, 0)
+	suite.NoError(suite.chain.BeforeTLS(&hooks.TLSInfo{ServerName: "example.com"}))
+	suite.Equal([]string{"exception"}, suite.recorded())
+}
+
+// TestChainTestSuite runs the test suite
+func TestChainTestSuite(t *testing.T) {
+	suite.Run(t, new(ChainTestSuite))
+}
@@ -0,0 +1,52 @@
+package hooks
+
+import (
+	"context"
+	"net"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tb0hdan/go-webfilter/pkg/proc"
+)
+
+// RequestInfo is what the filter knows about an intercepted request besides the request itself
+type RequestInfo struct {
+	// Process is the local process that made the request, nil if unknown
+	Process *proc.ProcessInfo
+	// OriginalDst is the pre-NAT destination of the connection, nil if it was not redirected
+	OriginalDst *net.TCPAddr
+	// ServerName is the SNI of intercepted HTTPS requests, empty for plain HTTP
+	ServerName string
+}
+
+type requestInfoKey struct{}
+
+// WithRequestInfo returns a copy of ctx carrying info
+func WithRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// RequestInfoFromContext returns the request information attached to ctx.
+// The upstream request is derived from the client request, so this also works with rsp.Request.Context().
+func RequestInfoFromContext(ctx context.Context) (*RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info, ok && info != nil
+}
+
+// SetRequestInfo attaches info to the request of c
+func SetRequestInfo(c echo.Context, info *RequestInfo) {
+	c.SetRequest(c.Request().WithContext(WithRequestInfo(c.Request().Context(), info)))
+}
+
+// GetRequestInfo returns the request information the server attached to c before running the hooks
+func GetRequestInfo(c echo.Context) (*RequestInfo, bool) {
+	return RequestInfoFromContext(c.Request().Context())
+}
+
+// GetProcess returns the local process that made the request of c, nil if unknown
+func GetProcess(c echo.Context) *proc.ProcessInfo {
+	info, ok := GetRequestInfo(c)
+	if !ok {
+		return nil
+	}
+	return info.Process
+}
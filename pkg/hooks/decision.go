@@ -0,0 +1,102 @@
+package hooks
+
+import (
+	"net/http"
+)
+
+// Action is what the server should do with a request
+type Action int
+
+const (
+	// ActionAllow forwards the request unchanged, it's the zero value
+	ActionAllow Action = iota
+	// ActionBlock refuses the request
+	ActionBlock
+	// ActionRedirect sends the client to another URL
+	ActionRedirect
+	// ActionRespond answers the request without contacting the destination
+	ActionRespond
+	// ActionModify forwards the request after rewriting it
+	ActionModify
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionAllow:
+		return "allow"
+	case ActionBlock:
+		return "block"
+	case ActionRedirect:
+		return "redirect"
+	case ActionRespond:
+		return "respond"
+	case ActionModify:
+		return "modify"
+	}
+	return "unknown"
+}
+
+// Decision is the outcome of BeforeRequest. The zero value allows the request.
+type Decision struct {
+	Action Action
+	// Reason and Category tell the user and the logs why a request was blocked
+	Reason   string
+	Category string
+	// Location is the redirect target
+	Location string
+	// StatusCode overrides the default status of a redirect (302), a response (200) or a block (403)
+	StatusCode int
+	// Header and Body make up the synthesized response
+	Header http.Header
+	Body   []byte
+	// Rewrite is applied to the upstream request before it is sent
+	Rewrite func(req *http.Request) error
+	// Final stops a Chain on an allow or modify decision, e.g. for allowlist entries
+	Final bool
+	// Hook is the name of the hook that made the decision, set by Chain
+	Hook string
+}
+
+// Terminal reports whether the decision ends the request without forwarding it
+func (d Decision) Terminal() bool {
+	return d.Action == ActionBlock || d.Action == ActionRedirect || d.Action == ActionRespond
+}
+
+// Status returns the status code the client gets for a terminal decision
+func (d Decision) Status() int {
+	if d.StatusCode != 0 {
+		return d.StatusCode
+	}
+	switch d.Action {
+	case ActionBlock:
+		return http.StatusForbidden
+	case ActionRedirect:
+		return http.StatusFound
+	}
+	return http.StatusOK
+}
+
+// Allow forwards the request
+func Allow() Decision {
+	return Decision{Action: ActionAllow}
+}
+
+// Block refuses the request, category is a short machine readable tag such as "ads" or "gambling"
+func Block(reason, category string) Decision {
+	return Decision{Action: ActionBlock, Reason: reason, Category: category}
+}
+
+// Redirect sends the client to location with a 302
+func Redirect(location string) Decision {
+	return Decision{Action: ActionRedirect, Location: location}
+}
+
+// Respond answers the request with the given response
+func Respond(statusCode int, header http.Header, body []byte) Decision {
+	return Decision{Action: ActionRespond, StatusCode: statusCode, Header: header, Body: body}
+}
+
+// Modify forwards the request after rewrite has been applied to it
+func Modify(rewrite func(req *http.Request) error) Decision {
+	return Decision{Action: ActionModify, Rewrite: rewrite}
+}
@@ -14,8 +14,8 @@ func (e *EmptyHookImpl) AfterRequest(c echo.Context, rsp *http.Response) error {
 	return nil
 }
 
-func (e *EmptyHookImpl) BeforeRequest(c echo.Context) error {
-	return nil
+func (e *EmptyHookImpl) BeforeRequest(c echo.Context) (Decision, error) {
+	return Allow(), nil
 }
 
 type HookImpl struct {
@@ -25,8 +25,8 @@ func (h *HookImpl) AfterRequest(c echo.Context, rsp *http.Response) error {
 	return nil
 }
 
-func (h *HookImpl) BeforeRequest(c echo.Context) error {
-	return nil
+func (h *HookImpl) BeforeRequest(c echo.Context) (Decision, error) {
+	return Allow(), nil
 }
 
 func New(logger zerolog.Logger) Hook {
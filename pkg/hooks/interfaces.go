@@ -7,6 +7,15 @@ import (
 )
 
 type Hook interface {
-	BeforeRequest(c echo.Context) error
+	// BeforeRequest decides what happens to a request before it's forwarded.
+	// Errors are reserved for failures of the hook itself and are answered with a 500.
+	BeforeRequest(c echo.Context) (Decision, error)
 	AfterRequest(c echo.Context, rsp *http.Response) error
 }
+
+// TLSHook is implemented by hooks that want to inspect TLS connections which are
+// passed through without decryption. Returning an error resets the connection,
+// except for ErrPassThrough which lets it through.
+type TLSHook interface {
+	BeforeTLS(info *TLSInfo) error
+}
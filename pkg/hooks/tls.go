@@ -0,0 +1,26 @@
+package hooks
+
+import (
+	"errors"
+	"net"
+
+	"github.com/tb0hdan/go-webfilter/pkg/proc"
+)
+
+// ErrPassThrough is returned by BeforeTLS to pass the connection through without asking the hooks
+// after it, the counterpart of a final allow decision
+var ErrPassThrough = errors.New("passed through")
+
+// TLSInfo is what is known about a TLS connection before any decryption happens
+type TLSInfo struct {
+	// ServerName is the SNI sent by the client, it may be empty
+	ServerName string
+	// ALPN lists the application protocols offered by the client
+	ALPN []string
+	// ClientAddr is the address of the local client
+	ClientAddr net.Addr
+	// OriginalDst is the pre-NAT destination of the connection
+	OriginalDst *net.TCPAddr
+	// Process is the local process that made the connection, nil if unknown
+	Process *proc.ProcessInfo
+}
@@ -0,0 +1,92 @@
+package override
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tb0hdan/go-webfilter/pkg/schedule"
+)
+
+// PIN is a fixed admin code, an empty PIN never verifies
+type PIN string
+
+func (p PIN) Verify(code string) bool {
+	return p != "" && subtle.ConstantTimeCompare([]byte(p), []byte(code)) == 1
+}
+
+// TOTP verifies RFC 6238 codes as shown by authenticator apps: HMAC-SHA1, 30 second steps, 6 digits
+type TOTP struct {
+	secret []byte
+	clock  schedule.Clock
+	mu     sync.Mutex
+	// used is the last step a code was accepted for, codes can't be replayed
+	used int64
+}
+
+const (
+	totpStep   = 30 * time.Second
+	totpDigits = 6
+	// totpSkew accepts codes of the neighbouring steps to allow for clock drift
+	totpSkew = 1
+)
+
+// Code returns the code valid at the given time
+func (t *TOTP) Code(at time.Time) string {
+	return t.code(at.Unix() / int64(totpStep/time.Second))
+}
+
+func (t *TOTP) code(step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, t.secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
+
+func (t *TOTP) Verify(code string) bool {
+	step := t.clock.Now().Unix() / int64(totpStep/time.Second)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		if s > t.used && subtle.ConstantTimeCompare([]byte(t.code(s)), []byte(code)) == 1 {
+			t.used = s
+			return true
+		}
+	}
+	return false
+}
+
+// NewTOTP creates a TOTP verifier from a base32 secret as used in otpauth:// URIs
+func NewTOTP(secret string, clock schedule.Clock) (*TOTP, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TOTP secret: %w", err)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("empty TOTP secret")
+	}
+	return &TOTP{secret: key, clock: clock}, nil
+}
+
+// Any verifies codes accepted by any of its authenticators
+type Any []Authenticator
+
+func (a Any) Verify(code string) bool {
+	for _, auth := range a {
+		if auth.Verify(code) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package override
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+	"github.com/tb0hdan/go-webfilter/pkg/proc"
+	"github.com/tb0hdan/go-webfilter/pkg/utils"
+)
+
+const (
+	// Path is where the unlock form of the block page posts to, on the blocked host itself
+	Path = "/.well-known/go-webfilter/unlock"
+	// DefaultDuration is how long an override lasts unless the form asks for less or more
+	DefaultDuration = 15 * time.Minute
+	// maxFailures invalid codes in a row lock the form for lockout
+	maxFailures = 5
+	lockout     = time.Minute
+)
+
+// Hook allows hosts with an active override and grants overrides posted to Path.
+// It must run before the hooks that block, overrides are final allow decisions.
+type Hook struct {
+	logger      zerolog.Logger
+	store       *Store
+	auth        Authenticator
+	maxDuration time.Duration
+	mu          sync.Mutex
+	failures    int
+	lockedUntil time.Time
+}
+
+func (h *Hook) BeforeRequest(c echo.Context) (hooks.Decision, error) {
+	host := utils.HostOnly(c.Request().Host)
+	if c.Request().URL.Path == Path {
+		return h.unlock(c, host), nil
+	}
+	if o := h.store.Match(host, hooks.GetProcess(c)); o != nil {
+		return hooks.Decision{Action: hooks.ActionAllow, Final: true, Reason: "override " + o.ID}, nil
+	}
+	return hooks.Allow(), nil
+}
+
+func (h *Hook) AfterRequest(c echo.Context, rsp *http.Response) error {
+	return nil
+}
+
+// BeforeTLS passes through connections to hosts with an active override, so blocking hooks don't reset them
+func (h *Hook) BeforeTLS(info *hooks.TLSInfo) error {
+	if o := h.store.Match(utils.HostOnly(info.ServerName), info.Process); o != nil {
+		h.logger.Debug().Msgf("Passing through %s with override %s", info.ServerName, o.ID)
+		return hooks.ErrPassThrough
+	}
+	return nil
+}
+
+// unlock checks the code posted by the block page and grants an override for host
+func (h *Hook) unlock(c echo.Context, host string) hooks.Decision {
+	if c.Request().Method != http.MethodPost {
+		return hooks.Respond(http.StatusMethodNotAllowed, http.Header{"Allow": {http.MethodPost}}, nil)
+	}
+	process := hooks.GetProcess(c)
+	if !h.verify(c.FormValue("code")) {
+		h.logger.Warn().Msgf("Invalid unlock code for %s from %s", host, processName(process))
+		decision := hooks.Block("Invalid or expired unlock code", "override")
+		if h.locked() {
+			decision.Reason = "Too many invalid unlock codes, try again later"
+			decision.StatusCode = http.StatusTooManyRequests
+		}
+		return decision
+	}
+	o := &Override{Host: host, GrantedTo: processName(process), Expires: h.store.clock.Now().Add(h.duration(c.FormValue("minutes")))}
+	switch c.FormValue("scope") {
+	case "process", "uid":
+		if process == nil {
+			return hooks.Block("The application could not be identified, unlock the site for everyone instead", "override")
+		}
+		if c.FormValue("scope") == "process" {
+			o.Binary = process.Binary
+		} else {
+			o.UID = process.UID
+		}
+	}
+	h.store.Grant(o)
+	return hooks.Decision{Action: hooks.ActionRedirect, Location: back(c.FormValue("url"), host), StatusCode: http.StatusSeeOther}
+}
+
+// verify checks code unless the form is locked after too many failures
+func (h *Hook) verify(code string) bool {
+	now := h.store.clock.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now.Before(h.lockedUntil) {
+		return false
+	}
+	if h.auth.Verify(strings.TrimSpace(code)) {
+		h.failures = 0
+		return true
+	}
+	h.failures++
+	if h.failures >= maxFailures {
+		h.failures = 0
+		h.lockedUntil = now.Add(lockout)
+	}
+	return false
+}
+
+func (h *Hook) locked() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.store.clock.Now().Before(h.lockedUntil)
+}
+
+// duration parses the minutes asked for, capped by the maximum duration
+func (h *Hook) duration(minutes string) time.Duration {
+	duration := DefaultDuration
+	if m, err := strconv.Atoi(minutes); err == nil && m > 0 {
+		duration = time.Duration(m) * time.Minute
+	}
+	return min(duration, h.maxDuration)
+}
+
+// back returns where to send the client after unlocking, only URLs on the unlocked host are followed
+func back(target, host string) string {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || utils.HostOnly(u.Host) != host || u.Path == Path {
+		return "/"
+	}
+	return u.String()
+}
+
+// processName describes the process that entered a code
+func processName(process *proc.ProcessInfo) string {
+	if process == nil {
+		return "unknown process"
+	}
+	return fmt.Sprintf("%s (PID %s, UID %s)", process.Binary, process.PID, process.UID)
+}
+
+// New creates a hook granting overrides of at most maxDuration to whoever knows a code accepted by auth
+func New(logger zerolog.Logger, store *Store, auth Authenticator, maxDuration time.Duration) *Hook {
+	if maxDuration <= 0 {
+		maxDuration = DefaultDuration
+	}
+	return &Hook{logger: logger, store: store, auth: auth, maxDuration: maxDuration}
+}
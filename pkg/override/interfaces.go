@@ -0,0 +1,7 @@
+package override
+
+// Authenticator checks the code entered in the unlock form
+type Authenticator interface {
+	// Verify reports whether code grants an override, it may consume one-time codes
+	Verify(code string) bool
+}
@@ -0,0 +1,266 @@
+package override_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+	"github.com/tb0hdan/go-webfilter/pkg/override"
+	"github.com/tb0hdan/go-webfilter/pkg/proc"
+)
+
+// fakeClock is a clock tests move by hand
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+var (
+	alice   = &proc.ProcessInfo{PID: "100", Binary: "/usr/lib/firefox/firefox", UID: "1000"}
+	aliceSh = &proc.ProcessInfo{PID: "101", Binary: "/usr/bin/curl", UID: "1000"}
+	bob     = &proc.ProcessInfo{PID: "200", Binary: "/usr/lib/firefox/firefox", UID: "1001"}
+)
+
+// OverrideTestSuite defines the test suite for overrides
+type OverrideTestSuite struct {
+	suite.Suite
+	clock *fakeClock
+	store *override.Store
+	hook  *override.Hook
+}
+
+// SetupTest creates a hook accepting PIN 4321 for at most an hour
+func (suite *OverrideTestSuite) SetupTest() {
+	suite.clock = &fakeClock{now: time.Date(2026, 10, 12, 10, 0, 0, 0, time.UTC)}
+	suite.store = override.NewStore(zerolog.Nop(), suite.clock)
+	suite.hook = override.New(zerolog.Nop(), suite.store, override.PIN("4321"), time.Hour)
+}
+
+// request runs the hook for a request from process
+func (suite *OverrideTestSuite) request(method, target string, form url.Values, process *proc.ProcessInfo) hooks.Decision {
+	req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	if form != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	}
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	if process != nil {
+		hooks.SetRequestInfo(c, &hooks.RequestInfo{Process: process})
+	}
+	decision, err := suite.hook.BeforeRequest(c)
+	suite.Require().NoError(err)
+	return decision
+}
+
+func (suite *OverrideTestSuite) unlock(form url.Values, process *proc.ProcessInfo) hooks.Decision {
+	return suite.request(http.MethodPost, "https://blocked.example.com"+override.Path, form, process)
+}
+
+func (suite *OverrideTestSuite) allowed(process *proc.ProcessInfo) bool {
+	decision := suite.request(http.MethodGet, "https://blocked.example.com/page", nil, process)
+	return decision.Action == hooks.ActionAllow && decision.Final
+}
+
+// TestUnlock tests granting an override for everyone until it expires
+func (suite *OverrideTestSuite) TestUnlock() {
+	suite.False(suite.allowed(alice))
+
+	decision := suite.unlock(url.Values{"code": {" 4321 "}, "url": {"https://blocked.example.com/page?x=1"}, "minutes": {"30"}}, alice)
+	suite.Equal(hooks.ActionRedirect, decision.Action)
+	suite.Equal(http.StatusSeeOther, decision.StatusCode)
+	suite.Equal("https://blocked.example.com/page?x=1", decision.Location)
+
+	suite.True(suite.allowed(alice))
+	suite.True(suite.allowed(bob))
+	suite.True(suite.allowed(nil))
+	suite.Equal(hooks.ActionAllow, suite.request(http.MethodGet, "https://other.example.com/", nil, alice).Action)
+	suite.False(suite.request(http.MethodGet, "https://other.example.com/", nil, alice).Final)
+
+	overrides := suite.store.List()
+	suite.Require().Len(overrides, 1)
+	suite.Equal("blocked.example.com", overrides[0].Host)
+	suite.Equal("/usr/lib/firefox/firefox (PID 100, UID 1000)", overrides[0].GrantedTo)
+	suite.Equal(suite.clock.Now().Add(30*time.Minute), overrides[0].Expires)
+
+	suite.clock.Advance(30 * time.Minute)
+	suite.False(suite.allowed(alice))
+	suite.Empty(suite.store.List())
+}
+
+// TestScope tests overrides limited to the user or the application entering the code
+func (suite *OverrideTestSuite) TestScope() {
+	suite.unlock(url.Values{"code": {"4321"}, "scope": {"uid"}}, alice)
+	suite.True(suite.allowed(aliceSh))
+	suite.False(suite.allowed(bob))
+	suite.False(suite.allowed(nil))
+
+	suite.SetupTest()
+	suite.unlock(url.Values{"code": {"4321"}, "scope": {"process"}}, alice)
+	suite.True(suite.allowed(bob))
+	suite.False(suite.allowed(aliceSh))
+
+	suite.SetupTest()
+	decision := suite.unlock(url.Values{"code": {"4321"}, "scope": {"process"}}, nil)
+	suite.Equal(hooks.ActionBlock, decision.Action)
+	suite.Empty(suite.store.List())
+}
+
+// TestPassthrough tests that overrides let passed through connections of the same scope through
+func (suite *OverrideTestSuite) TestPassthrough() {
+	suite.NoError(suite.hook.BeforeTLS(&hooks.TLSInfo{ServerName: "blocked.example.com", Process: alice}))
+
+	suite.unlock(url.Values{"code": {"4321"}, "scope": {"uid"}}, alice)
+	suite.ErrorIs(suite.hook.BeforeTLS(&hooks.TLSInfo{ServerName: "Blocked.Example.COM.", Process: aliceSh}), hooks.ErrPassThrough)
+	suite.NoError(suite.hook.BeforeTLS(&hooks.TLSInfo{ServerName: "blocked.example.com", Process: bob}))
+	suite.NoError(suite.hook.BeforeTLS(&hooks.TLSInfo{ServerName: "other.example.com", Process: alice}))
+
+	suite.clock.Advance(time.Hour)
+	suite.NoError(suite.hook.BeforeTLS(&hooks.TLSInfo{ServerName: "blocked.example.com", Process: alice}))
+}
+
+// TestDuration tests the default and the maximum duration
+func (suite *OverrideTestSuite) TestDuration() {
+	tests := []struct {
+		minutes  string
+		expected time.Duration
+	}{
+		{minutes: "", expected: override.DefaultDuration},
+		{minutes: "-5", expected: override.DefaultDuration},
+		{minutes: "5", expected: 5 * time.Minute},
+		{minutes: "600", expected: time.Hour},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.minutes, func() {
+			suite.SetupTest()
+			suite.unlock(url.Values{"code": {"4321"}, "minutes": {tt.minutes}}, alice)
+			overrides := suite.store.List()
+			suite.Require().Len(overrides, 1)
+			suite.Equal(tt.expected, overrides[0].Expires.Sub(overrides[0].Created))
+		})
+	}
+}
+
+// TestInvalidCode tests rejected codes and the lockout after too many of them
+func (suite *OverrideTestSuite) TestInvalidCode() {
+	for range 4 {
+		decision := suite.unlock(url.Values{"code": {"0000"}}, alice)
+		suite.Equal(hooks.ActionBlock, decision.Action)
+		suite.Equal("Invalid or expired unlock code", decision.Reason)
+	}
+	decision := suite.unlock(url.Values{"code": {"0000"}}, alice)
+	suite.Equal(http.StatusTooManyRequests, decision.Status())
+	// Even the right code is refused while locked
+	decision = suite.unlock(url.Values{"code": {"4321"}}, alice)
+	suite.Equal(http.StatusTooManyRequests, decision.Status())
+	suite.Empty(suite.store.List())
+
+	suite.clock.Advance(time.Minute)
+	decision = suite.unlock(url.Values{"code": {"4321"}}, alice)
+	suite.Equal(hooks.ActionRedirect, decision.Action)
+
+	decision = suite.request(http.MethodGet, "https://blocked.example.com"+override.Path, nil, alice)
+	suite.Equal(http.StatusMethodNotAllowed, decision.Status())
+}
+
+// TestRedirectBack tests that only URLs on the unlocked host are followed
+func (suite *OverrideTestSuite) TestRedirectBack() {
+	tests := map[string]string{
+		"https://blocked.example.com/a?b=c":           "https://blocked.example.com/a?b=c",
+		"http://BLOCKED.example.com:8080/":            "http://BLOCKED.example.com:8080/",
+		"https://evil.example.com/":                   "/",
+		"javascript:alert(1)":                         "/",
+		"//evil.example.com/":                         "/",
+		"https://blocked.example.com" + override.Path: "/",
+	}
+	for target, expected := range tests {
+		suite.Run(target, func() {
+			decision := suite.unlock(url.Values{"code": {"4321"}, "url": {target}}, alice)
+			suite.Equal(expected, decision.Location)
+		})
+	}
+}
+
+// TestAdminAPI tests listing and revoking overrides
+func (suite *OverrideTestSuite) TestAdminAPI() {
+	e := echo.New()
+	suite.store.RegisterRoutes(e.Group("/api"))
+	suite.unlock(url.Values{"code": {"4321"}}, alice)
+	suite.True(suite.allowed(alice))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/overrides", nil))
+	suite.Equal(http.StatusOK, rec.Code)
+	var overrides []override.Override
+	suite.Require().NoError(json.Unmarshal(rec.Body.Bytes(), &overrides))
+	suite.Require().Len(overrides, 1)
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/overrides/"+overrides[0].ID, nil))
+	suite.Equal(http.StatusNoContent, rec.Code)
+	suite.False(suite.allowed(alice))
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/overrides/"+overrides[0].ID, nil))
+	suite.Equal(http.StatusNotFound, rec.Code)
+}
+
+// TestTOTP tests codes against the RFC 6238 test vectors and replays
+func (suite *OverrideTestSuite) TestTOTP() {
+	// base32 of the RFC secret "12345678901234567890"
+	totp, err := override.NewTOTP("gezd gnbv gy3t qojq gezd gnbv gy3t qojq", suite.clock)
+	suite.Require().NoError(err)
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range vectors {
+		suite.Equal(expected, totp.Code(time.Unix(unix, 0)), unix)
+	}
+
+	now := suite.clock.Now()
+	suite.False(totp.Verify(totp.Code(now.Add(-time.Minute))))
+	suite.True(totp.Verify(totp.Code(now.Add(-30 * time.Second))))
+	suite.True(totp.Verify(totp.Code(now)))
+	// A code is used up once accepted, so are the ones before it
+	suite.False(totp.Verify(totp.Code(now)))
+	suite.False(totp.Verify(totp.Code(now.Add(-30 * time.Second))))
+	suite.True(totp.Verify(totp.Code(now.Add(30 * time.Second))))
+
+	_, err = override.NewTOTP("not base32!", suite.clock)
+	suite.ErrorContains(err, "invalid TOTP secret")
+	_, err = override.NewTOTP("", suite.clock)
+	suite.EqualError(err, "empty TOTP secret")
+
+	suite.False(override.PIN("").Verify(""))
+	auth := override.Any{override.PIN("1234"), totp}
+	suite.True(auth.Verify("1234"))
+	suite.False(auth.Verify("4321"))
+}
+
+// TestOverrideTestSuite runs the test suite
+func TestOverrideTestSuite(t *testing.T) {
+	suite.Run(t, new(OverrideTestSuite))
+}
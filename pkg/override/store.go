@@ -0,0 +1,125 @@
+package override
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/tb0hdan/go-webfilter/pkg/proc"
+	"github.com/tb0hdan/go-webfilter/pkg/schedule"
+	"github.com/tb0hdan/go-webfilter/pkg/utils"
+)
+
+// Override allows a blocked host until it expires
+type Override struct {
+	ID   string `json:"id"`
+	Host string `json:"host"`
+	// UID and Binary scope the override to a user or an application, empty means anyone
+	UID    string `json:"uid,omitempty"`
+	Binary string `json:"binary,omitempty"`
+	// GrantedTo is the process that entered the code
+	GrantedTo string    `json:"granted_to,omitempty"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+// matches reports whether o allows host for process
+func (o *Override) matches(host string, process *proc.ProcessInfo, now time.Time) bool {
+	if o.Host != host || !now.Before(o.Expires) {
+		return false
+	}
+	if o.UID == "" && o.Binary == "" {
+		return true
+	}
+	if process == nil {
+		return false
+	}
+	return (o.UID == "" || o.UID == process.UID) && (o.Binary == "" || o.Binary == process.Binary)
+}
+
+// Store holds the active overrides in memory
+type Store struct {
+	logger    zerolog.Logger
+	clock     schedule.Clock
+	mu        sync.Mutex
+	overrides map[string]*Override
+}
+
+// Grant activates o, filling in its ID and creation time
+func (s *Store) Grant(o *Override) *Override {
+	o.ID = utils.NewID()
+	o.Created = s.clock.Now()
+	s.mu.Lock()
+	s.overrides[o.ID] = o
+	s.mu.Unlock()
+	s.logger.Info().Msgf("Override %s granted for %s (uid %q, binary %q) to %s until %s",
+		o.ID, o.Host, o.UID, o.Binary, o.GrantedTo, o.Expires.Format(time.RFC3339))
+	return o
+}
+
+// Match returns an active override allowing host for process, nil if there is none
+func (s *Store) Match(host string, process *proc.ProcessInfo) *Override {
+	now := s.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, o := range s.overrides {
+		if !now.Before(o.Expires) {
+			delete(s.overrides, id)
+			continue
+		}
+		if o.matches(host, process, now) {
+			return o
+		}
+	}
+	return nil
+}
+
+// List returns the active overrides, the earliest expiring first
+func (s *Store) List() []Override {
+	now := s.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	overrides := make([]Override, 0, len(s.overrides))
+	for _, o := range s.overrides {
+		if now.Before(o.Expires) {
+			overrides = append(overrides, *o)
+		}
+	}
+	slices.SortFunc(overrides, func(a, b Override) int {
+		return a.Expires.Compare(b.Expires)
+	})
+	return overrides
+}
+
+// Revoke ends an override early, it reports whether the override existed
+func (s *Store) Revoke(id string) bool {
+	s.mu.Lock()
+	o, ok := s.overrides[id]
+	delete(s.overrides, id)
+	s.mu.Unlock()
+	if ok {
+		s.logger.Info().Msgf("Override %s for %s revoked", id, o.Host)
+	}
+	return ok
+}
+
+// RegisterRoutes adds the admin API listing (GET /overrides) and revoking (DELETE /overrides/:id) overrides
+func (s *Store) RegisterRoutes(g *echo.Group) {
+	g.GET("/overrides", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, s.List())
+	})
+	g.DELETE("/overrides/:id", func(c echo.Context) error {
+		if !s.Revoke(c.Param("id")) {
+			return echo.NewHTTPError(http.StatusNotFound, "override not found")
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+}
+
+// NewStore creates an empty store
+func NewStore(logger zerolog.Logger, clock schedule.Clock) *Store {
+	return &Store{logger: logger, clock: clock, overrides: make(map[string]*Override)}
+}
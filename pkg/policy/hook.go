@@ -0,0 +1,103 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+	"github.com/tb0hdan/go-webfilter/pkg/schedule"
+	"github.com/tb0hdan/go-webfilter/pkg/utils"
+)
+
+// Hook applies a policy to every request
+type Hook struct {
+	logger zerolog.Logger
+	policy atomic.Pointer[Policy]
+	clock  schedule.Clock
+	usage  *schedule.Tracker
+}
+
+// Policy returns the active policy
+func (h *Hook) Policy() *Policy {
+	return h.policy.Load()
+}
+
+// SetPolicy replaces the active policy, requests in flight finish with the old one
+func (h *Hook) SetPolicy(p *Policy) {
+	h.policy.Store(p)
+}
+
+// SetClock replaces the clock schedules are checked with, the system clock by default
+func (h *Hook) SetClock(clock schedule.Clock) {
+	h.clock = clock
+}
+
+// SetUsage sets the tracker counting quotas, rules with a quota never match without one.
+// It is kept when the policy is replaced.
+func (h *Hook) SetUsage(usage *schedule.Tracker) {
+	h.usage = usage
+}
+
+func (h *Hook) BeforeRequest(c echo.Context) (hooks.Decision, error) {
+	in := &Input{
+		Method:  c.Request().Method,
+		Host:    utils.HostOnly(c.Request().Host),
+		URL:     requestURL(c.Request()),
+		Process: hooks.GetProcess(c),
+		Time:    h.clock.Now(),
+		Usage:   h.usage,
+	}
+	rule, decision := h.Policy().Evaluate(in)
+	if rule != nil {
+		h.logger.Debug().Msgf("Policy rule %s matched %s %s: %s", rule.Name, in.Method, in.URL, rule.Action)
+	}
+	return decision, nil
+}
+
+func (h *Hook) AfterRequest(c echo.Context, rsp *http.Response) error {
+	return nil
+}
+
+// BeforeTLS applies the policy to passed through connections. Only the server name, the process and the time
+// are known: the host is the SNI, the URL is https://<SNI>/ and there is no method, so rules with methods never
+// match. Blocks and redirects reset the connection, allow rules pass it through and quotas count it.
+func (h *Hook) BeforeTLS(info *hooks.TLSInfo) error {
+	in := &Input{
+		Host:    utils.HostOnly(info.ServerName),
+		URL:     "https://" + info.ServerName + "/",
+		Process: info.Process,
+		Time:    h.clock.Now(),
+		Usage:   h.usage,
+	}
+	rule, decision := h.Policy().Evaluate(in)
+	switch {
+	case decision.Terminal() && rule != nil:
+		return fmt.Errorf("%s by policy rule %s", decision.Action, rule.Name)
+	case decision.Terminal():
+		return errors.New("blocked by default policy")
+	case decision.Final:
+		h.logger.Debug().Msgf("Policy rule %s passed through %s", rule.Name, info.ServerName)
+		return hooks.ErrPassThrough
+	}
+	return nil
+}
+
+// requestURL is the full URL the client asked for
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.RequestURI
+}
+
+// New creates a hook applying p
+func New(logger zerolog.Logger, p *Policy) *Hook {
+	h := &Hook{logger: logger, clock: schedule.SystemClock{}}
+	h.SetPolicy(p)
+	return h
+}
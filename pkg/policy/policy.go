@@ -0,0 +1,291 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+	"github.com/tb0hdan/go-webfilter/pkg/proc"
+	"github.com/tb0hdan/go-webfilter/pkg/schedule"
+	"gopkg.in/yaml.v3"
+)
+
+// Actions a rule can take
+const (
+	ActionAllow    = "allow"
+	ActionBlock    = "block"
+	ActionRedirect = "redirect"
+)
+
+// Rule matches requests on every condition it sets, an empty list or pattern matches anything.
+// Lists match if any of their entries does.
+type Rule struct {
+	Name string `yaml:"name" json:"name"`
+	// Hosts are globs (path.Match syntax) for the requested host without port, e.g. *.example.com
+	Hosts []string `yaml:"hosts" json:"hosts"`
+	// URL is a regular expression for the full URL, e.g. https://example.com/path?query
+	URL     string   `yaml:"url" json:"url"`
+	Methods []string `yaml:"methods" json:"methods"`
+	// Binaries are globs for the executable of the process making the request
+	Binaries []string `yaml:"binaries" json:"binaries"`
+	// Cmdline is a regular expression for the command line, arguments are separated by spaces
+	Cmdline string `yaml:"cmdline" json:"cmdline"`
+	UIDs    []int  `yaml:"uids" json:"uids"`
+	// Schedule names a schedule the rule is limited to
+	Schedule string `yaml:"schedule" json:"schedule"`
+	// Quota names a quota, the rule only matches once the quota is used up for the day
+	Quota string `yaml:"quota" json:"quota"`
+
+	Action   string `yaml:"action" json:"action"`
+	Reason   string `yaml:"reason" json:"reason"`
+	Category string `yaml:"category" json:"category"`
+	// Redirect is where the redirect action sends the client
+	Redirect string `yaml:"redirect" json:"redirect"`
+
+	url      *regexp.Regexp
+	cmdline  *regexp.Regexp
+	uids     []string
+	schedule schedule.Schedule
+	quota    *schedule.Quota
+}
+
+// Policy is an ordered list of rules, the first matching rule decides
+type Policy struct {
+	// Default is the action when no rule matches, allow lets the other hooks decide
+	Default string `yaml:"default" json:"default"`
+	// Schedules and Quotas are referenced by name from rules
+	Schedules map[string]schedule.Schedule `yaml:"schedules" json:"schedules"`
+	Quotas    map[string]*schedule.Quota   `yaml:"quotas" json:"quotas"`
+	Rules     []*Rule                      `yaml:"rules" json:"rules"`
+}
+
+// Input is what rules are matched against
+type Input struct {
+	Method string
+	// Host is the requested host without port
+	Host string
+	URL  string
+	// Process is nil if it could not be identified, process conditions never match then
+	Process *proc.ProcessInfo
+	// Time is checked against schedules
+	Time time.Time
+	// Usage counts quotas, rules with a quota never match without it
+	Usage *schedule.Tracker
+}
+
+// Evaluate returns the first rule matching in and its decision, or nil and the default decision.
+// Allow rules make final decisions, so other hooks of a chain can't block what the policy allows.
+func (p *Policy) Evaluate(in *Input) (*Rule, hooks.Decision) {
+	for _, rule := range p.Rules {
+		if rule.matches(in) {
+			return rule, rule.decision()
+		}
+	}
+	if p.Default == ActionBlock {
+		return nil, hooks.Block("Blocked by default policy", "")
+	}
+	return nil, hooks.Allow()
+}
+
+func (r *Rule) matches(in *Input) bool {
+	if r.schedule != nil && !r.schedule.Active(in.Time) {
+		return false
+	}
+	if len(r.Hosts) > 0 && !anyMatch(r.Hosts, in.Host) {
+		return false
+	}
+	if r.url != nil && !r.url.MatchString(in.URL) {
+		return false
+	}
+	if len(r.Methods) > 0 && !containsFold(r.Methods, in.Method) {
+		return false
+	}
+	if len(r.Binaries) == 0 && r.cmdline == nil && len(r.uids) == 0 && r.quota == nil {
+		return true
+	}
+	// Process conditions need a process
+	if in.Process == nil {
+		return false
+	}
+	if len(r.Binaries) > 0 && !anyMatch(r.Binaries, in.Process.Binary) {
+		return false
+	}
+	if r.cmdline != nil && !r.cmdline.MatchString(in.Process.Cmdline) {
+		return false
+	}
+	if len(r.uids) > 0 && !containsFold(r.uids, in.Process.UID) {
+		return false
+	}
+	// Usage is only counted for requests matching everything else
+	if r.quota != nil {
+		key, ok := r.quota.Key(in.Process)
+		return ok && in.Usage != nil && in.Usage.Use(r.Quota, r.quota, key)
+	}
+	return true
+}
+
+func (r *Rule) decision() hooks.Decision {
+	switch r.Action {
+	case ActionBlock:
+		reason := r.Reason
+		if reason == "" {
+			reason = fmt.Sprintf("Blocked by policy rule %q", r.Name)
+		}
+		return hooks.Block(reason, r.Category)
+	case ActionRedirect:
+		return hooks.Redirect(r.Redirect)
+	}
+	return hooks.Decision{Action: hooks.ActionAllow, Final: true}
+}
+
+// compile validates the rule and prepares its patterns
+func (r *Rule) compile(p *Policy) error {
+	switch r.Action {
+	case ActionAllow, ActionBlock:
+	case ActionRedirect:
+		if r.Redirect == "" {
+			return errors.New("redirect rule without redirect target")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	for i, host := range r.Hosts {
+		r.Hosts[i] = strings.ToLower(host)
+	}
+	for _, pattern := range append(append([]string{}, r.Hosts...), r.Binaries...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+	}
+	var err error
+	if r.URL != "" {
+		if r.url, err = regexp.Compile(r.URL); err != nil {
+			return fmt.Errorf("invalid url pattern: %w", err)
+		}
+	}
+	if r.Cmdline != "" {
+		if r.cmdline, err = regexp.Compile(r.Cmdline); err != nil {
+			return fmt.Errorf("invalid cmdline pattern: %w", err)
+		}
+	}
+	r.uids = nil
+	for _, uid := range r.UIDs {
+		r.uids = append(r.uids, strconv.Itoa(uid))
+	}
+	r.schedule, r.quota = nil, nil
+	if r.Schedule != "" {
+		var ok bool
+		if r.schedule, ok = p.Schedules[r.Schedule]; !ok {
+			return fmt.Errorf("unknown schedule %q", r.Schedule)
+		}
+	}
+	if r.Quota != "" {
+		var ok bool
+		if r.quota, ok = p.Quotas[r.Quota]; !ok {
+			return fmt.Errorf("unknown quota %q", r.Quota)
+		}
+	}
+	return nil
+}
+
+// validate checks and compiles every rule
+func (p *Policy) validate() error {
+	switch p.Default {
+	case "":
+		p.Default = ActionAllow
+	case ActionAllow, ActionBlock:
+	default:
+		return fmt.Errorf("unknown default action %q", p.Default)
+	}
+	for name, s := range p.Schedules {
+		if err := s.Compile(); err != nil {
+			return fmt.Errorf("schedule %s: %w", name, err)
+		}
+	}
+	for name, q := range p.Quotas {
+		if q == nil {
+			return fmt.Errorf("quota %s is empty", name)
+		}
+		if err := q.Compile(); err != nil {
+			return fmt.Errorf("quota %s: %w", name, err)
+		}
+	}
+	for i, rule := range p.Rules {
+		if rule == nil {
+			return fmt.Errorf("rule %d is empty", i+1)
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if err := rule.compile(p); err != nil {
+			return fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+// Parse parses and validates a policy. JSON is used if format is "json", YAML otherwise.
+// Unknown fields are errors so typos don't silently disable a condition.
+func Parse(data []byte, format string) (*Policy, error) {
+	p := &Policy{}
+	if format == "json" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(p); err != nil {
+			return nil, fmt.Errorf("error parsing policy: %w", err)
+		}
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		// An empty document is an empty policy
+		if err := decoder.Decode(p); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("error parsing policy: %w", err)
+		}
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	return p, nil
+}
+
+// Load reads a policy file, files ending in .json are JSON and anything else YAML
+func Load(filename string) (*Policy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading policy: %w", err)
+	}
+	format := "yaml"
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		format = "json"
+	}
+	return Parse(data, format)
+}
+
+// anyMatch reports whether value matches any of the globs
+func anyMatch(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,326 @@
+package policy_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+	"github.com/tb0hdan/go-webfilter/pkg/policy"
+	"github.com/tb0hdan/go-webfilter/pkg/proc"
+	"github.com/tb0hdan/go-webfilter/pkg/schedule"
+)
+
+var (
+	curl    = &proc.ProcessInfo{Binary: "/usr/bin/curl", Cmdline: "curl -X POST https://example.com/", UID: "1000"}
+	apt     = &proc.ProcessInfo{Binary: "/usr/bin/apt-get", Cmdline: "apt-get update", UID: "0"}
+	python  = &proc.ProcessInfo{Binary: "/usr/bin/python3", Cmdline: "python3 download.py", UID: "1000"}
+	firefox = &proc.ProcessInfo{Binary: "/usr/lib/firefox/firefox", Cmdline: "/usr/lib/firefox/firefox", UID: "1000"}
+	rootSh  = &proc.ProcessInfo{Binary: "/usr/bin/wget", Cmdline: "wget https://deb.debian.org/", UID: "0"}
+)
+
+// PolicyTestSuite defines the test suite for policy files
+type PolicyTestSuite struct {
+	suite.Suite
+}
+
+// TestEvaluate tests rule matching and ordering of the YAML policy
+func (suite *PolicyTestSuite) TestEvaluate() {
+	p, err := policy.Load(filepath.Join("testdata", "policy.yaml"))
+	suite.Require().NoError(err)
+
+	tests := []struct {
+		name             string
+		in               policy.Input
+		expectedRule     string
+		expectedAction   hooks.Action
+		expectedFinal    bool
+		expectedCategory string
+		expectedReason   string
+	}{
+		{
+			name:           "no match",
+			in:             policy.Input{Method: http.MethodGet, Host: "example.com", URL: "http://example.com/", Process: curl},
+			expectedAction: hooks.ActionAllow,
+		},
+		{
+			name:             "host glob",
+			in:               policy.Input{Method: http.MethodGet, Host: "www.casino.example", URL: "https://www.casino.example/", Process: curl},
+			expectedRule:     "no gambling",
+			expectedAction:   hooks.ActionBlock,
+			expectedCategory: "gambling",
+			expectedReason:   "Gambling is not allowed",
+		},
+		{
+			name:           "binary allowed before block",
+			in:             policy.Input{Method: http.MethodGet, Host: "casino.example", URL: "http://casino.example/", Process: apt},
+			expectedRule:   "package managers",
+			expectedAction: hooks.ActionAllow,
+			expectedFinal:  true,
+		},
+		{
+			name:           "host and uid",
+			in:             policy.Input{Method: http.MethodGet, Host: "deb.debian.org", URL: "https://deb.debian.org/", Process: rootSh},
+			expectedRule:   "root may update",
+			expectedAction: hooks.ActionAllow,
+			expectedFinal:  true,
+		},
+		{
+			name:             "method and binary",
+			in:               policy.Input{Method: "post", Host: "example.com", URL: "https://example.com/upload", Process: curl},
+			expectedRule:     "no uploads from curl",
+			expectedAction:   hooks.ActionBlock,
+			expectedCategory: "exfiltration",
+			expectedReason:   `Blocked by policy rule "no uploads from curl"`,
+		},
+		{
+			name:           "method without process",
+			in:             policy.Input{Method: http.MethodPost, Host: "example.com", URL: "https://example.com/upload"},
+			expectedAction: hooks.ActionAllow,
+		},
+		{
+			name:           "cmdline and url",
+			in:             policy.Input{Method: http.MethodGet, Host: "files.example.com", URL: "https://files.example.com/setup.exe", Process: python},
+			expectedRule:   "scripted downloads",
+			expectedAction: hooks.ActionBlock,
+		},
+		{
+			name:           "cmdline without url",
+			in:             policy.Input{Method: http.MethodGet, Host: "files.example.com", URL: "https://files.example.com/setup.zip", Process: python},
+			expectedAction: hooks.ActionAllow,
+		},
+		{
+			name:           "redirect",
+			in:             policy.Input{Method: http.MethodGet, Host: "search.example.com", URL: "https://search.example.com/search?q=x", Process: firefox},
+			expectedRule:   "safe search",
+			expectedAction: hooks.ActionRedirect,
+		},
+	}
+
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			rule, decision := p.Evaluate(&tt.in)
+			if tt.expectedRule == "" {
+				suite.Nil(rule)
+			} else {
+				suite.Require().NotNil(rule)
+				suite.Equal(tt.expectedRule, rule.Name)
+			}
+			suite.Equal(tt.expectedAction, decision.Action)
+			suite.Equal(tt.expectedFinal, decision.Final)
+			suite.Equal(tt.expectedCategory, decision.Category)
+			if tt.expectedReason != "" {
+				suite.Equal(tt.expectedReason, decision.Reason)
+			}
+			if decision.Action == hooks.ActionRedirect {
+				suite.Equal("https://safe.example.com/", decision.Location)
+			}
+		})
+	}
+}
+
+// TestJSON tests the JSON format and a default block policy
+func (suite *PolicyTestSuite) TestJSON() {
+	p, err := policy.Load(filepath.Join("testdata", "policy.json"))
+	suite.Require().NoError(err)
+
+	_, decision := p.Evaluate(&policy.Input{Host: "wiki.corp.example", Process: curl})
+	suite.Equal(hooks.ActionAllow, decision.Action)
+	_, decision = p.Evaluate(&policy.Input{Host: "example.com", Process: firefox})
+	suite.Equal(hooks.ActionAllow, decision.Action)
+	rule, decision := p.Evaluate(&policy.Input{Host: "example.com", Process: curl})
+	suite.Nil(rule)
+	suite.Equal(hooks.ActionBlock, decision.Action)
+}
+
+// TestInvalid tests that broken policies are rejected with the offending rule
+func (suite *PolicyTestSuite) TestInvalid() {
+	tests := []struct {
+		name     string
+		data     string
+		format   string
+		expected string
+	}{
+		{name: "unknown action", data: "rules:\n  - name: x\n    action: deny\n", expected: `rule x: unknown action "deny"`},
+		{name: "unknown default", data: "default: maybe\n", expected: `unknown default action "maybe"`},
+		{name: "redirect without target", data: "rules:\n  - action: redirect\n", expected: "rule #1: redirect rule without redirect target"},
+		{name: "bad regex", data: "rules:\n  - action: block\n    url: '('\n", expected: "rule #1: invalid url pattern"},
+		{name: "bad cmdline", data: "rules:\n  - action: block\n    cmdline: '[a'\n", expected: "rule #1: invalid cmdline pattern"},
+		{name: "bad glob", data: "rules:\n  - action: block\n    hosts: ['[a']\n", expected: "rule #1: invalid glob"},
+		{name: "typo", data: "rules:\n  - action: block\n    host: [example.com]\n", expected: "field host not found"},
+		{name: "json typo", data: `{"rules": [{"action": "block", "host": ["example.com"]}]}`, format: "json", expected: `unknown field "host"`},
+		{name: "bad uid", data: "rules:\n  - action: block\n    uids: [root]\n", expected: "error parsing policy"},
+	}
+
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			_, err := policy.Parse([]byte(tt.data), tt.format)
+			suite.Require().Error(err)
+			suite.Contains(err.Error(), tt.expected)
+		})
+	}
+
+	_, err := policy.Load(filepath.Join(suite.T().TempDir(), "missing.yaml"))
+	suite.Error(err)
+}
+
+// TestEmpty tests that an empty file allows everything
+func (suite *PolicyTestSuite) TestEmpty() {
+	path := filepath.Join(suite.T().TempDir(), "empty.yaml")
+	suite.Require().NoError(os.WriteFile(path, nil, 0o600))
+	p, err := policy.Load(path)
+	suite.Require().NoError(err)
+	_, decision := p.Evaluate(&policy.Input{Host: "example.com"})
+	suite.Equal(hooks.ActionAllow, decision.Action)
+}
+
+// TestHook tests the policy as a hook with the process attached by the server
+func (suite *PolicyTestSuite) TestHook() {
+	p, err := policy.Load(filepath.Join("testdata", "policy.yaml"))
+	suite.Require().NoError(err)
+	hook := policy.New(zerolog.Nop(), p)
+
+	req := httptest.NewRequest(http.MethodPut, "http://Example.COM.:8080/upload?x=1", nil)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	hooks.SetRequestInfo(c, &hooks.RequestInfo{Process: curl})
+	decision, err := hook.BeforeRequest(c)
+	suite.NoError(err)
+	suite.Equal(hooks.ActionBlock, decision.Action)
+
+	req = httptest.NewRequest(http.MethodGet, "http://casino.example:8080/", nil)
+	c = echo.New().NewContext(req, httptest.NewRecorder())
+	decision, err = hook.BeforeRequest(c)
+	suite.NoError(err)
+	suite.Equal("gambling", decision.Category)
+
+	// Swapping the policy takes effect for the next request
+	empty, err := policy.Parse(nil, "yaml")
+	suite.Require().NoError(err)
+	hook.SetPolicy(empty)
+	decision, err = hook.BeforeRequest(c)
+	suite.NoError(err)
+	suite.Equal(hooks.ActionAllow, decision.Action)
+}
+
+// TestPassthrough tests the policy for TLS connections passed through on their server name alone
+func (suite *PolicyTestSuite) TestPassthrough() {
+	p, err := policy.Load(filepath.Join("testdata", "policy.yaml"))
+	suite.Require().NoError(err)
+	hook := policy.New(zerolog.Nop(), p)
+	chain := hooks.NewChain(zerolog.Nop())
+	chain.Add("policy", hook, 0, 0)
+	chain.Add("reset", &resetHook{}, 1, 0)
+
+	suite.EqualError(hook.BeforeTLS(&hooks.TLSInfo{ServerName: "www.casino.example"}), "block by policy rule no gambling")
+	suite.ErrorIs(hook.BeforeTLS(&hooks.TLSInfo{ServerName: "deb.debian.org", Process: rootSh}), hooks.ErrPassThrough)
+	suite.NoError(chain.BeforeTLS(&hooks.TLSInfo{ServerName: "deb.debian.org", Process: rootSh}))
+	// Methods and paths are unknown, the upload and safe search rules can't match
+	suite.EqualError(chain.BeforeTLS(&hooks.TLSInfo{ServerName: "example.com", Process: curl}), "hook reset: reset")
+	suite.NoError(hook.BeforeTLS(&hooks.TLSInfo{ServerName: "search.example.com"}))
+
+	strict, err := policy.Parse([]byte("default: block\n"), "yaml")
+	suite.Require().NoError(err)
+	hook.SetPolicy(strict)
+	suite.EqualError(hook.BeforeTLS(&hooks.TLSInfo{ServerName: "example.com"}), "blocked by default policy")
+}
+
+// resetHook resets every passed through connection
+type resetHook struct {
+	hooks.EmptyHookImpl
+}
+
+func (resetHook) BeforeTLS(info *hooks.TLSInfo) error {
+	return errors.New("reset")
+}
+
+// fixedClock always returns the same time
+type fixedClock struct {
+	now time.Time
+}
+
+func (c *fixedClock) Now() time.Time {
+	return c.now
+}
+
+// TestScheduleAndQuota tests rules limited to a schedule and rules applying once a quota is used up
+func (suite *PolicyTestSuite) TestScheduleAndQuota() {
+	p, err := policy.Parse([]byte(`
+schedules:
+  work:
+    - days: [weekdays]
+      from: "09:00"
+      to: "17:00"
+quotas:
+  video:
+    limit: 2m
+rules:
+  - name: no video at work
+    hosts: ["*.video.example"]
+    schedule: work
+    action: block
+  - name: video quota
+    hosts: ["*.video.example"]
+    quota: video
+    action: block
+    category: quota
+`), "yaml")
+	suite.Require().NoError(err)
+	clock := &fixedClock{now: time.Date(2026, 10, 12, 10, 0, 0, 0, time.Local)}
+	usage, err := schedule.NewTracker(zerolog.Nop(), clock, "")
+	suite.Require().NoError(err)
+	hook := policy.New(zerolog.Nop(), p)
+	hook.SetClock(clock)
+	hook.SetUsage(usage)
+	decide := func(process *proc.ProcessInfo) hooks.Decision {
+		req := httptest.NewRequest(http.MethodGet, "https://www.video.example/watch", nil)
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+		hooks.SetRequestInfo(c, &hooks.RequestInfo{Process: process})
+		decision, err := hook.BeforeRequest(c)
+		suite.Require().NoError(err)
+		return decision
+	}
+
+	// Monday 10:00 is work time
+	suite.Equal(`Blocked by policy rule "no video at work"`, decide(firefox).Reason)
+	suite.Zero(usage.Used("video", "uid:1000"))
+
+	// After work two minutes of video are allowed
+	clock.now = clock.now.Add(8 * time.Hour)
+	suite.Equal(hooks.ActionAllow, decide(firefox).Action)
+	clock.now = clock.now.Add(time.Minute)
+	suite.Equal(hooks.ActionAllow, decide(curl).Action)
+	clock.now = clock.now.Add(time.Minute)
+	decision := decide(firefox)
+	suite.Equal(hooks.ActionBlock, decision.Action)
+	suite.Equal("quota", decision.Category)
+	suite.Equal(2*time.Minute, usage.Used("video", "uid:1000"))
+
+	// Other users and unidentified processes are not limited by a uid quota
+	suite.Equal(hooks.ActionAllow, decide(apt).Action)
+	suite.Equal(hooks.ActionAllow, decide(nil).Action)
+
+	// Passed through connections count as well
+	suite.Error(hook.BeforeTLS(&hooks.TLSInfo{ServerName: "www.video.example", Process: firefox}))
+	clock.now = clock.now.Add(24 * time.Hour)
+	suite.NoError(hook.BeforeTLS(&hooks.TLSInfo{ServerName: "www.video.example", Process: firefox}))
+	suite.Equal(time.Minute, usage.Used("video", "uid:1000"))
+
+	_, err = policy.Parse([]byte("rules:\n  - action: block\n    schedule: night\n"), "yaml")
+	suite.EqualError(err, `invalid policy: rule #1: unknown schedule "night"`)
+	_, err = policy.Parse([]byte("quotas:\n  video:\n    limit: forever\n"), "yaml")
+	suite.ErrorContains(err, "invalid policy: quota video: invalid limit")
+	_, err = policy.Parse([]byte("schedules:\n  work:\n    - days: [someday]\n"), "yaml")
+	suite.EqualError(err, `invalid policy: schedule work: window 1: unknown day "someday"`)
+}
+
+// TestPolicyTestSuite runs the test suite
+func TestPolicyTestSuite(t *testing.T) {
+	suite.Run(t, new(PolicyTestSuite))
+}
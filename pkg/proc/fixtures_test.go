@@ -0,0 +1,174 @@
+package proc_test
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+	"github.com/tb0hdan/go-webfilter/pkg/proc"
+)
+
+// fixtureRoot returns the procfs fixture tree for a scenario in testdata/procfs
+func fixtureRoot(scenario string) string {
+	return filepath.Join("testdata", "procfs", scenario)
+}
+
+// FixtureTestSuite runs the lister against the procfs fixture trees, no privileges needed
+type FixtureTestSuite struct {
+	suite.Suite
+	host *proc.ProcLister
+}
+
+// SetupTest sets up the test suite before each test
+func (suite *FixtureTestSuite) SetupTest() {
+	suite.host = proc.NewWithRoot(zerolog.Nop(), fixtureRoot("host"))
+}
+
+// TestGetPIDs tests that only numeric entries are listed
+func (suite *FixtureTestSuite) TestGetPIDs() {
+	pids, err := suite.host.GetPIDs()
+	suite.NoError(err)
+	suite.Equal([]string{"1", "1234", "2", "2345"}, pids)
+
+	_, err = proc.NewWithRoot(zerolog.Nop(), fixtureRoot("missing")).GetPIDs()
+	suite.Error(err)
+}
+
+// TestGetProcFDs tests listing fd directories, kernel threads have none we can read
+func (suite *FixtureTestSuite) TestGetProcFDs() {
+	fds, err := suite.host.GetProcFDs("1234")
+	suite.NoError(err)
+	suite.Equal([]string{"0", "1", "2", "3", "4"}, fds)
+
+	_, err = suite.host.GetProcFDs("2")
+	suite.Error(err)
+}
+
+// TestGetPidSocketInodes tests that only socket links are returned
+func (suite *FixtureTestSuite) TestGetPidSocketInodes() {
+	tests := []struct {
+		pid      string
+		expected []string
+	}{
+		{pid: "1", expected: []string{"1001"}},
+		{pid: "1234", expected: []string{"5001", "5003"}},
+		{pid: "2345", expected: []string{"5002"}},
+	}
+
+	for _, tt := range tests {
+		suite.Run(tt.pid, func() {
+			inodes, err := suite.host.GetPidSocketInodes(tt.pid)
+			suite.NoError(err)
+			suite.Equal(tt.expected, inodes)
+		})
+	}
+}
+
+// TestFindSocket tests socket lookup in the fixture net/tcp and net/tcp6 tables
+func (suite *FixtureTestSuite) TestFindSocket() {
+	tests := []struct {
+		name          string
+		local         string
+		expectedInode string
+		expectedUID   string
+	}{
+		{name: "IPv4", local: "10.0.0.5:48000", expectedInode: "5001", expectedUID: "1000"},
+		{name: "IPv6", local: "[2001:db8::5]:50000", expectedInode: "5002", expectedUID: "1000"},
+		{name: "IPv4-mapped", local: "10.0.0.5:48001", expectedInode: "5003", expectedUID: "1000"},
+		{name: "listening", local: "0.0.0.0:22", expectedInode: "1001", expectedUID: "0"},
+		{name: "unknown", local: "192.0.2.1:1"},
+	}
+
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			local, err := net.ResolveTCPAddr("tcp", tt.local)
+			suite.Require().NoError(err)
+			socket, err := suite.host.FindSocket(local)
+			if tt.expectedInode == "" {
+				suite.True(errors.Is(err, proc.ErrSocketNotFound))
+				return
+			}
+			suite.NoError(err)
+			suite.Equal(tt.expectedInode, socket.Inode)
+			suite.Equal(tt.expectedUID, socket.UID)
+		})
+	}
+}
+
+// TestProcessIdentification tests the whole socket to process resolution for every scenario
+// with both the scanning and the cached lister
+func (suite *FixtureTestSuite) TestProcessIdentification() {
+	tests := []struct {
+		name     string
+		scenario string
+		local    string
+		expected proc.ProcessInfo
+	}{
+		{
+			name:     "IPv4 client",
+			scenario: "host",
+			local:    "10.0.0.5:48000",
+			expected: proc.ProcessInfo{PID: "1234", Binary: "/usr/bin/curl", Cmdline: "curl -s http://example.com/"},
+		},
+		{
+			name:     "IPv6 client",
+			scenario: "host",
+			local:    "[2001:db8::5]:50000",
+			expected: proc.ProcessInfo{PID: "2345", Binary: "/usr/lib/firefox/firefox", Cmdline: "/usr/lib/firefox/firefox -P default"},
+		},
+		{
+			// The container shares the host network namespace, the binary path is the one inside the container
+			name:     "host network container",
+			scenario: "container",
+			local:    "10.0.0.5:40000",
+			expected: proc.ProcessInfo{PID: "4321", Binary: "/usr/local/bin/app", Cmdline: "app --port 8080"},
+		},
+	}
+
+	for _, tt := range tests {
+		root := fixtureRoot(tt.scenario)
+		listers := map[string]proc.Lister{
+			"scan":   proc.NewWithRoot(zerolog.Nop(), root),
+			"cached": proc.NewCachedLister(zerolog.Nop(), proc.NewWithRoot(zerolog.Nop(), root)),
+		}
+		for kind, lister := range listers {
+			suite.Run(tt.name+"/"+kind, func() {
+				local, err := net.ResolveTCPAddr("tcp", tt.local)
+				suite.Require().NoError(err)
+				socket, err := lister.FindSocket(local)
+				suite.Require().NoError(err)
+				info, err := lister.GetProcessInfoByInode(socket.Inode)
+				suite.Require().NoError(err)
+				suite.Equal(tt.expected, *info)
+			})
+		}
+	}
+}
+
+// TestOtherNetworkNamespace tests that a socket only listed in another network namespace
+// is not attributed to a connection reusing its local address
+func (suite *FixtureTestSuite) TestOtherNetworkNamespace() {
+	lister := proc.NewWithRoot(zerolog.Nop(), fixtureRoot("container"))
+	socket, err := lister.FindSocket(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 40000})
+	suite.NoError(err)
+	suite.Equal("6001", socket.Inode)
+
+	// The process in its own namespace is still resolvable by its socket inode
+	info, err := lister.GetProcessInfoByInode("7001")
+	suite.NoError(err)
+	suite.Equal("5432", info.PID)
+}
+
+// TestKernelThread tests that processes without an exe link are reported as errors
+func (suite *FixtureTestSuite) TestKernelThread() {
+	_, err := suite.host.GetProcessInfoByPID("2")
+	suite.Error(err)
+}
+
+// TestFixtureTestSuite runs the test suite
+func TestFixtureTestSuite(t *testing.T) {
+	suite.Run(t, new(FixtureTestSuite))
+}
@@ -0,0 +1,241 @@
+package proc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// defaultIndexRetries is how many times a lookup refreshes the index after a miss
+const defaultIndexRetries = 2
+
+// fdLocation is the file descriptor a socket inode was found at
+type fdLocation struct {
+	pid string
+	fd  string
+}
+
+// InodeIndex maps socket inodes to the processes holding them.
+// The index is built on the first lookup and refreshed incrementally afterwards:
+// only file descriptors of new processes and fds that appeared since the last refresh are read.
+// It is safe for concurrent use.
+type InodeIndex struct {
+	logger     zerolog.Logger
+	lister     Lister
+	maxRetries int
+
+	// refreshMu serializes refreshes, generation counts completed ones
+	refreshMu  sync.Mutex
+	generation uint64
+
+	mu sync.RWMutex
+	// inodes maps a socket inode to its location
+	inodes map[string]fdLocation
+	// fds maps a PID to its fds and the socket inode each of them points to, "" for other files
+	fds map[string]map[string]string
+	// stale fds were found pointing elsewhere and have to be read again on the next refresh
+	stale map[fdLocation]struct{}
+}
+
+// Lookup returns the PID of the process holding the socket inode.
+// A hit is verified with a single readlink, a miss refreshes the index at most maxRetries times,
+// the first refresh is incremental and the following ones are full rescans to catch reused fd numbers.
+func (idx *InodeIndex) Lookup(inode string) (string, error) {
+	var err error
+	for attempt := 0; attempt <= idx.maxRetries; attempt++ {
+		if attempt > 0 {
+			if err = idx.refresh(attempt > 1, idx.currentGeneration()); err != nil {
+				return "", err
+			}
+		}
+		if pid, ok := idx.get(inode); ok {
+			return pid, nil
+		}
+	}
+	return "", fmt.Errorf("inode %s not found in any process", inode)
+}
+
+// Refresh updates the index with the processes and file descriptors created since the last refresh
+func (idx *InodeIndex) Refresh() error {
+	return idx.refresh(false, idx.currentGeneration())
+}
+
+// Len returns the number of indexed socket inodes
+func (idx *InodeIndex) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.inodes)
+}
+
+func (idx *InodeIndex) currentGeneration() uint64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.generation
+}
+
+// get returns the PID for inode if the index has it and the fd still points to the socket
+func (idx *InodeIndex) get(inode string) (string, bool) {
+	idx.mu.RLock()
+	loc, ok := idx.inodes[inode]
+	idx.mu.RUnlock()
+	if !ok {
+		return "", false
+	}
+	target, err := idx.lister.ReadProcFD(loc.pid, loc.fd)
+	if err == nil && socketInode(target) == inode {
+		return loc.pid, true
+	}
+	// The process exited or closed the socket, forget about it
+	idx.mu.Lock()
+	if idx.inodes[inode] == loc {
+		delete(idx.inodes, inode)
+	}
+	idx.stale[loc] = struct{}{}
+	idx.mu.Unlock()
+	return "", false
+}
+
+// refresh updates the index. Unless full is set, fds that are already known are not read again.
+// Concurrent callers share a refresh: if one completed since seen was read, refresh returns immediately.
+func (idx *InodeIndex) refresh(full bool, seen uint64) error {
+	idx.refreshMu.Lock()
+	defer idx.refreshMu.Unlock()
+	if idx.currentGeneration() != seen {
+		return nil
+	}
+
+	// fds is only modified by refresh, it can be read without holding mu
+	idx.mu.Lock()
+	known, stale := idx.fds, idx.stale
+	idx.stale = make(map[fdLocation]struct{})
+	idx.mu.Unlock()
+	if full {
+		known = nil
+	}
+
+	pids, err := idx.lister.GetPIDs()
+	if err != nil {
+		return fmt.Errorf("failed to get PIDs: %v", err)
+	}
+	alive := make(map[string]struct{}, len(pids))
+	changed := make(map[string]map[string]string)
+	reads := 0
+	for _, pid := range pids {
+		names, err := idx.lister.GetProcFDs(pid)
+		if err != nil {
+			continue // The process exited or we are not allowed to look at it
+		}
+		alive[pid] = struct{}{}
+		previous := known[pid]
+		if unchanged(previous, names, pid, stale) {
+			continue
+		}
+		current := make(map[string]string, len(names))
+		for _, fd := range names {
+			inode, ok := previous[fd]
+			if _, isStale := stale[fdLocation{pid: pid, fd: fd}]; !ok || isStale {
+				target, err := idx.lister.ReadProcFD(pid, fd)
+				if err != nil {
+					continue // The fd was closed in the meantime
+				}
+				reads++
+				inode = socketInode(target)
+			}
+			current[fd] = inode
+		}
+		changed[pid] = current
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if full {
+		idx.fds = make(map[string]map[string]string, len(changed))
+		idx.inodes = make(map[string]fdLocation, len(idx.inodes))
+	}
+	// Drop the sockets of exited processes and of the ones that changed
+	for pid, fds := range idx.fds {
+		_, isAlive := alive[pid]
+		if _, isChanged := changed[pid]; isAlive && !isChanged {
+			continue
+		}
+		for fd, inode := range fds {
+			if inode != "" && idx.inodes[inode] == (fdLocation{pid: pid, fd: fd}) {
+				delete(idx.inodes, inode)
+			}
+		}
+		delete(idx.fds, pid)
+	}
+	for pid, fds := range changed {
+		idx.fds[pid] = fds
+		for fd, inode := range fds {
+			if inode != "" {
+				idx.inodes[inode] = fdLocation{pid: pid, fd: fd}
+			}
+		}
+	}
+	idx.generation++
+	idx.logger.Debug().Msgf("Inode index refreshed: %d processes, %d sockets, %d fds read, full=%v",
+		len(idx.fds), len(idx.inodes), reads, full)
+	return nil
+}
+
+// unchanged reports whether the fd directory of pid lists the same fds as previous and none of them is stale
+func unchanged(previous map[string]string, names []string, pid string, stale map[fdLocation]struct{}) bool {
+	if previous == nil || len(previous) != len(names) {
+		return false
+	}
+	for _, fd := range names {
+		if _, ok := previous[fd]; !ok {
+			return false
+		}
+		if _, ok := stale[fdLocation{pid: pid, fd: fd}]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// socketInode returns the inode of a "socket:[inode]" link target or "" for other files
+func socketInode(target string) string {
+	if !strings.HasPrefix(target, "socket:[") {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(target, "socket:["), "]")
+}
+
+// NewInodeIndex creates an empty index over lister, it's populated on the first lookup
+func NewInodeIndex(logger zerolog.Logger, lister Lister) *InodeIndex {
+	return &InodeIndex{
+		logger:     logger,
+		lister:     lister,
+		maxRetries: defaultIndexRetries,
+		inodes:     make(map[string]fdLocation),
+		fds:        make(map[string]map[string]string),
+		stale:      make(map[fdLocation]struct{}),
+	}
+}
+
+// CachedLister is a Lister resolving socket inodes through an InodeIndex instead of a full /proc scan
+type CachedLister struct {
+	Lister
+	index *InodeIndex
+}
+
+// GetProcessInfoByInode returns process information for a given socket inode
+func (cl *CachedLister) GetProcessInfoByInode(inode string) (*ProcessInfo, error) {
+	pid, err := cl.index.Lookup(inode)
+	if err != nil {
+		return nil, err
+	}
+	return cl.Lister.GetProcessInfoByPID(pid)
+}
+
+// NewCachedLister wraps lister with an inode index
+func NewCachedLister(logger zerolog.Logger, lister Lister) *CachedLister {
+	return &CachedLister{
+		Lister: lister,
+		index:  NewInodeIndex(logger, lister),
+	}
+}
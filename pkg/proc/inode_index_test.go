@@ -0,0 +1,378 @@
+package proc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+)
+
+// syntheticProc is an in-memory /proc tree: PIDs with fds pointing to sockets or files
+type syntheticProc struct {
+	mu        sync.RWMutex
+	processes map[string]map[string]string
+	readlinks atomic.Int64
+}
+
+func newSyntheticProc(pids, fdsPerPID int) *syntheticProc {
+	sp := &syntheticProc{processes: make(map[string]map[string]string)}
+	inode := 10000
+	for pid := 1; pid <= pids; pid++ {
+		for fd := 0; fd < fdsPerPID; fd++ {
+			target := "/dev/null"
+			// Every other fd is a socket
+			if fd%2 == 1 {
+				target = fmt.Sprintf("socket:[%d]", inode)
+				inode++
+			}
+			sp.set(strconv.Itoa(pid), strconv.Itoa(fd), target)
+		}
+	}
+	return sp
+}
+
+func (sp *syntheticProc) set(pid, fd, target string) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.processes[pid] == nil {
+		sp.processes[pid] = make(map[string]string)
+	}
+	sp.processes[pid][fd] = target
+}
+
+func (sp *syntheticProc) kill(pid string) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	delete(sp.processes, pid)
+}
+
+func (sp *syntheticProc) GetPIDs() ([]string, error) {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	pids := make([]string, 0, len(sp.processes))
+	for pid := range sp.processes {
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+func (sp *syntheticProc) GetProcFDs(pid string) ([]string, error) {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	fds, ok := sp.processes[pid]
+	if !ok {
+		return nil, fmt.Errorf("no such process %s", pid)
+	}
+	names := make([]string, 0, len(fds))
+	for fd := range fds {
+		names = append(names, fd)
+	}
+	return names, nil
+}
+
+func (sp *syntheticProc) ReadProcFD(pid, fd string) (string, error) {
+	sp.readlinks.Add(1)
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	target, ok := sp.processes[pid][fd]
+	if !ok {
+		return "", fmt.Errorf("no such fd %s/%s", pid, fd)
+	}
+	return target, nil
+}
+
+func (sp *syntheticProc) GetPidSocketInodes(pid string) ([]string, error) {
+	fds, err := sp.GetProcFDs(pid)
+	if err != nil {
+		return nil, err
+	}
+	var sockets []string
+	for _, fd := range fds {
+		target, err := sp.ReadProcFD(pid, fd)
+		if err != nil {
+			continue
+		}
+		if inode := socketInode(target); inode != "" {
+			sockets = append(sockets, inode)
+		}
+	}
+	return sockets, nil
+}
+
+func (sp *syntheticProc) GetProcessInfoByInode(inode string) (*ProcessInfo, error) {
+	pid, err := FindInodePID(sp, inode)
+	if err != nil {
+		return nil, err
+	}
+	return sp.GetProcessInfoByPID(pid)
+}
+
+func (sp *syntheticProc) GetProcessInfoByPID(pid string) (*ProcessInfo, error) {
+	return &ProcessInfo{PID: pid, Binary: "/usr/bin/synthetic-" + pid}, nil
+}
+
+func (sp *syntheticProc) FindSocket(local *net.TCPAddr) (*Socket, error) {
+	return nil, ErrSocketNotFound
+}
+
+// InodeIndexTestSuite defines the test suite for the socket inode index
+type InodeIndexTestSuite struct {
+	suite.Suite
+	tree  *syntheticProc
+	index *InodeIndex
+}
+
+// SetupTest creates 10 processes with 4 fds each, sockets are inodes 10000-10019
+func (suite *InodeIndexTestSuite) SetupTest() {
+	suite.tree = newSyntheticProc(10, 4)
+	suite.index = NewInodeIndex(zerolog.Nop(), suite.tree)
+}
+
+// TestLookup tests that the index is built once and hits only verify the fd
+func (suite *InodeIndexTestSuite) TestLookup() {
+	pid, err := suite.index.Lookup("10005")
+	suite.NoError(err)
+	suite.Equal("3", pid)
+	suite.Equal(20, suite.index.Len())
+
+	before := suite.tree.readlinks.Load()
+	pid, err = suite.index.Lookup("10019")
+	suite.NoError(err)
+	suite.Equal("10", pid)
+	suite.Equal(int64(1), suite.tree.readlinks.Load()-before)
+}
+
+// TestIncrementalRefresh tests that only new fds are read when the index is refreshed
+func (suite *InodeIndexTestSuite) TestIncrementalRefresh() {
+	suite.NoError(suite.index.Refresh())
+	suite.tree.set("11", "0", "socket:[20000]")
+	suite.tree.set("11", "1", "/dev/null")
+	suite.tree.set("1", "4", "socket:[20001]")
+
+	before := suite.tree.readlinks.Load()
+	pid, err := suite.index.Lookup("20000")
+	suite.NoError(err)
+	suite.Equal("11", pid)
+	// Three new fds plus the verification of the hit
+	suite.Equal(int64(4), suite.tree.readlinks.Load()-before)
+
+	pid, err = suite.index.Lookup("20001")
+	suite.NoError(err)
+	suite.Equal("1", pid)
+}
+
+// TestReusedFD tests that a socket behind a reused fd number is found by the full rescan
+func (suite *InodeIndexTestSuite) TestReusedFD() {
+	suite.NoError(suite.index.Refresh())
+	suite.tree.set("2", "1", "socket:[30000]")
+
+	pid, err := suite.index.Lookup("30000")
+	suite.NoError(err)
+	suite.Equal("2", pid)
+
+	// The old socket is gone
+	_, err = suite.index.Lookup("10002")
+	suite.Error(err)
+}
+
+// TestExitedProcess tests that sockets of exited processes are dropped
+func (suite *InodeIndexTestSuite) TestExitedProcess() {
+	suite.NoError(suite.index.Refresh())
+	suite.tree.kill("4")
+
+	_, err := suite.index.Lookup("10006")
+	suite.Error(err)
+	suite.Contains(err.Error(), "inode 10006 not found")
+	suite.Equal(18, suite.index.Len())
+}
+
+// TestBoundedRetry tests that a miss refreshes the index at most maxRetries times
+func (suite *InodeIndexTestSuite) TestBoundedRetry() {
+	suite.NoError(suite.index.Refresh())
+	generation := suite.index.currentGeneration()
+
+	_, err := suite.index.Lookup("99999")
+	suite.Error(err)
+	suite.Equal(generation+defaultIndexRetries, suite.index.currentGeneration())
+}
+
+// TestConcurrentLookups tests lookups from several goroutines while processes come and go
+func (suite *InodeIndexTestSuite) TestConcurrentLookups() {
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				inode := strconv.Itoa(10000 + (worker*50+i)%20)
+				if _, err := suite.index.Lookup(inode); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(worker)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			pid := strconv.Itoa(100 + i)
+			suite.tree.set(pid, "0", fmt.Sprintf("socket:[%d]", 40000+i))
+			suite.tree.kill(pid)
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		suite.NoError(err)
+	}
+}
+
+// TestCachedLister tests resolving process information through the index
+func (suite *InodeIndexTestSuite) TestCachedLister() {
+	lister := NewCachedLister(zerolog.Nop(), suite.tree)
+	info, err := lister.GetProcessInfoByInode("10001")
+	suite.NoError(err)
+	suite.Equal("1", info.PID)
+	suite.Equal("/usr/bin/synthetic-1", info.Binary)
+
+	_, err = lister.GetProcessInfoByInode("1")
+	suite.Error(err)
+	suite.False(errors.Is(err, ErrSocketNotFound))
+}
+
+// TestInodeIndexTestSuite runs the test suite
+func TestInodeIndexTestSuite(t *testing.T) {
+	suite.Run(t, new(InodeIndexTestSuite))
+}
+
+// benchmarkTree is a host with 500 processes holding 64 fds each, half of them sockets
+func benchmarkTree() *syntheticProc {
+	return newSyntheticProc(500, 64)
+}
+
+// BenchmarkFullScan measures the /proc scan GetProcessInfoByInode used to do for every request
+func BenchmarkFullScan(b *testing.B) {
+	tree := benchmarkTree()
+	// The socket of the last process is the worst case
+	inode := strconv.Itoa(10000 + 500*32 - 1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := FindInodePID(tree, inode); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(tree.readlinks.Load())/float64(b.N), "readlinks/op")
+}
+
+// BenchmarkInodeIndexLookup measures lookups in a populated index
+func BenchmarkInodeIndexLookup(b *testing.B) {
+	tree := benchmarkTree()
+	index := NewInodeIndex(zerolog.Nop(), tree)
+	if err := index.Refresh(); err != nil {
+		b.Fatal(err)
+	}
+	inode := strconv.Itoa(10000 + 500*32 - 1)
+	tree.readlinks.Store(0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := index.Lookup(inode); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(tree.readlinks.Load())/float64(b.N), "readlinks/op")
+}
+
+// BenchmarkInodeIndexNewSocket measures the miss path: a new connection from a new process
+func BenchmarkInodeIndexNewSocket(b *testing.B) {
+	tree := benchmarkTree()
+	index := NewInodeIndex(zerolog.Nop(), tree)
+	if err := index.Refresh(); err != nil {
+		b.Fatal(err)
+	}
+	tree.readlinks.Store(0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pid, inode := strconv.Itoa(1000+i), strconv.Itoa(100000+i)
+		tree.set(pid, "3", "socket:["+inode+"]")
+		if _, err := index.Lookup(inode); err != nil {
+			b.Fatal(err)
+		}
+		tree.kill(pid)
+	}
+	b.ReportMetric(float64(tree.readlinks.Load())/float64(b.N), "readlinks/op")
+}
+
+// writeProcTree writes sp as a procfs tree with fd symlinks below dir
+func writeProcTree(b *testing.B, sp *syntheticProc) string {
+	dir := b.TempDir()
+	for pid, fds := range sp.processes {
+		fdDir := filepath.Join(dir, pid, "fd")
+		if err := os.MkdirAll(fdDir, 0o755); err != nil {
+			b.Fatal(err)
+		}
+		for fd, target := range fds {
+			if err := os.Symlink(target, filepath.Join(fdDir, fd)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	return dir
+}
+
+// BenchmarkFullScanOnDisk is BenchmarkFullScan with real readdir and readlink calls
+func BenchmarkFullScanOnDisk(b *testing.B) {
+	lister := NewWithRoot(zerolog.Nop(), writeProcTree(b, benchmarkTree()))
+	inode := strconv.Itoa(10000 + 500*32 - 1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := FindInodePID(lister, inode); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkInodeIndexLookupOnDisk is BenchmarkInodeIndexLookup with real readdir and readlink calls
+func BenchmarkInodeIndexLookupOnDisk(b *testing.B) {
+	index := NewInodeIndex(zerolog.Nop(), NewWithRoot(zerolog.Nop(), writeProcTree(b, benchmarkTree())))
+	if err := index.Refresh(); err != nil {
+		b.Fatal(err)
+	}
+	inode := strconv.Itoa(10000 + 500*32 - 1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := index.Lookup(inode); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkInodeIndexRefreshOnDisk measures an incremental refresh of an unchanged tree,
+// the cost of a miss compared to BenchmarkFullScanOnDisk
+func BenchmarkInodeIndexRefreshOnDisk(b *testing.B) {
+	index := NewInodeIndex(zerolog.Nop(), NewWithRoot(zerolog.Nop(), writeProcTree(b, benchmarkTree())))
+	if err := index.Refresh(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := index.refresh(false, index.currentGeneration()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
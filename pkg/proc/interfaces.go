@@ -1,5 +1,7 @@
 package proc
 
+import "net"
+
 // Lister defines the interface for process listing operations
 type Lister interface {
 	// GetPIDs returns a list of all process IDs in the system
@@ -16,4 +18,17 @@ type Lister interface {
 	
 	// GetProcessInfoByInode returns process information for a given socket inode
 	GetProcessInfoByInode(inode string) (*ProcessInfo, error)
-}
\ No newline at end of file
+
+	// GetProcessInfoByPID returns process information for a given process ID
+	GetProcessInfoByPID(pid string) (*ProcessInfo, error)
+
+	// FindSocket returns the TCP socket bound to the given local address
+	FindSocket(local *net.TCPAddr) (*Socket, error)
+}
+
+// SocketLookup finds the socket behind a TCP connection
+type SocketLookup interface {
+	// LookupSocket returns the socket with the given local and remote addresses.
+	// ErrSocketNotFound is returned if there is no such socket.
+	LookupSocket(local, remote *net.TCPAddr) (*Socket, error)
+}
@@ -0,0 +1,45 @@
+package proc
+
+import (
+	"errors"
+	"net"
+
+	"github.com/rs/zerolog"
+)
+
+// LookupSocket implements SocketLookup by scanning /proc/net/tcp and /proc/net/tcp6.
+// Only the local address is matched, a local port identifies a client socket well enough.
+func (pl *ProcLister) LookupSocket(local, remote *net.TCPAddr) (*Socket, error) {
+	return pl.FindSocket(local)
+}
+
+// FallbackLookup tries several socket lookups in order. A lookup reporting ErrSocketNotFound
+// is authoritative, the next one is only tried if the lookup itself failed.
+type FallbackLookup struct {
+	logger  zerolog.Logger
+	lookups []SocketLookup
+}
+
+func (f *FallbackLookup) LookupSocket(local, remote *net.TCPAddr) (*Socket, error) {
+	var lastErr error
+	for _, lookup := range f.lookups {
+		socket, err := lookup.LookupSocket(local, remote)
+		if err == nil || errors.Is(err, ErrSocketNotFound) {
+			return socket, err
+		}
+		f.logger.Debug().Err(err).Msgf("Socket lookup %T failed, trying the next one", lookup)
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = ErrSocketNotFound
+	}
+	return nil, lastErr
+}
+
+// NewFallbackLookup creates a lookup trying each of lookups in order
+func NewFallbackLookup(logger zerolog.Logger, lookups ...SocketLookup) *FallbackLookup {
+	return &FallbackLookup{
+		logger:  logger,
+		lookups: lookups,
+	}
+}
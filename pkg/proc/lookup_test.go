@@ -0,0 +1,78 @@
+package proc
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+)
+
+// stubLookup answers every socket lookup the same way and counts the calls
+type stubLookup struct {
+	socket *Socket
+	err    error
+	calls  int
+}
+
+func (s *stubLookup) LookupSocket(local, remote *net.TCPAddr) (*Socket, error) {
+	s.calls++
+	return s.socket, s.err
+}
+
+// FallbackLookupTestSuite defines the test suite for FallbackLookup
+type FallbackLookupTestSuite struct {
+	suite.Suite
+	local *net.TCPAddr
+}
+
+func (suite *FallbackLookupTestSuite) SetupTest() {
+	suite.local = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+
+// TestFound tests that the first lookup finding the socket wins
+func (suite *FallbackLookupTestSuite) TestFound() {
+	primary := &stubLookup{socket: &Socket{Inode: "1"}}
+	secondary := &stubLookup{socket: &Socket{Inode: "2"}}
+
+	socket, err := NewFallbackLookup(zerolog.Nop(), primary, secondary).LookupSocket(suite.local, nil)
+	suite.Require().NoError(err)
+	suite.Equal("1", socket.Inode)
+	suite.Zero(secondary.calls)
+}
+
+// TestNotFoundIsAuthoritative tests that a socket the kernel doesn't know isn't searched for in /proc
+func (suite *FallbackLookupTestSuite) TestNotFoundIsAuthoritative() {
+	primary := &stubLookup{err: ErrSocketNotFound}
+	secondary := &stubLookup{socket: &Socket{Inode: "2"}}
+
+	_, err := NewFallbackLookup(zerolog.Nop(), primary, secondary).LookupSocket(suite.local, nil)
+	suite.ErrorIs(err, ErrSocketNotFound)
+	suite.Zero(secondary.calls)
+}
+
+// TestFailureFallsBack tests that a failed lookup is followed by the next one
+func (suite *FallbackLookupTestSuite) TestFailureFallsBack() {
+	primary := &stubLookup{err: errors.New("netlink unavailable")}
+	secondary := &stubLookup{socket: &Socket{Inode: "2"}}
+
+	socket, err := NewFallbackLookup(zerolog.Nop(), primary, secondary).LookupSocket(suite.local, nil)
+	suite.Require().NoError(err)
+	suite.Equal("2", socket.Inode)
+}
+
+// TestAllFailed tests that the last error is returned if no lookup works
+func (suite *FallbackLookupTestSuite) TestAllFailed() {
+	failure := errors.New("procfs unavailable")
+	primary := &stubLookup{err: errors.New("netlink unavailable")}
+	secondary := &stubLookup{err: failure}
+
+	_, err := NewFallbackLookup(zerolog.Nop(), primary, secondary).LookupSocket(suite.local, nil)
+	suite.ErrorIs(err, failure)
+}
+
+// TestFallbackLookupTestSuite runs the test suite
+func TestFallbackLookupTestSuite(t *testing.T) {
+	suite.Run(t, new(FallbackLookupTestSuite))
+}
@@ -2,6 +2,8 @@
 package mocks
 
 import (
+	"net"
+
 	"github.com/stretchr/testify/mock"
 	"github.com/tb0hdan/go-webfilter/pkg/proc"
 )
@@ -51,4 +53,21 @@ func (m *MockLister) GetProcessInfoByInode(inode string) (*proc.ProcessInfo, err
 		return nil, args.Error(1)
 	}
 	return args.Get(0).(*proc.ProcessInfo), args.Error(1)
-}
\ No newline at end of file
+}
+// GetProcessInfoByPID returns process information for a given process ID
+func (m *MockLister) GetProcessInfoByPID(pid string) (*proc.ProcessInfo, error) {
+	args := m.Called(pid)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*proc.ProcessInfo), args.Error(1)
+}
+
+// FindSocket returns the TCP socket bound to the given local address
+func (m *MockLister) FindSocket(local *net.TCPAddr) (*proc.Socket, error) {
+	args := m.Called(local)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*proc.Socket), args.Error(1)
+}
@@ -0,0 +1,89 @@
+package proc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/tb0hdan/go-webfilter/pkg/utils"
+)
+
+// ErrSocketNotFound is returned when a socket is not known to the kernel, e.g. it's not a local one
+var ErrSocketNotFound = errors.New("socket not found")
+
+// netTCPFiles are the socket tables for IPv4 and IPv6 relative to the procfs root,
+// the latter also lists IPv4-mapped sockets
+var netTCPFiles = []string{"net/tcp", "net/tcp6"}
+
+// Socket is a TCP socket as listed in /proc/net/tcp and /proc/net/tcp6
+type Socket struct {
+	LocalAddr  *net.TCPAddr
+	RemoteAddr *net.TCPAddr
+	UID        string
+	Inode      string
+}
+
+// ParseNetTCP parses the contents of /proc/net/tcp or /proc/net/tcp6
+func ParseNetTCP(data string) ([]Socket, error) {
+	var sockets []Socket
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		//   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+		if line == "" || strings.HasPrefix(line, "sl") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			return nil, fmt.Errorf("unexpected number of fields in line: %s", line)
+		}
+		local, err := parseHexTCPAddr(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing local address: %w", err)
+		}
+		remote, err := parseHexTCPAddr(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing remote address: %w", err)
+		}
+		sockets = append(sockets, Socket{
+			LocalAddr:  local,
+			RemoteAddr: remote,
+			UID:        fields[7],
+			Inode:      fields[9],
+		})
+	}
+	return sockets, nil
+}
+
+func parseHexTCPAddr(addr string) (*net.TCPAddr, error) {
+	ip, port, err := utils.ParseHexAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}, nil
+}
+
+// FindSocket looks up the socket bound to local in both the IPv4 and the IPv6 socket tables
+func (pl *ProcLister) FindSocket(local *net.TCPAddr) (*Socket, error) {
+	for _, name := range netTCPFiles {
+		path := pl.path(name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			// IPv6 may be disabled
+			pl.logger.Debug().Err(err).Msgf("Error reading %s", path)
+			continue
+		}
+		sockets, err := ParseNetTCP(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", path, err)
+		}
+		for _, socket := range sockets {
+			// IP.Equal treats IPv4-mapped IPv6 addresses and IPv4 addresses as equal
+			if socket.LocalAddr.Port == local.Port && socket.LocalAddr.IP.Equal(local.IP) {
+				return &socket, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("socket %s: %w", local, ErrSocketNotFound)
+}
@@ -0,0 +1,124 @@
+package proc_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+	"github.com/tb0hdan/go-webfilter/pkg/proc"
+)
+
+const (
+	netTCPHeader  = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+	netTCP6Header = "  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+)
+
+// NetTCPTestSuite defines the test suite for /proc/net/tcp parsing
+type NetTCPTestSuite struct {
+	suite.Suite
+}
+
+// TestParseNetTCP tests parsing of both the IPv4 and the IPv6 socket tables
+func (suite *NetTCPTestSuite) TestParseNetTCP() {
+	tests := []struct {
+		name           string
+		data           string
+		expectedLocal  string
+		expectedRemote string
+		expectedUID    string
+		expectedInode  string
+		expectedError  bool
+	}{
+		{
+			name:           "IPv4 connection",
+			data:           netTCPHeader + "   1: 0100007F:BC8F 0100A8C0:0050 01 00000000:00000000 00:00000000 00000000  1000        0 906 1 000000000842e0b2 100 0 0 10 0\n",
+			expectedLocal:  "127.0.0.1:48271",
+			expectedRemote: "192.168.0.1:80",
+			expectedUID:    "1000",
+			expectedInode:  "906",
+		},
+		{
+			name:           "IPv6 loopback",
+			data:           netTCP6Header + "   0: 00000000000000000000000001000000:1F90 00000000000000000000000001000000:D2F0 01 00000000:00000000 00:00000000 00000000  1000        0 31337 1 0000000000000000 20 4 30 10 -1\n",
+			expectedLocal:  "[::1]:8080",
+			expectedRemote: "[::1]:54000",
+			expectedUID:    "1000",
+			expectedInode:  "31337",
+		},
+		{
+			name:           "IPv6 global address",
+			data:           netTCP6Header + "   3: B80D0120000000000000000001000000:C350 B80D012000000000000000000A000000:01BB 01 00000000:00000000 00:00000000 00000000   999        0 4242 1 0000000000000000 20 4 30 10 -1\n",
+			expectedLocal:  "[2001:db8::1]:50000",
+			expectedRemote: "[2001:db8::a]:443",
+			expectedUID:    "999",
+			expectedInode:  "4242",
+		},
+		{
+			name:           "IPv4-mapped IPv6",
+			data:           netTCP6Header + "   7: 0000000000000000FFFF00000100007F:C350 0000000000000000FFFF00000101A8C0:0050 01 00000000:00000000 00:00000000 00000000     0        0 777 1 0000000000000000 20 4 30 10 -1\n",
+			expectedLocal:  "127.0.0.1:50000",
+			expectedRemote: "192.168.1.1:80",
+			expectedUID:    "0",
+			expectedInode:  "777",
+		},
+		{
+			name:          "truncated line",
+			data:          netTCP6Header + "   0: 00000000000000000000000001000000:1F90\n",
+			expectedError: true,
+		},
+		{
+			name:          "invalid address",
+			data:          netTCP6Header + "   0: 0000000000000000000000000100000Z:1F90 00000000000000000000000001000000:D2F0 01 00000000:00000000 00:00000000 00000000  1000        0 1 1 0000000000000000 20 4 30 10 -1\n",
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			sockets, err := proc.ParseNetTCP(tt.data)
+			if tt.expectedError {
+				suite.Error(err)
+				return
+			}
+			suite.NoError(err)
+			suite.Len(sockets, 1)
+			suite.Equal(tt.expectedLocal, sockets[0].LocalAddr.String())
+			suite.Equal(tt.expectedRemote, sockets[0].RemoteAddr.String())
+			suite.Equal(tt.expectedUID, sockets[0].UID)
+			suite.Equal(tt.expectedInode, sockets[0].Inode)
+		})
+	}
+}
+
+// TestParseNetTCPEmpty tests a table that only has the header
+func (suite *NetTCPTestSuite) TestParseNetTCPEmpty() {
+	sockets, err := proc.ParseNetTCP(netTCP6Header)
+	suite.NoError(err)
+	suite.Empty(sockets)
+}
+
+// TestFindSocketIntegration tests socket lookup in the real socket tables
+func (suite *NetTCPTestSuite) TestFindSocketIntegration() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration tests in short mode")
+	}
+	for _, network := range []string{"tcp4", "tcp6"} {
+		suite.Run(network, func() {
+			listener, err := net.Listen(network, "localhost:0")
+			if err != nil {
+				suite.T().Skipf("%s is not available: %v", network, err)
+			}
+			defer func() { _ = listener.Close() }()
+
+			socket, err := proc.New(zerolog.Nop()).FindSocket(listener.Addr().(*net.TCPAddr))
+			suite.NoError(err)
+			suite.NotEmpty(socket.Inode)
+		})
+	}
+}
+
+// TestNetTCPTestSuite runs the test suite
+func TestNetTCPTestSuite(t *testing.T) {
+	suite.Run(t, new(NetTCPTestSuite))
+}
@@ -3,6 +3,7 @@ package proc
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 
@@ -23,16 +24,26 @@ type ProcessInfo struct {
 	DstHost string
 }
 
+// DefaultRoot is where procfs is mounted
+const DefaultRoot = "/proc"
+
 type ProcLister struct {
 	logger zerolog.Logger
+	// root is the procfs mount point, fixture trees can be used instead of the real one
+	root string
+}
+
+// path returns the path of elem below the procfs root
+func (pl *ProcLister) path(elem ...string) string {
+	return filepath.Join(append([]string{pl.root}, elem...)...)
 }
 
 func (pl *ProcLister) GetPIDs() ([]string, error) {
-	// Read the /proc directory to get the list of inodes
+	// Read the procfs root to get the list of PIDs
 	reg := regexp.MustCompile("^[0-9]+$")
-	dirs, err := os.ReadDir("/proc")
+	dirs, err := os.ReadDir(pl.root)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read /proc directory: %v", err)
+		return nil, fmt.Errorf("failed to read %s directory: %v", pl.root, err)
 	}
 
 	var pids []string
@@ -47,7 +58,7 @@ func (pl *ProcLister) GetPIDs() ([]string, error) {
 
 func (pl *ProcLister) GetProcFDs(pid string) ([]string, error) {
 	// Read the /proc/[pid]/fd directory to get the list of file descriptors
-	fdsDir := fmt.Sprintf("/proc/%s/fd", pid)
+	fdsDir := pl.path(pid, "fd")
 	dirs, err := os.ReadDir(fdsDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read %s directory: %v", fdsDir, err)
@@ -63,7 +74,7 @@ func (pl *ProcLister) GetProcFDs(pid string) ([]string, error) {
 
 func (pl *ProcLister) ReadProcFD(pid, fd string) (string, error) {
 	// Read the symbolic link of the file descriptor
-	fdPath := fmt.Sprintf("/proc/%s/fd/%s", pid, fd)
+	fdPath := pl.path(pid, "fd", fd)
 	target, err := os.Readlink(fdPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to read link %s: %v", fdPath, err)
@@ -93,43 +104,65 @@ func (pl *ProcLister) GetPidSocketInodes(pid string) ([]string, error) {
 }
 
 func (pl *ProcLister) GetProcessInfoByInode(inode string) (*ProcessInfo, error) {
+	pid, err := FindInodePID(pl, inode)
+	if err != nil {
+		return nil, err
+	}
+	return pl.GetProcessInfoByPID(pid)
+}
+
+func (pl *ProcLister) GetProcessInfoByPID(pid string) (*ProcessInfo, error) {
+	// Read the cmdline of the process
+	cmdlinePath := pl.path(pid, "cmdline")
+	cmdlineData, err := os.ReadFile(cmdlinePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cmdline for PID %s: %v", pid, err)
+	}
+	// Read the binary name from the exe link
+	exePath := pl.path(pid, "exe")
+	binary, err := os.Readlink(exePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read exe link for PID %s: %v", pid, err)
+	}
+	return &ProcessInfo{
+		Binary:  strings.TrimSpace(binary),
+		// Arguments are NUL separated
+		Cmdline: strings.TrimSpace(strings.ReplaceAll(string(cmdlineData), "\x00", " ")),
+		PID:     pid,
+	}, nil
+}
+
+// FindInodePID scans the file descriptors of every process for the socket inode.
+// This is a full scan of /proc, see InodeIndex for a cached alternative.
+func FindInodePID(lister Lister, inode string) (string, error) {
 	// Read the /proc directory to get the list of PIDs
-	pids, err := pl.GetPIDs()
+	pids, err := lister.GetPIDs()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get PIDs: %v", err)
+		return "", fmt.Errorf("failed to get PIDs: %v", err)
 	}
 
 	for _, pid := range pids {
-		sockets, err := pl.GetPidSocketInodes(pid)
+		sockets, err := lister.GetPidSocketInodes(pid)
 		if err != nil {
 			continue // Skip if we can't get sockets for this PID
 		}
 		if utils.Index(sockets, func(s string) bool { return s == inode }) != -1 {
-			// If the inode is found in the sockets, read the cmdline
-			cmdlinePath := fmt.Sprintf("/proc/%s/cmdline", pid)
-			cmdlineData, err := os.ReadFile(cmdlinePath)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read cmdline for PID %s: %v", pid, err)
-			}
-			// Read the binary name from the exe link
-			exePath := fmt.Sprintf("/proc/%s/exe", pid)
-			binary, err := os.Readlink(exePath)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read exe link for PID %s: %v", pid, err)
-			}
-			return &ProcessInfo{
-				Binary:  strings.TrimSpace(binary),
-				Cmdline: strings.TrimSpace(string(cmdlineData)),
-				PID:     pid,
-			}, nil
+			return pid, nil
 		}
 	}
 
-	return nil, fmt.Errorf("inode %s not found in any process", inode)
+	return "", fmt.Errorf("inode %s not found in any process", inode)
 }
 
 func New(logger zerolog.Logger) *ProcLister {
+	return NewWithRoot(logger, DefaultRoot)
+}
+
+// NewWithRoot creates a lister reading procfs mounted at root, e.g. the host's /proc bind mounted
+// into a container or a fixture tree in tests
+func NewWithRoot(logger zerolog.Logger, root string) *ProcLister {
 	return &ProcLister{
 		logger: logger,
+		root:   root,
 	}
 }
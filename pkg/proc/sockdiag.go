@@ -0,0 +1,133 @@
+package proc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Netlink and sock_diag constants from linux/netlink.h, linux/sock_diag.h and linux/inet_diag.h
+const (
+	nlmsgHdrLen          = 16
+	nlmsgError           = 2
+	nlmsgDone            = 3
+	nlmFRequest          = 1
+	sockDiagByFamily     = 20
+	inetDiagReqV2Len     = 56
+	inetDiagMsgLen       = 72
+	inetDiagNoCookie     = ^uint32(0)
+	afInet               = 2
+	afInet6              = 10
+	ipprotoTCP           = 6
+	allTCPStates         = ^uint32(0)
+	inetDiagSockIDOffset = 8
+)
+
+// SockDiag looks up sockets by asking the kernel over NETLINK_SOCK_DIAG for the exact
+// 4-tuple of a connection, which is a single hash lookup instead of a /proc/net/tcp scan.
+type SockDiag struct {
+	seq uint32
+}
+
+// encodeSockDiagRequest builds a SOCK_DIAG_BY_FAMILY request (nlmsghdr + inet_diag_req_v2)
+// for the TCP socket with the given local and remote addresses
+func encodeSockDiagRequest(seq uint32, local, remote *net.TCPAddr) ([]byte, error) {
+	if local == nil || remote == nil {
+		return nil, errors.New("both local and remote addresses are required")
+	}
+	family := uint8(afInet)
+	localIP, remoteIP := local.IP.To4(), remote.IP.To4()
+	if localIP == nil || remoteIP == nil {
+		family = afInet6
+		localIP, remoteIP = local.IP.To16(), remote.IP.To16()
+	}
+	if localIP == nil || remoteIP == nil {
+		return nil, fmt.Errorf("invalid address pair %s, %s", local, remote)
+	}
+
+	buf := make([]byte, nlmsgHdrLen+inetDiagReqV2Len)
+	// struct nlmsghdr
+	binary.NativeEndian.PutUint32(buf[0:4], uint32(len(buf)))
+	binary.NativeEndian.PutUint16(buf[4:6], sockDiagByFamily)
+	binary.NativeEndian.PutUint16(buf[6:8], nlmFRequest)
+	binary.NativeEndian.PutUint32(buf[8:12], seq)
+	// struct inet_diag_req_v2
+	req := buf[nlmsgHdrLen:]
+	req[0] = family
+	req[1] = ipprotoTCP
+	binary.NativeEndian.PutUint32(req[4:8], allTCPStates)
+	// struct inet_diag_sockid, ports and addresses are in network byte order
+	id := req[inetDiagSockIDOffset:]
+	binary.BigEndian.PutUint16(id[0:2], uint16(local.Port))
+	binary.BigEndian.PutUint16(id[2:4], uint16(remote.Port))
+	copy(id[4:20], localIP)
+	copy(id[20:36], remoteIP)
+	binary.NativeEndian.PutUint32(id[40:44], inetDiagNoCookie)
+	binary.NativeEndian.PutUint32(id[44:48], inetDiagNoCookie)
+	return buf, nil
+}
+
+// parseSockDiagResponse extracts the socket from a reply to encodeSockDiagRequest
+func parseSockDiagResponse(data []byte, seq uint32) (*Socket, error) {
+	for len(data) >= nlmsgHdrLen {
+		msgLen := int(binary.NativeEndian.Uint32(data[0:4]))
+		if msgLen < nlmsgHdrLen || msgLen > len(data) {
+			return nil, fmt.Errorf("invalid netlink message length %d", msgLen)
+		}
+		msgType := binary.NativeEndian.Uint16(data[4:6])
+		msgSeq := binary.NativeEndian.Uint32(data[8:12])
+		payload := data[nlmsgHdrLen:msgLen]
+		// Messages are 4 byte aligned
+		data = data[min((msgLen+3)&^3, len(data)):]
+		if msgSeq != seq {
+			continue
+		}
+
+		switch msgType {
+		case nlmsgError:
+			if len(payload) < 4 {
+				return nil, errors.New("truncated netlink error")
+			}
+			errno := -int32(binary.NativeEndian.Uint32(payload[0:4]))
+			// ENOENT
+			if errno == 2 {
+				return nil, ErrSocketNotFound
+			}
+			return nil, fmt.Errorf("sock_diag error: errno %d", errno)
+		case nlmsgDone:
+			return nil, ErrSocketNotFound
+		case sockDiagByFamily:
+			if len(payload) < inetDiagMsgLen {
+				return nil, errors.New("truncated inet_diag_msg")
+			}
+			return decodeInetDiagMsg(payload), nil
+		}
+	}
+	return nil, ErrSocketNotFound
+}
+
+// decodeInetDiagMsg decodes struct inet_diag_msg
+func decodeInetDiagMsg(msg []byte) *Socket {
+	ipLen := net.IPv6len
+	if msg[0] == afInet {
+		ipLen = net.IPv4len
+	}
+	id := msg[4:52]
+	localIP := make(net.IP, ipLen)
+	remoteIP := make(net.IP, ipLen)
+	copy(localIP, id[4:4+ipLen])
+	copy(remoteIP, id[20:20+ipLen])
+	return &Socket{
+		LocalAddr:  &net.TCPAddr{IP: localIP, Port: int(binary.BigEndian.Uint16(id[0:2]))},
+		RemoteAddr: &net.TCPAddr{IP: remoteIP, Port: int(binary.BigEndian.Uint16(id[2:4]))},
+		UID:        strconv.FormatUint(uint64(binary.NativeEndian.Uint32(msg[64:68])), 10),
+		Inode:      strconv.FormatUint(uint64(binary.NativeEndian.Uint32(msg[68:72])), 10),
+	}
+}
+
+// NewSockDiag creates a sock_diag based socket lookup
+func NewSockDiag() *SockDiag {
+	return &SockDiag{}
+}
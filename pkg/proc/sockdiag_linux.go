@@ -0,0 +1,42 @@
+package proc
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// LookupSocket asks the kernel for the socket with the exact local and remote addresses
+func (d *SockDiag) LookupSocket(local, remote *net.TCPAddr) (*Socket, error) {
+	seq := atomic.AddUint32(&d.seq, 1)
+	request, err := encodeSockDiagRequest(seq, local, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return nil, fmt.Errorf("error opening sock_diag socket: %w", err)
+	}
+	defer func() {
+		_ = unix.Close(fd)
+	}()
+	// Never block a request on a kernel that doesn't answer
+	timeout := unix.Timeval{Sec: 1}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		return nil, fmt.Errorf("error setting sock_diag timeout: %w", err)
+	}
+	kernel := &unix.SockaddrNetlink{Family: unix.AF_NETLINK}
+	if err := unix.Sendto(fd, request, 0, kernel); err != nil {
+		return nil, fmt.Errorf("error sending sock_diag request: %w", err)
+	}
+
+	buf := make([]byte, 8192)
+	n, _, err := unix.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error receiving sock_diag response: %w", err)
+	}
+	return parseSockDiagResponse(buf[:n], seq)
+}
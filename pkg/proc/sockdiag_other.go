@@ -0,0 +1,13 @@
+//go:build !linux
+
+package proc
+
+import (
+	"errors"
+	"net"
+)
+
+// LookupSocket is only supported on Linux
+func (d *SockDiag) LookupSocket(local, remote *net.TCPAddr) (*Socket, error) {
+	return nil, errors.New("sock_diag is not supported on this platform")
+}
@@ -0,0 +1,147 @@
+package proc
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+)
+
+// SockDiagTestSuite defines the test suite for the sock_diag socket lookup
+type SockDiagTestSuite struct {
+	suite.Suite
+}
+
+// TestEncodeSockDiagRequest tests the wire encoding of SOCK_DIAG_BY_FAMILY requests
+func (suite *SockDiagTestSuite) TestEncodeSockDiagRequest() {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		suite.T().Skip("Expected bytes are recorded on a little-endian host")
+	}
+	tests := []struct {
+		name     string
+		local    *net.TCPAddr
+		remote   *net.TCPAddr
+		expected string
+	}{
+		{
+			name:   "IPv4",
+			local:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 48271},
+			remote: &net.TCPAddr{IP: net.IPv4(93, 184, 216, 34), Port: 80},
+			expected: "48000000" + "1400" + "0100" + "07000000" + "00000000" + // nlmsghdr
+				"02" + "06" + "00" + "00" + "ffffffff" + // family, protocol, ext, pad, states
+				"bc8f" + "0050" + // sport, dport
+				"7f000001000000000000000000000000" + // src
+				"5db8d822000000000000000000000000" + // dst
+				"00000000" + "ffffffffffffffff", // if, cookie
+		},
+		{
+			name:   "IPv6",
+			local:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000},
+			remote: &net.TCPAddr{IP: net.ParseIP("2001:db8::a"), Port: 443},
+			expected: "48000000" + "1400" + "0100" + "07000000" + "00000000" +
+				"0a" + "06" + "00" + "00" + "ffffffff" +
+				"c350" + "01bb" +
+				"20010db8000000000000000000000001" +
+				"20010db800000000000000000000000a" +
+				"00000000" + "ffffffffffffffff",
+		},
+	}
+
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			request, err := encodeSockDiagRequest(7, tt.local, tt.remote)
+			suite.NoError(err)
+			suite.Equal(tt.expected, hex.EncodeToString(request))
+		})
+	}
+
+	suite.Run("missing remote address", func() {
+		_, err := encodeSockDiagRequest(1, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, nil)
+		suite.Error(err)
+	})
+}
+
+// TestParseSockDiagResponse tests decoding of kernel replies
+func (suite *SockDiagTestSuite) TestParseSockDiagResponse() {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		suite.T().Skip("Recorded bytes are from a little-endian host")
+	}
+	msg := "58000000" + "1400" + "0200" + "07000000" + "00000000" + // nlmsghdr
+		"02" + "01" + "00" + "00" + // family, state, timer, retrans
+		"bc8f" + "0050" +
+		"7f000001000000000000000000000000" +
+		"5db8d822000000000000000000000000" +
+		"00000000" + "0100000000000000" + // if, cookie
+		"00000000" + "00000000" + "00000000" + // expires, rqueue, wqueue
+		"e8030000" + "8a030000" // uid 1000, inode 906
+	data, err := hex.DecodeString(msg)
+	suite.Require().NoError(err)
+
+	socket, err := parseSockDiagResponse(data, 7)
+	suite.NoError(err)
+	suite.Equal("127.0.0.1:48271", socket.LocalAddr.String())
+	suite.Equal("93.184.216.34:80", socket.RemoteAddr.String())
+	suite.Equal("1000", socket.UID)
+	suite.Equal("906", socket.Inode)
+
+	suite.Run("ENOENT", func() {
+		errMsg := "24000000" + "0200" + "0000" + "07000000" + "00000000" + "feffffff" + "0000000000000000000000000000000000000000"
+		data, err := hex.DecodeString(errMsg)
+		suite.Require().NoError(err)
+		_, err = parseSockDiagResponse(data, 7)
+		suite.True(errors.Is(err, ErrSocketNotFound))
+	})
+
+	suite.Run("foreign sequence number", func() {
+		_, err := parseSockDiagResponse(data, 8)
+		suite.True(errors.Is(err, ErrSocketNotFound))
+	})
+
+	suite.Run("truncated message", func() {
+		_, err := parseSockDiagResponse(data[:40], 7)
+		suite.Error(err)
+	})
+}
+
+// TestLookupSocketIntegration tests a lookup of a real connection
+func (suite *SockDiagTestSuite) TestLookupSocketIntegration() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration tests in short mode")
+	}
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0"} {
+		suite.Run(address, func() {
+			listener, err := net.Listen("tcp", address)
+			if err != nil {
+				suite.T().Skipf("%s is not available: %v", address, err)
+			}
+			defer func() { _ = listener.Close() }()
+			client, err := net.Dial("tcp", listener.Addr().String())
+			suite.Require().NoError(err)
+			defer func() { _ = client.Close() }()
+
+			socket, err := NewSockDiag().LookupSocket(client.LocalAddr().(*net.TCPAddr), client.RemoteAddr().(*net.TCPAddr))
+			if err != nil && !errors.Is(err, ErrSocketNotFound) {
+				suite.T().Skipf("sock_diag is not available: %v", err)
+			}
+			suite.Require().NoError(err)
+			suite.Equal(strconv.Itoa(os.Getuid()), socket.UID)
+			suite.Equal(client.LocalAddr().String(), socket.LocalAddr.String())
+
+			// The /proc scanner must agree on the inode
+			procSocket, err := New(zerolog.Nop()).FindSocket(client.LocalAddr().(*net.TCPAddr))
+			suite.Require().NoError(err)
+			suite.Equal(procSocket.Inode, socket.Inode)
+		})
+	}
+}
+
+// TestSockDiagTestSuite runs the test suite
+func TestSockDiagTestSuite(t *testing.T) {
+	suite.Run(t, new(SockDiagTestSuite))
+}
@@ -0,0 +1,143 @@
+package reload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// DefaultInterval is how often watched files are polled
+const DefaultInterval = 2 * time.Second
+
+// Loader parses and validates the watched files and activates the result.
+// On error nothing may be activated, so the previous version stays in use.
+type Loader func() error
+
+// Load returns a Loader parsing filename with parse and handing the result to activate.
+// activate is only called with versions that parsed, it should swap them in atomically.
+func Load[T any](filename string, parse func(string) (T, error), activate func(T)) Loader {
+	return func() error {
+		value, err := parse(filename)
+		if err != nil {
+			return err
+		}
+		activate(value)
+		return nil
+	}
+}
+
+// Watcher reloads configuration when its files change or on SIGHUP
+type Watcher struct {
+	logger   zerolog.Logger
+	interval time.Duration
+	// mu serializes reloads, loaders never run concurrently
+	mu      sync.Mutex
+	entries []*entry
+}
+
+type entry struct {
+	name  string
+	files []string
+	load  Loader
+	stats []os.FileInfo
+}
+
+// Add watches files and calls load when any of them changes.
+// The current version is assumed to be loaded already.
+func (w *Watcher) Add(name string, load Loader, files ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.entries = append(w.entries, &entry{name: name, files: files, load: load, stats: statAll(files)})
+}
+
+// Reload reloads everything regardless of changes, as done on SIGHUP
+func (w *Watcher) Reload() error {
+	return w.reload(true)
+}
+
+// Check reloads the entries whose files changed since they were last loaded
+func (w *Watcher) Check() error {
+	return w.reload(false)
+}
+
+func (w *Watcher) reload(force bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var errs []error
+	for _, e := range w.entries {
+		// Files are stat'ed before reading, a write racing with the load is picked up next time
+		stats := statAll(e.files)
+		if !force && sameStats(e.stats, stats) {
+			continue
+		}
+		// A broken file is reported once, not on every poll until it is fixed
+		e.stats = stats
+		if err := e.load(); err != nil {
+			w.logger.Error().Err(err).Msgf("Error reloading %s, keeping the previous version", e.name)
+			errs = append(errs, fmt.Errorf("error reloading %s: %w", e.name, err))
+			continue
+		}
+		w.logger.Info().Msgf("Reloaded %s", e.name)
+	}
+	return errors.Join(errs...)
+}
+
+// Start polls the watched files and reloads everything on SIGHUP until ctx is done
+func (w *Watcher) Start(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				w.logger.Info().Msg("SIGHUP received, reloading")
+				_ = w.Reload()
+			case <-ticker.C:
+				_ = w.Check()
+			}
+		}
+	}()
+}
+
+// statAll returns the file info of every file, nil for files that can't be stat'ed
+func statAll(files []string) []os.FileInfo {
+	stats := make([]os.FileInfo, len(files))
+	for i, file := range files {
+		stats[i], _ = os.Stat(file)
+	}
+	return stats
+}
+
+// sameStats reports whether no file was created, removed, replaced or modified
+func sameStats(a, b []os.FileInfo) bool {
+	for i := range a {
+		switch {
+		case a[i] == nil && b[i] == nil:
+		case a[i] == nil || b[i] == nil:
+			return false
+		case !os.SameFile(a[i], b[i]), !a[i].ModTime().Equal(b[i].ModTime()), a[i].Size() != b[i].Size():
+			return false
+		}
+	}
+	return true
+}
+
+// New creates a watcher polling every interval, DefaultInterval if interval is not positive
+func New(logger zerolog.Logger, interval time.Duration) *Watcher {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Watcher{logger: logger, interval: interval}
+}
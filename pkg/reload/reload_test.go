@@ -0,0 +1,181 @@
+package reload_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+	"github.com/tb0hdan/go-webfilter/pkg/policy"
+	"github.com/tb0hdan/go-webfilter/pkg/reload"
+)
+
+const (
+	blockExample = "rules:\n  - hosts: [example.com]\n    action: block\n"
+	allowAll     = "rules: []\n"
+)
+
+// ReloadTestSuite defines the test suite for reload.Watcher
+type ReloadTestSuite struct {
+	suite.Suite
+	dir     string
+	file    string
+	watcher *reload.Watcher
+	hook    *policy.Hook
+}
+
+// SetupTest writes a policy and watches it
+func (suite *ReloadTestSuite) SetupTest() {
+	suite.dir = suite.T().TempDir()
+	suite.file = filepath.Join(suite.dir, "policy.yaml")
+	suite.write(blockExample)
+	p, err := policy.Load(suite.file)
+	suite.Require().NoError(err)
+	suite.hook = policy.New(zerolog.Nop(), p)
+	suite.watcher = reload.New(zerolog.Nop(), 10*time.Millisecond)
+	suite.watcher.Add("policy", reload.Load(suite.file, policy.Load, suite.hook.SetPolicy), suite.file)
+}
+
+// write replaces the policy file, bumping the modification time so every change is seen
+func (suite *ReloadTestSuite) write(data string) {
+	suite.Require().NoError(os.WriteFile(suite.file, []byte(data), 0o600))
+	modTime := time.Now().Add(time.Duration(len(data)) * time.Second)
+	suite.Require().NoError(os.Chtimes(suite.file, modTime, modTime))
+}
+
+// action evaluates a request for example.com against the active policy
+func (suite *ReloadTestSuite) action() hooks.Action {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	decision, err := suite.hook.BeforeRequest(echo.New().NewContext(req, httptest.NewRecorder()))
+	suite.Require().NoError(err)
+	return decision.Action
+}
+
+// TestCheck tests that only changed files are reloaded
+func (suite *ReloadTestSuite) TestCheck() {
+	var loads atomic.Int32
+	counted := filepath.Join(suite.dir, "counted")
+	suite.Require().NoError(os.WriteFile(counted, []byte("1"), 0o600))
+	suite.watcher.Add("counted", func() error {
+		loads.Add(1)
+		return nil
+	}, counted)
+
+	suite.NoError(suite.watcher.Check())
+	suite.Equal(int32(0), loads.Load())
+	suite.Equal(hooks.ActionBlock, suite.action())
+
+	suite.write(allowAll)
+	suite.NoError(suite.watcher.Check())
+	suite.Equal(hooks.ActionAllow, suite.action())
+	suite.Equal(int32(0), loads.Load())
+
+	// Replacing a file by rename is a change even if size and time match
+	info, err := os.Stat(counted)
+	suite.Require().NoError(err)
+	replacement := filepath.Join(suite.dir, "replacement")
+	suite.Require().NoError(os.WriteFile(replacement, []byte("2"), 0o600))
+	suite.Require().NoError(os.Chtimes(replacement, info.ModTime(), info.ModTime()))
+	suite.Require().NoError(os.Rename(replacement, counted))
+	suite.NoError(suite.watcher.Check())
+	suite.Equal(int32(1), loads.Load())
+
+	suite.NoError(suite.watcher.Reload())
+	suite.Equal(int32(2), loads.Load())
+}
+
+// TestRollback tests that a broken file keeps the previous version active until it is fixed
+func (suite *ReloadTestSuite) TestRollback() {
+	suite.write("rules:\n  - action: deny\n")
+	err := suite.watcher.Check()
+	suite.ErrorContains(err, `error reloading policy: invalid policy: rule #1: unknown action "deny"`)
+	suite.Equal(hooks.ActionBlock, suite.action())
+	// The broken version is not retried until it changes
+	suite.NoError(suite.watcher.Check())
+
+	suite.Require().NoError(os.Remove(suite.file))
+	suite.ErrorContains(suite.watcher.Check(), "error reading policy")
+	suite.Equal(hooks.ActionBlock, suite.action())
+
+	suite.write(allowAll)
+	suite.NoError(suite.watcher.Check())
+	suite.Equal(hooks.ActionAllow, suite.action())
+}
+
+// TestErrorsJoined tests that a failing entry does not stop the others from reloading
+func (suite *ReloadTestSuite) TestErrorsJoined() {
+	suite.watcher.Add("broken", func() error {
+		return errors.New("bad list")
+	})
+	suite.write(allowAll)
+	err := suite.watcher.Reload()
+	suite.EqualError(err, "error reloading broken: bad list")
+	suite.Equal(hooks.ActionAllow, suite.action())
+}
+
+// TestConcurrent tests swapping policies while requests are evaluated
+func (suite *ReloadTestSuite) TestConcurrent() {
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				action := suite.action()
+				suite.Contains([]hooks.Action{hooks.ActionAllow, hooks.ActionBlock}, action)
+			}
+		}()
+	}
+	for i := range 50 {
+		if i%2 == 0 {
+			suite.write(allowAll)
+		} else {
+			suite.write(blockExample)
+		}
+		suite.NoError(suite.watcher.Check())
+	}
+	close(stop)
+	wg.Wait()
+	suite.Equal(hooks.ActionBlock, suite.action())
+}
+
+// TestStart tests polling and SIGHUP
+func (suite *ReloadTestSuite) TestStart() {
+	var loads atomic.Int32
+	suite.watcher.Add("signal", func() error {
+		loads.Add(1)
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	suite.watcher.Start(ctx)
+
+	suite.write(allowAll)
+	suite.Eventually(func() bool { return suite.action() == hooks.ActionAllow }, time.Second, 5*time.Millisecond)
+	suite.Equal(int32(0), loads.Load())
+
+	suite.Require().NoError(syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	suite.Eventually(func() bool { return loads.Load() == 1 }, time.Second, 5*time.Millisecond)
+}
+
+// TestReloadTestSuite runs the test suite
+func TestReloadTestSuite(t *testing.T) {
+	suite.Run(t, new(ReloadTestSuite))
+}
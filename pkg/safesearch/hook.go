@@ -0,0 +1,64 @@
+package safesearch
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+)
+
+// Hook enforces safe search on the requests to the engines of a table.
+// HTTPS is only rewritten when it is intercepted, passed through connections are never seen decrypted.
+type Hook struct {
+	logger zerolog.Logger
+	table  atomic.Pointer[Table]
+}
+
+// Table returns the active table
+func (h *Hook) Table() *Table {
+	return h.table.Load()
+}
+
+// SetTable replaces the active table, requests in flight finish with the old one
+func (h *Hook) SetTable(t *Table) {
+	h.table.Store(t)
+}
+
+func (h *Hook) BeforeRequest(c echo.Context) (hooks.Decision, error) {
+	req := c.Request()
+	host := req.Host
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	engine := h.Table().Match(host, req.URL.Path)
+	if engine == nil {
+		return hooks.Allow(), nil
+	}
+	if engine.Redirect != "" {
+		scheme := "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+		location := scheme + "://" + engine.Redirect + req.URL.RequestURI()
+		h.logger.Debug().Msgf("Safe search %s: redirecting %s to %s", engine.Name, host, location)
+		return hooks.Redirect(location), nil
+	}
+	h.logger.Debug().Msgf("Safe search %s: enforcing on %s%s", engine.Name, host, req.URL.Path)
+	return hooks.Modify(engine.Rewrite), nil
+}
+
+func (h *Hook) AfterRequest(c echo.Context, rsp *http.Response) error {
+	return nil
+}
+
+// New creates a hook enforcing safe search on the engines of t, see Default
+func New(logger zerolog.Logger, t *Table) *Hook {
+	h := &Hook{logger: logger}
+	h.SetTable(t)
+	return h
+}
@@ -0,0 +1,177 @@
+package safesearch
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed engines.yaml
+var defaultTable []byte
+
+// Engine is how safe search is enforced on one search engine or video site
+type Engine struct {
+	Name string `yaml:"name"`
+	// Hosts are globs (path.Match syntax) for the host without port
+	Hosts []string `yaml:"hosts"`
+	// Paths are prefixes of the URL path safe search applies to, every path if empty
+	Paths []string `yaml:"paths"`
+	// Params are set in the query string, replacing values chosen by the user
+	Params map[string]string `yaml:"params"`
+	// Headers are set on the request, e.g. YouTube-Restrict
+	Headers map[string]string `yaml:"headers"`
+	// Redirect is a host the client is sent to instead, keeping path and query
+	Redirect string `yaml:"redirect"`
+}
+
+// Table lists the engines, the first one matching a request applies
+type Table struct {
+	Engines []*Engine `yaml:"engines"`
+}
+
+// Match returns the engine for host and path, nil if safe search does not apply
+func (t *Table) Match(host, urlPath string) *Engine {
+	for _, engine := range t.Engines {
+		if engine.matches(host, urlPath) {
+			return engine
+		}
+	}
+	return nil
+}
+
+func (e *Engine) matches(host, urlPath string) bool {
+	hostMatch := false
+	for _, pattern := range e.Hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			hostMatch = true
+			break
+		}
+	}
+	if !hostMatch {
+		return false
+	}
+	if len(e.Paths) == 0 {
+		return true
+	}
+	for _, prefix := range e.Paths {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrite enforces the params and headers of the engine on an upstream request
+func (e *Engine) Rewrite(req *http.Request) error {
+	// Sorted so the rewritten query is the same for every request
+	for _, name := range slices.Sorted(maps.Keys(e.Params)) {
+		req.URL.RawQuery = setParam(req.URL.RawQuery, name, e.Params[name])
+	}
+	for name, value := range e.Headers {
+		req.Header.Set(name, value)
+	}
+	return nil
+}
+
+// setParam replaces every value of name in a raw query, leaving the rest of it byte for byte
+func setParam(rawQuery, name, value string) string {
+	var kept []string
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		key, _, _ := strings.Cut(pair, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == name {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	return strings.Join(append(kept, url.QueryEscape(name)+"="+url.QueryEscape(value)), "&")
+}
+
+// validate checks the engines and lowercases their hosts
+func (t *Table) validate() error {
+	for i, engine := range t.Engines {
+		if engine == nil {
+			return fmt.Errorf("engine %d is empty", i+1)
+		}
+		if engine.Name == "" {
+			engine.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if err := engine.validate(); err != nil {
+			return fmt.Errorf("engine %s: %w", engine.Name, err)
+		}
+	}
+	return nil
+}
+
+func (e *Engine) validate() error {
+	if len(e.Hosts) == 0 {
+		return errors.New("no hosts")
+	}
+	for i, pattern := range e.Hosts {
+		e.Hosts[i] = strings.ToLower(pattern)
+		if _, err := path.Match(e.Hosts[i], ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+	}
+	if e.Redirect != "" {
+		if len(e.Params) > 0 || len(e.Headers) > 0 {
+			return errors.New("redirect can't be combined with params or headers")
+		}
+		if strings.ContainsAny(e.Redirect, "/?#@") {
+			return fmt.Errorf("redirect %q must be a host", e.Redirect)
+		}
+		if e.matches(strings.ToLower(e.Redirect), "/") {
+			return fmt.Errorf("redirect %q matches the engine itself", e.Redirect)
+		}
+		return nil
+	}
+	if len(e.Params) == 0 && len(e.Headers) == 0 {
+		return errors.New("no params, headers or redirect")
+	}
+	return nil
+}
+
+// Parse parses and validates a YAML table
+func Parse(data []byte) (*Table, error) {
+	t := &Table{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(t); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error parsing safe search table: %w", err)
+	}
+	if err := t.validate(); err != nil {
+		return nil, fmt.Errorf("invalid safe search table: %w", err)
+	}
+	return t, nil
+}
+
+// Load reads a YAML table file
+func Load(filename string) (*Table, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading safe search table: %w", err)
+	}
+	return Parse(data)
+}
+
+// Default is the built-in table, see engines.yaml
+func Default() *Table {
+	t, err := Parse(defaultTable)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
@@ -0,0 +1,152 @@
+package safesearch_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+	"github.com/tb0hdan/go-webfilter/pkg/safesearch"
+)
+
+// SafeSearchTestSuite defines the test suite for safe search
+type SafeSearchTestSuite struct {
+	suite.Suite
+	hook *safesearch.Hook
+}
+
+// SetupTest creates a hook with the built-in table
+func (suite *SafeSearchTestSuite) SetupTest() {
+	suite.hook = safesearch.New(zerolog.Nop(), safesearch.Default())
+}
+
+// request runs the hook for target and applies its rewrite the way the server does
+func (suite *SafeSearchTestSuite) request(target string) (hooks.Decision, *http.Request) {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if req.URL.Scheme == "https" {
+		req.TLS = &tls.ConnectionState{ServerName: req.Host}
+	}
+	decision, err := suite.hook.BeforeRequest(echo.New().NewContext(req, httptest.NewRecorder()))
+	suite.Require().NoError(err)
+	if decision.Action == hooks.ActionModify {
+		suite.Require().NoError(decision.Rewrite(req))
+	}
+	return decision, req
+}
+
+// TestParams tests forcing query parameters, other parameters are kept as they were sent
+func (suite *SafeSearchTestSuite) TestParams() {
+	tests := map[string]string{
+		"https://www.google.com/search?q=a+b&safe=off":                     "q=a+b&safe=active",
+		"https://www.google.co.uk/search?safe=off&q=%7E&safe=images&hl=en": "q=%7E&hl=en&safe=active",
+		"https://google.de/search":                                         "safe=active",
+		"https://www.bing.com/search?q=x&adlt=off":                         "q=x&adlt=strict",
+		"https://duckduckgo.com/?q=x&kp=-2":                                "q=x&kp=1",
+		"https://uk.search.yahoo.com/search?p=x":                           "p=x&vm=r",
+		"https://WWW.YANDEX.RU./search/?text=x":                            "text=x&family=yes",
+	}
+	for target, expected := range tests {
+		suite.Run(target, func() {
+			decision, req := suite.request(target)
+			suite.Equal(hooks.ActionModify, decision.Action)
+			suite.Equal(expected, req.URL.RawQuery)
+		})
+	}
+}
+
+// TestHeaders tests setting headers, on top of what the client sent
+func (suite *SafeSearchTestSuite) TestHeaders() {
+	req := httptest.NewRequest(http.MethodGet, "https://www.youtube.com/watch?v=x", nil)
+	req.Header.Set("YouTube-Restrict", "Off")
+	decision, err := suite.hook.BeforeRequest(echo.New().NewContext(req, httptest.NewRecorder()))
+	suite.Require().NoError(err)
+	suite.Require().Equal(hooks.ActionModify, decision.Action)
+	suite.Require().NoError(decision.Rewrite(req))
+	suite.Equal([]string{"Moderate"}, req.Header.Values("YouTube-Restrict"))
+	suite.Equal("v=x", req.URL.RawQuery)
+}
+
+// TestUnmatched tests that other hosts and paths are left alone
+func (suite *SafeSearchTestSuite) TestUnmatched() {
+	for _, target := range []string{
+		"https://www.google.com/maps?q=x",
+		"https://mail.google.com/search?q=x",
+		"https://example.com/search?q=x",
+		"http://notgoogle.com/search?q=x",
+	} {
+		decision, req := suite.request(target)
+		suite.Equal(hooks.ActionAllow, decision.Action, target)
+		suite.Equal("q=x", req.URL.RawQuery, target)
+	}
+}
+
+// TestRedirect tests sending the client to the safe host of an engine
+func (suite *SafeSearchTestSuite) TestRedirect() {
+	table, err := safesearch.Parse([]byte(`
+engines:
+  - name: video
+    hosts: ["video.example.com", "*.video.example.com"]
+    redirect: restrict.video.example.org
+`))
+	suite.Require().NoError(err)
+	suite.hook.SetTable(table)
+
+	decision, _ := suite.request("https://m.video.example.com/watch?v=1")
+	suite.Equal(hooks.ActionRedirect, decision.Action)
+	suite.Equal("https://restrict.video.example.org/watch?v=1", decision.Location)
+
+	decision, _ = suite.request("http://video.example.com:8080/")
+	suite.Equal("http://restrict.video.example.org/", decision.Location)
+
+	decision, _ = suite.request("https://www.google.com/search?q=x")
+	suite.Equal(hooks.ActionAllow, decision.Action)
+}
+
+// TestParse tests the validation of tables
+func (suite *SafeSearchTestSuite) TestParse() {
+	tests := map[string]string{
+		"engines: [{name: a, params: {x: y}}]":                                     "engine a: no hosts",
+		"engines: [{name: a, hosts: [a.com]}]":                                     "engine a: no params, headers or redirect",
+		"engines: [{hosts: ['[a'], params: {x: y}}]":                               `engine #1: invalid glob "[a"`,
+		"engines: [{name: a, hosts: [a.com], redirect: b.com, params: {x: y}}]":    "engine a: redirect can't be combined with params or headers",
+		"engines: [{name: a, hosts: [a.com], redirect: 'https://b.com/'}]":         `engine a: redirect "https://b.com/" must be a host`,
+		"engines: [{name: a, hosts: ['*.a.com'], redirect: safe.a.com}]":           `engine a: redirect "safe.a.com" matches the engine itself`,
+		"engines: [{name: a, hosts: [a.com], params: {x: y}, typo: true}]":         "field typo not found",
+		"engines: [{name: a, hosts: [A.com], headers: {X-Safe: '1'}, paths: [/]}]": "",
+	}
+	for data, expected := range tests {
+		suite.Run(data, func() {
+			_, err := safesearch.Parse([]byte(data))
+			if expected == "" {
+				suite.NoError(err)
+				return
+			}
+			suite.ErrorContains(err, expected)
+		})
+	}
+}
+
+// TestLoad tests reading a table file
+func (suite *SafeSearchTestSuite) TestLoad() {
+	path := filepath.Join(suite.T().TempDir(), "engines.yaml")
+	suite.Require().NoError(os.WriteFile(path, []byte("engines: [{hosts: [Search.Example.com], params: {safe: '1'}}]"), 0o600))
+	table, err := safesearch.Load(path)
+	suite.Require().NoError(err)
+	suite.Require().Len(table.Engines, 1)
+	suite.Equal([]string{"search.example.com"}, table.Engines[0].Hosts)
+	suite.NotNil(table.Match("search.example.com", "/"))
+
+	_, err = safesearch.Load(filepath.Join(suite.T().TempDir(), "missing.yaml"))
+	suite.ErrorContains(err, "error reading safe search table")
+}
+
+// TestSafeSearchTestSuite runs the test suite
+func TestSafeSearchTestSuite(t *testing.T) {
+	suite.Run(t, new(SafeSearchTestSuite))
+}
@@ -0,0 +1,8 @@
+package schedule
+
+import "time"
+
+// Clock tells the time, tests inject their own
+type Clock interface {
+	Now() time.Time
+}
@@ -0,0 +1,197 @@
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tb0hdan/go-webfilter/pkg/proc"
+	"github.com/tb0hdan/go-webfilter/pkg/utils"
+)
+
+// Slot is the unit of usage, every slot with at least one request counts in full
+const Slot = time.Minute
+
+// Quota limits the daily usage of whatever rules reference it
+type Quota struct {
+	// Limit is a duration such as 30m or 2h
+	Limit string `yaml:"limit" json:"limit"`
+	// Per is uid (the default) or process, usage is counted separately for each
+	Per string `yaml:"per" json:"per"`
+
+	limit time.Duration
+}
+
+// Compile validates the quota
+func (q *Quota) Compile() error {
+	var err error
+	if q.limit, err = time.ParseDuration(q.Limit); err != nil {
+		return fmt.Errorf("invalid limit: %w", err)
+	}
+	if q.limit <= 0 {
+		return fmt.Errorf("limit %s is not positive", q.Limit)
+	}
+	switch q.Per {
+	case "":
+		q.Per = "uid"
+	case "uid", "process":
+	default:
+		return fmt.Errorf("unknown quota subject %q, expected uid or process", q.Per)
+	}
+	return nil
+}
+
+// Key returns who usage is counted for, false if the process is unknown
+func (q *Quota) Key(process *proc.ProcessInfo) (string, bool) {
+	if process == nil {
+		return "", false
+	}
+	if q.Per == "process" {
+		return "process:" + process.Binary, process.Binary != ""
+	}
+	return "uid:" + process.UID, process.UID != ""
+}
+
+// usage is the activity of one key on one day
+type usage struct {
+	Day  string        `json:"day"`
+	Used time.Duration `json:"used"`
+	// Slot is the last slot counted, requests in the same slot are free
+	Slot int64 `json:"slot"`
+}
+
+// Tracker counts daily usage from request activity and persists it across restarts
+type Tracker struct {
+	logger zerolog.Logger
+	clock  Clock
+	path   string
+	mu     sync.Mutex
+	usage  map[string]*usage
+	dirty  bool
+}
+
+// Use records activity of key against the named quota and reports whether the quota is exhausted.
+// Activity is only counted while the quota lasts.
+func (t *Tracker) Use(name string, q *Quota, key string) bool {
+	now := t.clock.Now()
+	day := now.Format(time.DateOnly)
+	slot := now.Unix() / int64(Slot/time.Second)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.get(name+"/"+key, day)
+	if u.Used >= q.limit {
+		return true
+	}
+	if u.Slot != slot {
+		u.Used += Slot
+		u.Slot = slot
+		t.dirty = true
+	}
+	return false
+}
+
+// Used returns today's usage of key against the named quota
+func (t *Tracker) Used(name, key string) time.Duration {
+	day := t.clock.Now().Format(time.DateOnly)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.get(name+"/"+key, day).Used
+}
+
+// get returns the usage of id on day, starting over on a new day
+func (t *Tracker) get(id, day string) *usage {
+	u, ok := t.usage[id]
+	if !ok || u.Day != day {
+		u = &usage{Day: day}
+		t.usage[id] = u
+	}
+	return u
+}
+
+// Save writes the counters if they changed, the file is replaced atomically
+func (t *Tracker) Save() error {
+	if t.path == "" {
+		return nil
+	}
+	t.mu.Lock()
+	if !t.dirty {
+		t.mu.Unlock()
+		return nil
+	}
+	// Earlier days are of no use anymore
+	today := t.clock.Now().Format(time.DateOnly)
+	for id, u := range t.usage {
+		if u.Day != today {
+			delete(t.usage, id)
+		}
+	}
+	data, err := json.MarshalIndent(t.usage, "", "  ")
+	t.dirty = false
+	t.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("error encoding quota usage: %w", err)
+	}
+	if err := utils.WriteFile(t.path, data); err != nil {
+		// Try again next time
+		t.mu.Lock()
+		t.dirty = true
+		t.mu.Unlock()
+		return fmt.Errorf("error writing quota usage: %w", err)
+	}
+	return nil
+}
+
+// Start saves the counters every interval and once more when ctx is done
+func (t *Tracker) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				if err := t.Save(); err != nil {
+					t.logger.Error().Err(err).Msg("Error saving quota usage")
+				}
+				return
+			case <-ticker.C:
+				if err := t.Save(); err != nil {
+					t.logger.Error().Err(err).Msg("Error saving quota usage")
+				}
+			}
+		}
+	}()
+}
+
+// load reads counters saved by an earlier run, a missing file is a fresh start
+func (t *Tracker) load() error {
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading quota usage: %w", err)
+	}
+	if err := json.Unmarshal(data, &t.usage); err != nil {
+		return fmt.Errorf("error parsing quota usage: %w", err)
+	}
+	if t.usage == nil {
+		t.usage = make(map[string]*usage)
+	}
+	return nil
+}
+
+// NewTracker creates a tracker persisting to path, which may be empty to keep usage in memory only
+func NewTracker(logger zerolog.Logger, clock Clock, path string) (*Tracker, error) {
+	t := &Tracker{logger: logger, clock: clock, path: path, usage: make(map[string]*usage)}
+	if path != "" {
+		if err := t.load(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,130 @@
+package schedule_test
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/suite"
+	"github.com/tb0hdan/go-webfilter/pkg/proc"
+	"github.com/tb0hdan/go-webfilter/pkg/schedule"
+)
+
+// fakeClock is a clock tests move by hand
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// QuotaTestSuite defines the test suite for quota tracking
+type QuotaTestSuite struct {
+	suite.Suite
+	clock   *fakeClock
+	path    string
+	tracker *schedule.Tracker
+	quota   *schedule.Quota
+}
+
+// SetupTest starts every test at 10:00 with no usage
+func (suite *QuotaTestSuite) SetupTest() {
+	suite.clock = &fakeClock{now: at(time.Monday, 10, 0)}
+	suite.path = filepath.Join(suite.T().TempDir(), "quota", "usage.json")
+	var err error
+	suite.tracker, err = schedule.NewTracker(zerolog.Nop(), suite.clock, suite.path)
+	suite.Require().NoError(err)
+	suite.quota = &schedule.Quota{Limit: "3m"}
+	suite.Require().NoError(suite.quota.Compile())
+}
+
+// TestUse tests that active minutes are counted until the limit
+func (suite *QuotaTestSuite) TestUse() {
+	// Many requests in one minute count once
+	for range 10 {
+		suite.False(suite.tracker.Use("video", suite.quota, "uid:1000"))
+	}
+	suite.Equal(time.Minute, suite.tracker.Used("video", "uid:1000"))
+
+	// Idle time is free
+	suite.clock.Advance(time.Hour)
+	suite.False(suite.tracker.Use("video", suite.quota, "uid:1000"))
+	suite.clock.Advance(time.Minute)
+	suite.False(suite.tracker.Use("video", suite.quota, "uid:1000"))
+	suite.Equal(3*time.Minute, suite.tracker.Used("video", "uid:1000"))
+	suite.clock.Advance(time.Minute)
+	suite.True(suite.tracker.Use("video", suite.quota, "uid:1000"))
+	suite.Equal(3*time.Minute, suite.tracker.Used("video", "uid:1000"))
+
+	// Other users and quotas are counted separately
+	suite.False(suite.tracker.Use("video", suite.quota, "uid:1001"))
+	suite.False(suite.tracker.Use("games", suite.quota, "uid:1000"))
+
+	// A new day starts over
+	suite.clock.Advance(24 * time.Hour)
+	suite.False(suite.tracker.Use("video", suite.quota, "uid:1000"))
+	suite.Equal(time.Minute, suite.tracker.Used("video", "uid:1000"))
+}
+
+// TestPersistence tests that usage survives a restart on the same day only
+func (suite *QuotaTestSuite) TestPersistence() {
+	suite.NoError(suite.tracker.Save())
+	suite.NoFileExists(suite.path)
+
+	for range 3 {
+		suite.tracker.Use("video", suite.quota, "uid:1000")
+		suite.clock.Advance(time.Minute)
+	}
+	suite.Require().NoError(suite.tracker.Save())
+
+	restarted, err := schedule.NewTracker(zerolog.Nop(), suite.clock, suite.path)
+	suite.Require().NoError(err)
+	suite.Equal(3*time.Minute, restarted.Used("video", "uid:1000"))
+	suite.True(restarted.Use("video", suite.quota, "uid:1000"))
+
+	suite.clock.Advance(24 * time.Hour)
+	restarted, err = schedule.NewTracker(zerolog.Nop(), suite.clock, suite.path)
+	suite.Require().NoError(err)
+	suite.Zero(restarted.Used("video", "uid:1000"))
+
+	suite.Require().NoError(os.WriteFile(suite.path, []byte("{"), 0o600))
+	_, err = schedule.NewTracker(zerolog.Nop(), suite.clock, suite.path)
+	suite.ErrorContains(err, "error parsing quota usage")
+}
+
+// TestQuota tests quota validation and keys
+func (suite *QuotaTestSuite) TestQuota() {
+	process := &proc.ProcessInfo{Binary: "/usr/bin/mpv", UID: "1000"}
+	key, ok := suite.quota.Key(process)
+	suite.True(ok)
+	suite.Equal("uid:1000", key)
+	perProcess := &schedule.Quota{Limit: "1h", Per: "process"}
+	suite.Require().NoError(perProcess.Compile())
+	key, ok = perProcess.Key(process)
+	suite.True(ok)
+	suite.Equal("process:/usr/bin/mpv", key)
+	_, ok = perProcess.Key(nil)
+	suite.False(ok)
+
+	suite.EqualError((&schedule.Quota{Limit: "0s"}).Compile(), "limit 0s is not positive")
+	suite.ErrorContains((&schedule.Quota{Limit: "half an hour"}).Compile(), "invalid limit")
+	suite.EqualError((&schedule.Quota{Limit: "1h", Per: "host"}).Compile(), `unknown quota subject "host", expected uid or process`)
+}
+
+// TestQuotaTestSuite runs the test suite
+func TestQuotaTestSuite(t *testing.T) {
+	suite.Run(t, new(QuotaTestSuite))
+}
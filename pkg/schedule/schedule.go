@@ -0,0 +1,117 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SystemClock is the wall clock in the local time zone
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Window is a daily time range on some days of the week.
+// A range ending before it starts runs past midnight and belongs to the day it starts on.
+type Window struct {
+	// Days are mon..sun, weekdays or weekend, every day if empty
+	Days []string `yaml:"days" json:"days"`
+	// From and To are HH:MM in local time, To is exclusive
+	From string `yaml:"from" json:"from"`
+	To   string `yaml:"to" json:"to"`
+
+	days     [7]bool
+	from, to int
+}
+
+// Schedule is active whenever any of its windows is
+type Schedule []*Window
+
+var dayNames = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekend":  {time.Saturday, time.Sunday},
+}
+
+// Active reports whether t falls into one of the windows
+func (s Schedule) Active(t time.Time) bool {
+	for _, w := range s {
+		if w.active(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Window) active(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.from < w.to {
+		return w.days[t.Weekday()] && minute >= w.from && minute < w.to
+	}
+	// Past midnight the window still belongs to the previous day
+	yesterday := (t.Weekday() + 6) % 7
+	return w.days[t.Weekday()] && minute >= w.from || w.days[yesterday] && minute < w.to
+}
+
+// Compile validates the windows and prepares them for Active
+func (s Schedule) Compile() error {
+	if len(s) == 0 {
+		return fmt.Errorf("schedule without windows")
+	}
+	for i, w := range s {
+		if w == nil {
+			return fmt.Errorf("window %d is empty", i+1)
+		}
+		if err := w.compile(); err != nil {
+			return fmt.Errorf("window %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (w *Window) compile() error {
+	w.days = [7]bool{}
+	for _, name := range w.Days {
+		days, ok := dayNames[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown day %q", name)
+		}
+		for _, day := range days {
+			w.days[day] = true
+		}
+	}
+	if len(w.Days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	var err error
+	if w.from, err = minuteOfDay(w.From, "00:00"); err != nil {
+		return err
+	}
+	if w.to, err = minuteOfDay(w.To, "24:00"); err != nil {
+		return err
+	}
+	if w.from == w.to {
+		return fmt.Errorf("empty time range %s-%s", w.From, w.To)
+	}
+	return nil
+}
+
+// minuteOfDay parses HH:MM, 24:00 being the end of the day
+func minuteOfDay(value, fallback string) (int, error) {
+	if value == "" {
+		value = fallback
+	}
+	var hour, minute int
+	if _, err := fmt.Sscanf(value, "%d:%d", &hour, &minute); err != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return hour*60 + minute, nil
+}
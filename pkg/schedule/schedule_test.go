@@ -0,0 +1,67 @@
+package schedule_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tb0hdan/go-webfilter/pkg/schedule"
+)
+
+// at returns a local time in the week of Monday 2026-10-12
+func at(day time.Weekday, hour, minute int) time.Time {
+	return time.Date(2026, 10, 11+int(day), hour, minute, 0, 0, time.Local)
+}
+
+func TestScheduleActive(t *testing.T) {
+	s := schedule.Schedule{
+		{Days: []string{"weekdays"}, From: "09:00", To: "17:00"},
+		{Days: []string{"Fri", "sat"}, From: "22:30", To: "06:00"},
+	}
+	require.NoError(t, s.Compile())
+
+	tests := []struct {
+		name     string
+		time     time.Time
+		expected bool
+	}{
+		{name: "monday morning", time: at(time.Monday, 9, 0), expected: true},
+		{name: "monday before", time: at(time.Monday, 8, 59)},
+		{name: "monday end is exclusive", time: at(time.Monday, 17, 0)},
+		{name: "sunday", time: at(time.Sunday, 12, 0)},
+		{name: "friday night", time: at(time.Friday, 23, 0), expected: true},
+		{name: "saturday early", time: at(time.Saturday, 5, 59), expected: true},
+		{name: "saturday morning", time: at(time.Saturday, 6, 0)},
+		{name: "sunday early", time: at(time.Sunday, 1, 0), expected: true},
+		{name: "friday early", time: at(time.Friday, 1, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, s.Active(tt.time))
+		})
+	}
+
+	allDay := schedule.Schedule{{}}
+	require.NoError(t, allDay.Compile())
+	assert.True(t, allDay.Active(at(time.Sunday, 23, 59)))
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule schedule.Schedule
+		expected string
+	}{
+		{name: "no windows", schedule: schedule.Schedule{}, expected: "schedule without windows"},
+		{name: "unknown day", schedule: schedule.Schedule{{Days: []string{"someday"}}}, expected: `window 1: unknown day "someday"`},
+		{name: "bad time", schedule: schedule.Schedule{{From: "9am"}}, expected: `window 1: invalid time "9am", expected HH:MM`},
+		{name: "past midnight", schedule: schedule.Schedule{{To: "24:01"}}, expected: `window 1: invalid time "24:01", expected HH:MM`},
+		{name: "empty range", schedule: schedule.Schedule{{From: "10:00", To: "10:00"}}, expected: "window 1: empty time range 10:00-10:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.EqualError(t, tt.schedule.Compile(), tt.expected)
+		})
+	}
+}
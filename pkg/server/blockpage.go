@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"mime"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+//go:embed templates/blockpage.html
+var defaultBlockPage string
+
+// BlockInfo is what the user is told about a blocked request
+type BlockInfo struct {
+	URL      string `json:"url"`
+	Method   string `json:"method"`
+	Reason   string `json:"reason,omitempty"`
+	Category string `json:"category,omitempty"`
+	// Process is the binary of the process that made the request, empty if unknown
+	Process string `json:"process,omitempty"`
+	PID     string `json:"pid,omitempty"`
+	// ReferenceID is logged along with the block so users can refer to it
+	ReferenceID string    `json:"reference_id"`
+	Time        time.Time `json:"time"`
+	// Unlock is where the unlock form posts to, no form is shown if empty
+	Unlock string `json:"unlock,omitempty"`
+	// RequestAccess is where the request access form posts to, no form is shown if empty
+	RequestAccess string `json:"request_access,omitempty"`
+}
+
+// BlockPage renders blocked requests as HTML, JSON or plain text depending on the Accept header
+type BlockPage struct {
+	tmpl *template.Template
+}
+
+// Render writes the block page for info with the given status code
+func (bp *BlockPage) Render(c echo.Context, status int, info *BlockInfo) error {
+	// Never cache the answer for a URL that may be unblocked later
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	switch negotiate(c.Request().Header.Get(echo.HeaderAccept), echo.MIMETextHTML, echo.MIMEApplicationJSON, echo.MIMETextPlain) {
+	case echo.MIMEApplicationJSON:
+		return c.JSON(status, struct {
+			Blocked bool `json:"blocked"`
+			*BlockInfo
+		}{Blocked: true, BlockInfo: info})
+	case echo.MIMETextPlain:
+		return c.String(status, info.text())
+	}
+	var page bytes.Buffer
+	if err := bp.tmpl.Execute(&page, info); err != nil {
+		return fmt.Errorf("error rendering block page: %w", err)
+	}
+	return c.HTMLBlob(status, page.Bytes())
+}
+
+func (info *BlockInfo) text() string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "Access to %s was blocked by the web filter.\n", info.URL)
+	if info.Reason != "" {
+		fmt.Fprintf(&text, "Reason: %s\n", info.Reason)
+	}
+	if info.Category != "" {
+		fmt.Fprintf(&text, "Category: %s\n", info.Category)
+	}
+	if info.Process != "" {
+		fmt.Fprintf(&text, "Application: %s\n", info.Process)
+	}
+	fmt.Fprintf(&text, "Reference: %s\n", info.ReferenceID)
+	return text.String()
+}
+
+// negotiate picks the offer the Accept header prefers, the first one wins ties and an empty header.
+// Nothing acceptable falls back to the first offer too, a block page is better than a 406.
+func negotiate(accept string, offers ...string) string {
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the q value of the most specific media range in the Accept header matching offer
+func acceptQuality(accept, offer string) float64 {
+	if strings.TrimSpace(accept) == "" {
+		return 1
+	}
+	offerType, offerSubtype, _ := strings.Cut(offer, "/")
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		rangeType, rangeSubtype, _ := strings.Cut(mediaType, "/")
+		var s int
+		switch {
+		case rangeType == offerType && rangeSubtype == offerSubtype:
+			s = 2
+		case rangeType == offerType && rangeSubtype == "*":
+			s = 1
+		case rangeType == "*" && rangeSubtype == "*":
+			s = 0
+		default:
+			continue
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, q = s, 1
+		if value, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+	}
+	return q
+}
+
+// newReferenceID returns a short random ID identifying a block in the logs
+func newReferenceID() string {
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
+
+// NewBlockPage creates a block page from an html/template, see templates/blockpage.html for the fields
+func NewBlockPage(text string) (*BlockPage, error) {
+	tmpl, err := template.New("blockpage").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing block page template: %w", err)
+	}
+	return &BlockPage{tmpl: tmpl}, nil
+}
+
+// LoadBlockPage creates a block page from a template file
+func LoadBlockPage(path string) (*BlockPage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading block page template: %w", err)
+	}
+	return NewBlockPage(string(data))
+}
+
+// DefaultBlockPage is the built-in block page
+func DefaultBlockPage() *BlockPage {
+	return &BlockPage{tmpl: template.Must(template.New("blockpage").Parse(defaultBlockPage))}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected string
+	}{
+		{accept: "", expected: echo.MIMETextHTML},
+		{accept: "*/*", expected: echo.MIMETextHTML},
+		{accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", expected: echo.MIMETextHTML},
+		{accept: "application/json", expected: echo.MIMEApplicationJSON},
+		{accept: "application/json, text/plain;q=0.5", expected: echo.MIMEApplicationJSON},
+		{accept: "application/json;q=0.5, text/plain", expected: echo.MIMETextPlain},
+		{accept: "text/*", expected: echo.MIMETextHTML},
+		{accept: "text/*, text/html;q=0", expected: echo.MIMETextPlain},
+		{accept: "image/png", expected: echo.MIMETextHTML},
+		{accept: "invalid;;, application/json", expected: echo.MIMEApplicationJSON},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			assert.Equal(t, tt.expected, negotiate(tt.accept, echo.MIMETextHTML, echo.MIMEApplicationJSON, echo.MIMETextPlain))
+		})
+	}
+}
+
+func TestBlockPage(t *testing.T) {
+	blocker := &decisionHook{decision: hooks.Decision{
+		Action:     hooks.ActionBlock,
+		Reason:     "<script>alert(1)</script>",
+		Category:   "malware",
+		StatusCode: http.StatusUnavailableForLegalReasons,
+	}}
+	srv := New(zerolog.Nop(), false)
+	srv.SetHooks(blocker)
+	e := echo.New()
+	srv.RegisterRoutes(e)
+	listeners := map[string]*httptest.Server{
+		"http":  httptest.NewServer(e),
+		"https": httptest.NewTLSServer(e),
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	for scheme, listener := range listeners {
+		defer listener.Close()
+		t.Run(scheme, func(t *testing.T) {
+			get := func(accept string) (*http.Response, string) {
+				req, err := http.NewRequest(http.MethodGet, listener.URL+"/casino?x=1", nil)
+				require.NoError(t, err)
+				req.Host = "blocked.example.com"
+				if accept != "" {
+					req.Header.Set("Accept", accept)
+				}
+				rsp, err := client.Do(req)
+				require.NoError(t, err)
+				defer func() { _ = rsp.Body.Close() }()
+				body, err := io.ReadAll(rsp.Body)
+				require.NoError(t, err)
+				assert.Equal(t, http.StatusUnavailableForLegalReasons, rsp.StatusCode)
+				assert.Equal(t, "no-store", rsp.Header.Get("Cache-Control"))
+				return rsp, string(body)
+			}
+			url := scheme + "://blocked.example.com/casino?x=1"
+
+			rsp, body := get("text/html")
+			assert.Equal(t, echo.MIMETextHTMLCharsetUTF8, rsp.Header.Get("Content-Type"))
+			assert.Contains(t, body, "<dd>"+url+"</dd>")
+			assert.Contains(t, body, "&lt;script&gt;alert(1)&lt;/script&gt;")
+			assert.NotContains(t, body, "<script>")
+			assert.Contains(t, body, "<dd>malware</dd>")
+			assert.Contains(t, body, "Reference ")
+
+			rsp, body = get("application/json")
+			assert.Equal(t, echo.MIMEApplicationJSON, rsp.Header.Get("Content-Type"))
+			var info struct {
+				Blocked bool `json:"blocked"`
+				BlockInfo
+			}
+			require.NoError(t, json.Unmarshal([]byte(body), &info))
+			assert.True(t, info.Blocked)
+			assert.Equal(t, url, info.URL)
+			assert.Equal(t, http.MethodGet, info.Method)
+			assert.Equal(t, "malware", info.Category)
+			assert.Len(t, info.ReferenceID, 12)
+			// The test itself made the request
+			assert.Equal(t, strconv.Itoa(os.Getpid()), info.PID)
+
+			rsp, body = get("text/plain")
+			assert.Equal(t, echo.MIMETextPlainCharsetUTF8, rsp.Header.Get("Content-Type"))
+			assert.Contains(t, body, "Access to "+url+" was blocked by the web filter.\n")
+			assert.Contains(t, body, "Category: malware\n")
+		})
+	}
+}
+
+func TestCustomBlockPage(t *testing.T) {
+	_, err := NewBlockPage("{{.Missing")
+	assert.Error(t, err)
+	_, err = LoadBlockPage(filepath.Join(t.TempDir(), "missing.html"))
+	assert.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "blocked.html")
+	require.NoError(t, os.WriteFile(path, []byte("<p>{{.Category}}: {{.ReferenceID}}</p>"), 0o600))
+	blockPage, err := LoadBlockPage(path)
+	require.NoError(t, err)
+
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	require.NoError(t, blockPage.Render(c, http.StatusForbidden, &BlockInfo{Category: "ads", ReferenceID: "abc"}))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, "<p>ads: abc</p>", rec.Body.String())
+}
+
+func TestBlockPageForms(t *testing.T) {
+	render := func(info *BlockInfo) string {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+		require.NoError(t, DefaultBlockPage().Render(c, http.StatusForbidden, info))
+		return rec.Body.String()
+	}
+
+	assert.NotContains(t, render(&BlockInfo{URL: "http://example.com/"}), "<form")
+	body := render(&BlockInfo{URL: "http://example.com/a?b=c", Unlock: "/.well-known/go-webfilter/unlock"})
+	assert.Contains(t, body, `<form method="post" action="/.well-known/go-webfilter/unlock">`)
+	assert.Contains(t, body, `<input type="hidden" name="url" value="http://example.com/a?b=c">`)
+	assert.Contains(t, body, `name="code"`)
+	assert.NotContains(t, body, "Request access")
+
+	body = render(&BlockInfo{URL: "http://example.com/", RequestAccess: "/.well-known/go-webfilter/request-access"})
+	assert.NotContains(t, body, `name="code"`)
+	assert.Contains(t, body, `<form method="post" action="/.well-known/go-webfilter/request-access">`)
+	assert.Contains(t, body, `<textarea id="reason" name="reason"`)
+}
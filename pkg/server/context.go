@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/tb0hdan/go-webfilter/pkg/utils"
+)
+
+type originalDstKey struct{}
+
+// ConnContext is meant to be used as http.Server.ConnContext. It records the
+// pre-NAT destination of every accepted connection so handlers don't have to trust the Host header.
+func (s *Server) ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	dst, err := redirectedDst(conn)
+	if err != nil {
+		s.logger.Debug().Err(err).Msgf("Original destination not available for %s", conn.RemoteAddr())
+		return ctx
+	}
+	return context.WithValue(ctx, originalDstKey{}, dst)
+}
+
+// redirectedDst returns the original destination of a connection that has been redirected to the proxy
+func redirectedDst(conn net.Conn) (*net.TCPAddr, error) {
+	dst, err := utils.OriginalDst(conn)
+	if err != nil {
+		return nil, err
+	}
+	// Connections made directly to the proxy report the proxy itself as the original destination
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.Equal(dst.IP) && local.Port == dst.Port {
+		return nil, errors.New("connection was not redirected")
+	}
+	return dst, nil
+}
+
+// OriginalDstFromContext returns the pre-NAT destination recorded by ConnContext
+func OriginalDstFromContext(ctx context.Context) (*net.TCPAddr, bool) {
+	dst, ok := ctx.Value(originalDstKey{}).(*net.TCPAddr)
+	return dst, ok
+}
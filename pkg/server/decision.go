@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+	"github.com/tb0hdan/go-webfilter/pkg/proc"
+)
+
+// respondDecision answers a request that a hook did not let through
+func (s *Server) respondDecision(c echo.Context, decision hooks.Decision) error {
+	target := displayURL(c.Request())
+	source := processName(hooks.GetProcess(c))
+	status := decision.Status()
+	switch decision.Action {
+	case hooks.ActionBlock:
+		info := &BlockInfo{
+			URL:           target,
+			Method:        c.Request().Method,
+			Reason:        decision.Reason,
+			Category:      decision.Category,
+			ReferenceID:   newReferenceID(),
+			Time:          time.Now(),
+			Unlock:        s.unlockPath,
+			RequestAccess: s.accessPath,
+		}
+		if process := hooks.GetProcess(c); process != nil {
+			info.Process, info.PID = process.Binary, process.PID
+		}
+		s.logger.Info().Msgf("Blocked %s %s from %s%s: %s (category %q, reference %s)",
+			c.Request().Method, target, source, decidedBy(decision), decision.Reason, decision.Category, info.ReferenceID)
+		return s.blockPage.Render(c, status, info)
+	case hooks.ActionRedirect:
+		if decision.Location == "" || status < http.StatusMultipleChoices || status > http.StatusPermanentRedirect {
+			s.logger.Error().Msgf("Invalid redirect of %s to %q with status %d", target, decision.Location, status)
+			return c.String(http.StatusInternalServerError, "Error processing request")
+		}
+		s.logger.Info().Msgf("Redirected %s %s from %s%s to %s (%d)",
+			c.Request().Method, target, source, decidedBy(decision), decision.Location, status)
+		return c.Redirect(status, decision.Location)
+	case hooks.ActionRespond:
+		s.logger.Info().Msgf("Answered %s %s from %s%s with %d", c.Request().Method, target, source, decidedBy(decision), status)
+		for name, values := range decision.Header {
+			c.Response().Header()[name] = values
+		}
+		c.Response().WriteHeader(status)
+		_, err := c.Response().Write(decision.Body)
+		return err
+	}
+	return fmt.Errorf("decision %s does not end the request", decision.Action)
+}
+
+// decidedBy names the hook of a chain that made the decision
+func decidedBy(decision hooks.Decision) string {
+	if decision.Hook == "" {
+		return ""
+	}
+	return " by hook " + decision.Hook
+}
+
+// displayURL is the URL the client asked for, as shown in logs and to the user
+func displayURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.RequestURI
+}
+
+// processName describes the process that made a request
+func processName(process *proc.ProcessInfo) string {
+	if process == nil {
+		return "unknown process"
+	}
+	return fmt.Sprintf("%s (PID %s)", process.Binary, process.PID)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+)
+
+// decisionHook returns the same decision for every request
+type decisionHook struct {
+	hooks.EmptyHookImpl
+	decision hooks.Decision
+	err      error
+}
+
+func (h *decisionHook) BeforeRequest(c echo.Context) (hooks.Decision, error) {
+	return h.decision, h.err
+}
+
+func TestDecisions(t *testing.T) {
+	var hits atomic.Int32
+	// The origin echoes back the request URI and a header hooks may inject
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("X-Request-URI", r.RequestURI)
+		w.Header().Set("X-Injected", r.Header.Get("X-Injected"))
+	}))
+	defer origin.Close()
+	originURL, err := url.Parse(origin.URL)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name             string
+		hook             *decisionHook
+		expectedStatus   int
+		expectedHeader   http.Header
+		expectedBody     string
+		expectedUpstream bool
+	}{
+		{
+			name:             "allow",
+			hook:             &decisionHook{decision: hooks.Allow()},
+			expectedStatus:   http.StatusOK,
+			expectedHeader:   http.Header{"X-Request-Uri": {"/path?q=1"}},
+			expectedUpstream: true,
+		},
+		{
+			name:           "block",
+			hook:           &decisionHook{decision: hooks.Block("gambling site", "gambling")},
+			expectedStatus: http.StatusForbidden,
+			expectedHeader: http.Header{"Content-Type": {echo.MIMETextHTMLCharsetUTF8}, "Cache-Control": {"no-store"}},
+		},
+		{
+			name:           "block with status",
+			hook:           &decisionHook{decision: hooks.Decision{Action: hooks.ActionBlock, Reason: "legal", StatusCode: http.StatusUnavailableForLegalReasons}},
+			expectedStatus: http.StatusUnavailableForLegalReasons,
+		},
+		{
+			name:           "redirect",
+			hook:           &decisionHook{decision: hooks.Redirect("https://safe.example.com/")},
+			expectedStatus: http.StatusFound,
+			expectedHeader: http.Header{"Location": {"https://safe.example.com/"}},
+		},
+		{
+			name:           "permanent redirect",
+			hook:           &decisionHook{decision: hooks.Decision{Action: hooks.ActionRedirect, Location: "/elsewhere", StatusCode: http.StatusMovedPermanently}},
+			expectedStatus: http.StatusMovedPermanently,
+			expectedHeader: http.Header{"Location": {"/elsewhere"}},
+		},
+		{
+			name:           "redirect without location",
+			hook:           &decisionHook{decision: hooks.Redirect("")},
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "respond",
+			hook:           &decisionHook{decision: hooks.Respond(http.StatusTeapot, http.Header{"Content-Type": {"application/json"}}, []byte(`{"ok":true}`))},
+			expectedStatus: http.StatusTeapot,
+			expectedHeader: http.Header{"Content-Type": {"application/json"}},
+			expectedBody:   `{"ok":true}`,
+		},
+		{
+			name: "modify",
+			hook: &decisionHook{decision: hooks.Modify(func(req *http.Request) error {
+				req.Header.Set("X-Injected", "yes")
+				query := req.URL.Query()
+				query.Set("safe", "active")
+				req.URL.RawQuery = query.Encode()
+				return nil
+			})},
+			expectedStatus:   http.StatusOK,
+			expectedHeader:   http.Header{"X-Injected": {"yes"}, "X-Request-Uri": {"/path?q=1&safe=active"}},
+			expectedUpstream: true,
+		},
+		{
+			name: "modify error",
+			hook: &decisionHook{decision: hooks.Modify(func(req *http.Request) error {
+				return errors.New("rewrite failed")
+			})},
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "hook error",
+			hook:           &decisionHook{err: errors.New("hook failed")},
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody:   "Error processing request",
+		},
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := New(zerolog.Nop(), false)
+			srv.SetHooks(tt.hook)
+			e := echo.New()
+			srv.RegisterRoutes(e)
+			proxy := httptest.NewServer(e)
+			defer proxy.Close()
+
+			before := hits.Load()
+			req, err := http.NewRequest(http.MethodGet, proxy.URL+"/path?q=1", nil)
+			require.NoError(t, err)
+			req.Host = originURL.Host
+			rsp, err := client.Do(req)
+			require.NoError(t, err)
+			defer func() { _ = rsp.Body.Close() }()
+			body, err := io.ReadAll(rsp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedStatus, rsp.StatusCode)
+			for name, values := range tt.expectedHeader {
+				assert.Equal(t, values, rsp.Header.Values(name), name)
+			}
+			if tt.expectedBody != "" {
+				assert.Equal(t, tt.expectedBody, string(body))
+			}
+			assert.Equal(t, tt.expectedUpstream, hits.Load() > before)
+		})
+	}
+}
+
+func TestDecisionTerminal(t *testing.T) {
+	assert.False(t, hooks.Decision{}.Terminal())
+	assert.False(t, hooks.Modify(nil).Terminal())
+	assert.True(t, hooks.Block("", "").Terminal())
+	assert.True(t, hooks.Redirect("/").Terminal())
+	assert.True(t, hooks.Respond(http.StatusOK, nil, nil).Terminal())
+	assert.Equal(t, "block", hooks.ActionBlock.String())
+}
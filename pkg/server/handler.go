@@ -1,65 +1,77 @@
 package server
 
 import (
-	"bufio"
-	"bytes"
-	"fmt"
+	"errors"
 	"io"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
 
 	"github.com/labstack/echo/v4"
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
 )
 
 func (s *Server) HandlePath(c echo.Context) error {
-	var (
-		err     error
-		reqBody []byte
-	)
-	// Extract the path parameter
-	path := c.Param("path")
-	if path == "" {
-		// If no path parameter is provided, use the root path
-		path = "/"
-	}
-	qs := c.Request().URL.RawQuery
-	if len(qs) > 0 {
-		// If there are query parameters, append them to the path
-		path += "?" + qs
+	if status, err := s.checkDestination(c.Request()); err != nil {
+		s.logger.Warn().Err(err).Msgf("Refusing request from %s for %s", c.Request().RemoteAddr, displayURL(c.Request()))
+		return c.String(status, err.Error())
 	}
 	if err := s.IdentifyLocalAddr(c); err != nil {
+		s.logger.Error().Err(err).Msg("Error identifying local address")
 		return c.String(http.StatusInternalServerError, "Error identifying local address")
 	}
 	// Run hooks before processing the request
-	if err := s.serverHooks.BeforeRequest(c); err != nil {
+	decision, err := s.serverHooks.BeforeRequest(c)
+	if err != nil {
 		s.logger.Error().Err(err).Msg("Error running BeforeRequest hook")
 		return c.String(http.StatusInternalServerError, "Error processing request")
 	}
-	// Construct the full URL to fetch
-	url := fmt.Sprintf("%s://%s/%s", c.Scheme(), c.Request().Host, path)
-	if c.Request().Method != http.MethodGet {
-		// prepare body for non-GET requests
-		reqBody, err = io.ReadAll(c.Request().Body)
-		if err != nil {
-			return c.String(http.StatusInternalServerError, "Error reading request body")
-		}
+	if decision.Terminal() {
+		return s.respondDecision(c, decision)
+	}
+	// Construct the full URL to fetch, the destination has been checked before the hooks ran
+	host := c.Request().Host
+	target := host
+	if dst, ok := OriginalDstFromContext(c.Request().Context()); ok {
+		target = dst.String()
+	}
+	scheme := "http"
+	if c.Request().TLS != nil {
+		scheme = "https"
 	}
-	// Keep-alive connections are using separate context, so we need to create a new request
-	req, err := http.NewRequestWithContext(c.Request().Context(), c.Request().Method, url, bytes.NewReader(reqBody))
+	upstream := upstreamURL(scheme, target, c.Request())
+	// Keep-alive connections are using separate context, so we need to create a new request.
+	// The body is streamed as is instead of being buffered in memory.
+	ctx := withServerName(c.Request().Context(), serverName(host, c.Request()))
+	var body io.Reader
+	if c.Request().ContentLength != 0 {
+		body = c.Request().Body
+	}
+	req, err := http.NewRequestWithContext(ctx, c.Request().Method, scheme+"://"+target, body)
 	if err != nil {
 		return c.String(http.StatusInternalServerError, "Error creating request")
 	}
+	req.URL = upstream
+	req.ContentLength = c.Request().ContentLength
+	// Keep sending the Host the client asked for
+	req.Host = host
 	// Copy headers from the original request
-	for name, values := range c.Request().Header {
-		for _, value := range values {
-			req.Header.Add(name, value)
+	copyRequestHeaders(req, c.Request())
+	if decision.Action == hooks.ActionModify && decision.Rewrite != nil {
+		if err := rewrite(req, decision.Rewrite); err != nil {
+			s.logger.Error().Err(err).Msgf("Error rewriting request: %s", displayURL(c.Request()))
+			return c.String(http.StatusInternalServerError, "Error processing request")
 		}
+		s.logger.Debug().Msgf("Rewrote %s%s", displayURL(c.Request()), decidedBy(decision))
 	}
 	// Dump the request if dump is enabled
 	s.DumpRequest(req)
-	rsp, err := http.DefaultClient.Do(req)
+	rsp, err := s.client.Do(req)
 	if err != nil {
-		s.logger.Error().Err(err).Msgf("Error executing request: %s", url)
-		return c.String(http.StatusInternalServerError, "Error making request")
+		s.logger.Error().Err(err).Msgf("Error executing request: %s %s", target, upstream.RequestURI())
+		return c.String(http.StatusBadGateway, "Error making request")
 	}
 	defer func() {
 		_ = rsp.Body.Close()
@@ -71,25 +83,82 @@ func (s *Server) HandlePath(c echo.Context) error {
 	}
 	// Dump the request and response if dump is enabled
 	s.DumpResponse(rsp)
-	// Copy headers from the original request
-	for name, values := range rsp.Header {
-		for _, value := range values {
-			c.Response().Header().Set(name, value)
-		}
+	if err := s.relayResponse(c.Response(), rsp); err != nil {
+		// Headers are already sent, abort so the client doesn't take a truncated body as complete
+		s.logger.Error().Err(err).Msgf("Error relaying response: %s %s", target, upstream.RequestURI())
+		panic(http.ErrAbortHandler)
 	}
-	scanner := bufio.NewScanner(rsp.Body)
-	for scanner.Scan() {
-		line := scanner.Bytes()
-		written, err := c.Response().Write(line)
-		if err != nil {
-			s.logger.Error().Err(err).Msg("Error writing response")
-			break
-		}
-		if written < len(line) {
-			s.logger.Error().Err(err).Msg("Error writing response")
-			break
-		}
-		c.Response().Flush()
+	return nil
+}
+
+// checkDestination refuses requests the proxy must not relay. Redirected requests always go to their original
+// destination, whatever Host says, and the hooks see that destination next to Host. Requests made directly to
+// the proxy go to Host and are only relayed for local clients, anyone else could use the proxy as an open relay.
+// It returns the status to answer with when the request is refused.
+func (s *Server) checkDestination(r *http.Request) (int, error) {
+	if serverName(r.Host, r) == "" {
+		return http.StatusBadRequest, errors.New("unable to determine request destination")
+	}
+	if _, ok := OriginalDstFromContext(r.Context()); ok {
+		return 0, nil
+	}
+	client, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil || !client.Addr().Unmap().IsLoopback() {
+		return http.StatusForbidden, errors.New("only redirected connections are relayed")
+	}
+	return 0, nil
+}
+
+// upstreamURL builds the upstream URL from the raw request target, so the path (including
+// encoded slashes) and the query string reach the origin exactly as the client sent them.
+// Path and RawPath are set as well for rewrites to read and change.
+func upstreamURL(scheme, target string, r *http.Request) *url.URL {
+	u := &url.URL{Scheme: scheme, Host: target}
+	uri := r.RequestURI
+	if uri == "*" {
+		// OPTIONS * applies to the server as a whole
+		u.Opaque = uri
+		return u
+	}
+	if !strings.HasPrefix(uri, "/") {
+		// absolute-form, the Host has already been taken care of
+		uri = r.URL.RequestURI()
+	}
+	path, query, hasQuery := strings.Cut(uri, "?")
+	u.RawQuery = query
+	u.ForceQuery = hasQuery && query == ""
+	u.Path = path
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		u.Path = unescaped
+	}
+	u.RawPath = path
+	// An opaque value starting with // would be sent in absolute-form
+	if !strings.HasPrefix(path, "//") {
+		u.Opaque = path
+	}
+	return u
+}
+
+// rewrite applies the rewrite of a modify decision to req. The raw path is sent
+// as is only as long as the rewrite leaves the path alone.
+func rewrite(req *http.Request, fn func(req *http.Request) error) error {
+	path, rawPath := req.URL.Path, req.URL.RawPath
+	if err := fn(req); err != nil {
+		return err
+	}
+	if req.URL.Path != path || req.URL.RawPath != rawPath {
+		req.URL.Opaque = ""
 	}
 	return nil
 }
+
+// serverName returns the TLS server name to present upstream: the Host header or the client's SNI
+func serverName(host string, r *http.Request) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		return name
+	}
+	if host == "" && r.TLS != nil {
+		return r.TLS.ServerName
+	}
+	return strings.Trim(host, "[]")
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+	"github.com/tb0hdan/go-webfilter/pkg/utils"
+)
+
+// TLSMode decides what happens to redirected TLS connections by default
+type TLSMode int
+
+const (
+	// TLSIntercept terminates TLS with a minted certificate and proxies the decrypted requests
+	TLSIntercept TLSMode = iota
+	// TLSPassthrough splices the encrypted stream to the original destination untouched
+	TLSPassthrough
+)
+
+const clientHelloTimeout = 10 * time.Second
+
+// spliceIdleTimeout closes passed through connections without traffic in either direction for that long
+var spliceIdleTimeout = 5 * time.Minute
+
+// maxAcceptDelay caps the backoff after failed accepts, e.g. while out of file descriptors
+const maxAcceptDelay = time.Second
+
+var errClientHelloRead = errors.New("client hello read")
+
+// SetTLSMode sets the default TLS mode. Hosts matching one of the exceptions
+// (see utils.MatchHost) get the opposite treatment.
+func (s *Server) SetTLSMode(mode TLSMode, exceptions []string) {
+	s.tlsMode = mode
+	s.tlsExceptions = exceptions
+}
+
+// passthrough reports whether a TLS connection for serverName should be passed through
+func (s *Server) passthrough(serverName string) bool {
+	for _, pattern := range s.tlsExceptions {
+		if serverName != "" && utils.MatchHost(pattern, serverName) {
+			return s.tlsMode != TLSPassthrough
+		}
+	}
+	return s.tlsMode == TLSPassthrough
+}
+
+// TLSListener wraps the raw HTTPS listener. It peeks at every ClientHello and either
+// hands the connection to the intercepting TLS server or splices it to its original destination.
+func (s *Server) TLSListener(inner net.Listener, config *tls.Config) net.Listener {
+	l := &tlsListener{
+		Listener: inner,
+		server:   s,
+		config:   config,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+type tlsListener struct {
+	net.Listener
+	server    *Server
+	config    *tls.Config
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *tlsListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// acceptLoop hands accepted connections to route. Failed accepts are retried with a backoff like
+// http.Server does, the listener is only given up once it is closed.
+func (l *tlsListener) acceptLoop() {
+	var delay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			_ = l.Close()
+			return
+		}
+		if err != nil {
+			delay = min(max(2*delay, 5*time.Millisecond), maxAcceptDelay)
+			l.server.logger.Error().Err(err).Msgf("Error accepting TLS connection, retrying in %s", delay)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-l.done:
+				return
+			}
+		}
+		delay = 0
+		go l.route(conn)
+	}
+}
+
+// route peeks the ClientHello and decides between interception and passthrough
+func (l *tlsListener) route(conn net.Conn) {
+	s := l.server
+	hello, peeked, err := peekClientHello(conn)
+	if err != nil {
+		s.logger.Debug().Err(err).Msgf("Error reading ClientHello from %s", conn.RemoteAddr())
+		_ = conn.Close()
+		return
+	}
+	if !s.passthrough(hello.ServerName) {
+		select {
+		case l.conns <- tls.Server(peeked, l.config):
+		case <-l.done:
+			_ = conn.Close()
+		}
+		return
+	}
+
+	origDst, err := redirectedDst(conn)
+	if err != nil {
+		s.logger.Error().Err(err).Msgf("Original destination unknown for passthrough of %s", hello.ServerName)
+		resetConn(conn)
+		return
+	}
+	hello.ClientAddr = conn.RemoteAddr()
+	hello.OriginalDst = origDst
+	client, _ := conn.RemoteAddr().(*net.TCPAddr)
+	hello.Process, err = s.LookupProcess(client, origDst, hello.ServerName)
+	if err != nil {
+		s.logger.Warn().Err(err).Msgf("Error identifying process for %s", conn.RemoteAddr())
+	}
+	if tlsHook, ok := s.serverHooks.(hooks.TLSHook); ok {
+		if err := tlsHook.BeforeTLS(hello); err != nil && !errors.Is(err, hooks.ErrPassThrough) {
+			s.logger.Info().Err(err).Msgf("TLS connection to %s (%s) reset", hello.ServerName, origDst)
+			resetConn(conn)
+			return
+		}
+	}
+	s.logger.Debug().Msgf("Passing through TLS connection to %s (%s)", hello.ServerName, origDst)
+	s.splice(peeked, origDst)
+}
+
+// splice copies bytes both ways between the client and the original destination
+// until both are done or the connection is idle for spliceIdleTimeout
+func (s *Server) splice(conn net.Conn, dst *net.TCPAddr) {
+	dialed, err := s.dialer.Dial("tcp", dst.String())
+	if err != nil {
+		s.logger.Error().Err(err).Msgf("Error connecting to %s", dst)
+		resetConn(conn)
+		return
+	}
+	client := &idleConn{Conn: conn, timeout: spliceIdleTimeout}
+	upstream := &idleConn{Conn: dialed, timeout: spliceIdleTimeout}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		// Propagate the half-close so the other direction can finish
+		if tcpConn, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = tcpConn.CloseWrite()
+		}
+	}
+	go pipe(upstream, client)
+	go pipe(client, upstream)
+	wg.Wait()
+	_ = upstream.Close()
+	_ = client.Close()
+}
+
+// idleConn pushes the deadline of the connection back with every read and write. Both directions
+// of a splice read from one connection and write to the other, so only idle splices time out.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// CloseWrite half-closes the underlying TCP connection
+func (c *idleConn) CloseWrite() error {
+	if tcpConn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return tcpConn.CloseWrite()
+	}
+	return nil
+}
+
+// peekClientHello reads the ClientHello without answering it. The returned
+// connection replays the consumed bytes, so the handshake can still take place.
+func peekClientHello(conn net.Conn) (*hooks.TLSInfo, *peekedConn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(clientHelloTimeout)); err != nil {
+		return nil, nil, err
+	}
+	var (
+		recorded bytes.Buffer
+		info     *hooks.TLSInfo
+	)
+	recorder := &recordingConn{Conn: conn, recorded: &recorded}
+	err := tls.Server(recorder, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			info = &hooks.TLSInfo{
+				ServerName: hello.ServerName,
+				ALPN:       append([]string(nil), hello.SupportedProtos...),
+			}
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if info == nil {
+		return nil, nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, nil, err
+	}
+	return info, &peekedConn{Conn: conn, reader: io.MultiReader(&recorded, conn)}, nil
+}
+
+// recordingConn keeps a copy of everything read and refuses to write anything
+type recordingConn struct {
+	net.Conn
+	recorded *bytes.Buffer
+}
+
+func (r *recordingConn) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	r.recorded.Write(p[:n])
+	return n, err
+}
+
+func (r *recordingConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// peekedConn replays the peeked bytes before reading from the connection again
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (p *peekedConn) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+// NetConn returns the underlying connection
+func (p *peekedConn) NetConn() net.Conn {
+	return p.Conn
+}
+
+// CloseWrite half-closes the underlying TCP connection
+func (p *peekedConn) CloseWrite() error {
+	if tcpConn, ok := p.Conn.(interface{ CloseWrite() error }); ok {
+		return tcpConn.CloseWrite()
+	}
+	return nil
+}
+
+// resetConn closes the connection with a RST instead of a FIN
+func resetConn(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(0)
+	}
+	_ = conn.Close()
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tb0hdan/go-webfilter/pkg/ca"
+)
+
+func TestPassthroughDecision(t *testing.T) {
+	s := New(zerolog.Nop(), false)
+
+	s.SetTLSMode(TLSIntercept, []string{"*.bank.com", "pinned.example.com"})
+	assert.False(t, s.passthrough("example.com"))
+	assert.False(t, s.passthrough(""))
+	assert.True(t, s.passthrough("www.bank.com"))
+	assert.True(t, s.passthrough("pinned.example.com"))
+
+	s.SetTLSMode(TLSPassthrough, []string{"inspect.example.com"})
+	assert.True(t, s.passthrough("example.com"))
+	assert.True(t, s.passthrough(""))
+	assert.False(t, s.passthrough("inspect.example.com"))
+}
+
+func TestPeekClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	go func() {
+		_ = tls.Client(client, &tls.Config{
+			ServerName: "peek.example.com",
+			NextProtos: []string{"h2", "http/1.1"},
+		}).Handshake()
+	}()
+
+	info, peeked, err := peekClientHello(server)
+	require.NoError(t, err)
+	assert.Equal(t, "peek.example.com", info.ServerName)
+	assert.Equal(t, []string{"h2", "http/1.1"}, info.ALPN)
+	assert.Same(t, server, peeked.NetConn())
+}
+
+func TestTLSListener(t *testing.T) {
+	authority, err := ca.New(zerolog.Nop(), t.TempDir())
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(authority.CertificatePEM())
+
+	s := New(zerolog.Nop(), false)
+	s.SetTLSMode(TLSIntercept, []string{"passthrough.example.com"})
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener := s.TLSListener(inner, authority.TLSConfig())
+	defer func() { _ = listener.Close() }()
+
+	httpServer := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.ServerName))
+	})}
+	go func() { _ = httpServer.Serve(listener) }()
+	defer func() { _ = httpServer.Close() }()
+
+	t.Run("intercepted host is served after the peek", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "intercept.example.com"},
+		}}
+		rsp, err := client.Get("https://" + inner.Addr().String())
+		require.NoError(t, err)
+		defer func() { _ = rsp.Body.Close() }()
+		body, err := io.ReadAll(rsp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "intercept.example.com", string(body))
+	})
+
+	t.Run("passthrough without original destination is reset", func(t *testing.T) {
+		conn, err := tls.Dial("tcp", inner.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "passthrough.example.com"})
+		if err == nil {
+			_ = conn.Close()
+		}
+		assert.Error(t, err)
+	})
+}
+
+// flakyListener fails the first accepts like a process out of file descriptors would
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, syscall.EMFILE
+	}
+	return l.Listener.Accept()
+}
+
+func TestTLSListenerRetriesAccept(t *testing.T) {
+	authority, err := ca.New(zerolog.Nop(), t.TempDir())
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(authority.CertificatePEM())
+
+	s := New(zerolog.Nop(), false)
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener := s.TLSListener(&flakyListener{Listener: inner, failures: 3}, authority.TLSConfig())
+	defer func() { _ = listener.Close() }()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", inner.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "retry.example.com"})
+	require.NoError(t, err)
+	_ = conn.Close()
+
+	require.NoError(t, listener.Close())
+	_, err = listener.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestSpliceIdleTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { spliceIdleTimeout = timeout }(spliceIdleTimeout)
+	spliceIdleTimeout = 100 * time.Millisecond
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = upstream.Close() }()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	done := make(chan struct{})
+	go func() {
+		New(zerolog.Nop(), false).splice(server, upstream.Addr().(*net.TCPAddr))
+		close(done)
+	}()
+
+	_, err = client.Write([]byte("ping"))
+	require.NoError(t, err)
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(client, reply)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(reply))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle splice was not closed")
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const relayBufferSize = 32 * 1024
+
+// hopHeaders are meaningful only for a single connection and must not be forwarded.
+// See RFC 9110, section 7.6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes hop-by-hop headers, including the ones listed in Connection
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// copyRequestHeaders copies end-to-end headers of the client request to the upstream request
+func copyRequestHeaders(dst, src *http.Request) {
+	for name, values := range src.Header {
+		for _, value := range values {
+			dst.Header.Add(name, value)
+		}
+	}
+	removeHopHeaders(dst.Header)
+	// Trailers are filled in by net/http once the body has been read
+	if len(src.Trailer) > 0 {
+		dst.Trailer = src.Trailer
+	}
+}
+
+// relayResponse writes the upstream response to the client unchanged:
+// status code, every header value, body bytes and trailers.
+func (s *Server) relayResponse(w *echo.Response, rsp *http.Response) error {
+	header := w.Header()
+	for name, values := range rsp.Header {
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+	removeHopHeaders(header)
+	// Announce trailers so they are sent after a chunked body
+	announced := make(map[string]bool, len(rsp.Trailer))
+	for name := range rsp.Trailer {
+		header.Add("Trailer", name)
+		announced[name] = true
+	}
+	w.WriteHeader(rsp.StatusCode)
+
+	if err := copyBody(w, rsp.Body, isStreaming(rsp)); err != nil {
+		return err
+	}
+
+	// rsp.Trailer is only complete once the body has been read till EOF
+	for name, values := range rsp.Trailer {
+		if !announced[name] {
+			name = http.TrailerPrefix + name
+		}
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+	return nil
+}
+
+// isStreaming reports whether each chunk should reach the client as soon as it arrives
+func isStreaming(rsp *http.Response) bool {
+	if rsp.ContentLength == -1 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(rsp.Header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// copyBody copies bytes as is, optionally flushing after every read
+func copyBody(w *echo.Response, body io.Reader, flush bool) error {
+	buf := make([]byte, relayBufferSize)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if flush {
+				w.Flush()
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
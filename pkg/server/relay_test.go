@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// relay fetches url from the origin and relays the response through relayResponse
+func relay(t *testing.T, url string) *httptest.ResponseRecorder {
+	t.Helper()
+	s := New(zerolog.Nop(), false)
+	rsp, err := s.client.Get(url)
+	require.NoError(t, err)
+	defer func() { _ = rsp.Body.Close() }()
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	require.NoError(t, s.relayResponse(c.Response(), rsp))
+	return rec
+}
+
+func TestRelayResponse(t *testing.T) {
+	binary := make([]byte, 256*1024)
+	_, err := rand.Read(binary)
+	require.NoError(t, err)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("not here"))
+		case "/redirect":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		case "/cookies":
+			w.Header().Add("Set-Cookie", "a=1")
+			w.Header().Add("Set-Cookie", "b=2")
+			w.Header().Set("Connection", "X-Hop")
+			w.Header().Set("X-Hop", "secret")
+		case "/binary":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write(binary)
+		case "/trailers":
+			w.Header().Set("Trailer", "X-Checksum")
+			_, _ = w.Write([]byte("line one\nline two\n"))
+			w.Header().Set("X-Checksum", "abc")
+			w.Header().Set(http.TrailerPrefix+"X-Late", "def")
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = w.Write([]byte("data: one\n\n"))
+		}
+	}))
+	defer origin.Close()
+
+	t.Run("status code is preserved", func(t *testing.T) {
+		rec := relay(t, origin.URL+"/missing")
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Equal(t, "not here", rec.Body.String())
+	})
+
+	t.Run("redirects are not followed", func(t *testing.T) {
+		rec := relay(t, origin.URL+"/redirect")
+		assert.Equal(t, http.StatusFound, rec.Code)
+		assert.Equal(t, "/elsewhere", rec.Header().Get("Location"))
+	})
+
+	t.Run("multi-valued headers are kept and hop-by-hop headers dropped", func(t *testing.T) {
+		rec := relay(t, origin.URL+"/cookies")
+		assert.Equal(t, []string{"a=1", "b=2"}, rec.Header().Values("Set-Cookie"))
+		assert.Empty(t, rec.Header().Get("Connection"))
+		assert.Empty(t, rec.Header().Get("X-Hop"))
+	})
+
+	t.Run("binary body is relayed byte for byte", func(t *testing.T) {
+		rec := relay(t, origin.URL+"/binary")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.True(t, bytes.Equal(binary, rec.Body.Bytes()))
+	})
+
+	t.Run("newlines and trailers are preserved", func(t *testing.T) {
+		rec := relay(t, origin.URL+"/trailers")
+		result := rec.Result()
+		body, err := io.ReadAll(result.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "line one\nline two\n", string(body))
+		assert.Equal(t, "abc", result.Trailer.Get("X-Checksum"))
+		assert.Equal(t, "def", result.Trailer.Get("X-Late"))
+	})
+
+	t.Run("event streams are flushed", func(t *testing.T) {
+		rec := relay(t, origin.URL+"/events")
+		assert.True(t, rec.Flushed)
+		assert.Equal(t, "data: one\n\n", rec.Body.String())
+	})
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Connection", "keep-alive, X-Custom")
+	header.Set("Keep-Alive", "timeout=5")
+	header.Set("X-Custom", "1")
+	header.Set("Upgrade", "h2c")
+	header.Set("Content-Type", "text/plain")
+
+	removeHopHeaders(header)
+	assert.Equal(t, http.Header{"Content-Type": []string{"text/plain"}}, header)
+}
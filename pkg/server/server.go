@@ -1,18 +1,18 @@
 package server
 
 import (
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"os"
-	"strings"
+	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog"
 	"github.com/tb0hdan/go-webfilter/pkg/firewall"
-	"github.com/tb0hdan/go-webfilter/pkg/firewall/nft"
+	"github.com/tb0hdan/go-webfilter/pkg/firewall/netlink"
 	"github.com/tb0hdan/go-webfilter/pkg/hooks"
 	"github.com/tb0hdan/go-webfilter/pkg/proc"
 	"github.com/tb0hdan/go-webfilter/pkg/utils"
@@ -24,8 +24,51 @@ type Server struct {
 	dump        bool
 	logger      zerolog.Logger
 	procLister  proc.Lister
+	sockets     proc.SocketLookup
 	fw          firewall.Firewall
 	serverHooks hooks.Hook
+	blockPage   *BlockPage
+	unlockPath  string
+	accessPath  string
+	dialer      *net.Dialer
+	client      *http.Client
+	// TLS connections are intercepted or passed through depending on SNI
+	tlsMode       TLSMode
+	tlsExceptions []string
+}
+
+// SetProcRoot makes process identification read procfs mounted at root instead of /proc
+func (s *Server) SetProcRoot(root string) {
+	procLister := proc.NewWithRoot(s.logger, root)
+	// Socket inodes are resolved through a cached index instead of scanning procfs for every request
+	s.procLister = proc.NewCachedLister(s.logger, procLister)
+	if root != proc.DefaultRoot {
+		// sock_diag answers for our own network namespace, which isn't necessarily the one of that procfs
+		s.sockets = procLister
+		return
+	}
+	// sock_diag finds the exact connection, the procfs scanner is the fallback
+	s.sockets = proc.NewFallbackLookup(s.logger, proc.NewSockDiag(), procLister)
+}
+
+// SetFirewall replaces the default netlink nftables firewall, it has to be called before Setup installs the rules
+func (s *Server) SetFirewall(fw firewall.Firewall) {
+	s.fw = fw
+}
+
+// SetBlockPage replaces the built-in page shown for blocked requests
+func (s *Server) SetBlockPage(blockPage *BlockPage) {
+	s.blockPage = blockPage
+}
+
+// SetUnlockPath makes the block page offer an unlock form posting to path on the blocked host
+func (s *Server) SetUnlockPath(path string) {
+	s.unlockPath = path
+}
+
+// SetRequestAccessPath makes the block page offer a request access form posting to path on the blocked host
+func (s *Server) SetRequestAccessPath(path string) {
+	s.accessPath = path
 }
 
 func (s *Server) SetHooks(serverHooks hooks.Hook) {
@@ -38,63 +81,67 @@ func (s *Server) SetHooks(serverHooks hooks.Hook) {
 	s.logger.Info().Msg("Hooks set for the server")
 }
 
+// IdentifyLocalAddr finds the local process that made the request and attaches it,
+// together with the original destination and SNI, to the request for the hooks to use
 func (s *Server) IdentifyLocalAddr(c echo.Context) error {
 	// Get the remote address from the request
-	localAddr := c.Request().RemoteAddr
-	if localAddr == "" {
-		return c.String(http.StatusBadRequest, "Local address not found")
+	if c.Request().RemoteAddr == "" {
+		return fmt.Errorf("local address not found")
 	}
-	// Split the remote address into IP and port
-	host, port, err := net.SplitHostPort(localAddr)
+	client, err := net.ResolveTCPAddr("tcp", c.Request().RemoteAddr)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "Error splitting local address")
+		return fmt.Errorf("error parsing local address: %w", err)
+	}
+	info := &hooks.RequestInfo{}
+	// The client socket is connected to the original destination, or to
+	// the proxy itself when the connection was not redirected
+	dst, ok := OriginalDstFromContext(c.Request().Context())
+	if ok {
+		info.OriginalDst = dst
+	} else {
+		dst, _ = c.Request().Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	}
+	if c.Request().TLS != nil {
+		info.ServerName = c.Request().TLS.ServerName
 	}
+	info.Process, err = s.LookupProcess(client, dst, c.Request().Host)
+	if err != nil {
+		return err
+	}
+	if info.Process != nil {
+		s.logger.Debug().Msgf("Request from PID %s (%s) to %s", info.Process.PID, info.Process.Binary, c.Request().Host)
+	}
+	hooks.SetRequestInfo(c, info)
+	return nil
+}
 
-	f, err := os.Open("/proc/net/tcp")
+// LookupProcess finds the local process owning the client side of a connection to dst.
+// It returns nil if the connection is not known to the kernel, e.g. it's not a local one.
+func (s *Server) LookupProcess(client, dst *net.TCPAddr, dstHost string) (*proc.ProcessInfo, error) {
+	if client == nil {
+		return nil, fmt.Errorf("client address not found")
+	}
+	socket, err := s.sockets.LookupSocket(client, dst)
+	if errors.Is(err, proc.ErrSocketNotFound) {
+		return nil, nil
+	}
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "Error opening /proc/net/tcp")
+		return nil, fmt.Errorf("error finding socket: %w", err)
 	}
-	data, err := io.ReadAll(f)
+	// Found the matching remote address
+	s.logger.Info().Msgf("Local address identified: %s\n", socket.LocalAddr)
+	procInfo, err := s.procLister.GetProcessInfoByInode(socket.Inode)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "Error reading /proc/net/tcp")
-	}
-	for _, line := range strings.Split(string(data), "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-		//   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
-		if strings.HasPrefix(line, "sl") {
-			continue
-		}
-		fields := strings.Fields(line)
-		src, srcPort, err := utils.ParseHexAddr(fields[1])
-		if err != nil {
-			return c.String(http.StatusInternalServerError, "Error parsing local address")
-		}
-		dst, dstPort, err := utils.ParseHexAddr(fields[2])
-		if err != nil {
-			return c.String(http.StatusInternalServerError, "Error parsing remote address")
-		}
-		if src == host && fmt.Sprintf("%d", srcPort) == port {
-			// Found the matching remote address
-			s.logger.Info().Msgf("Local address identified: %s:%d\n", src, srcPort)
-			uid, inode := fields[7], fields[9]
-			procInfo, err := s.procLister.GetProcessInfoByInode(inode)
-			if err != nil {
-				return c.String(http.StatusInternalServerError, "Error getting process info by inode")
-			}
-			procInfo.UID = uid
-			procInfo.SrcAddr = src
-			procInfo.SrcPort = fmt.Sprintf("%d", srcPort)
-			procInfo.DstAddr = dst
-			procInfo.DstPort = fmt.Sprintf("%d", dstPort)
-			procInfo.DstHost = c.Request().Host
-			fmt.Printf("%+v", procInfo)
-		}
-
+		return nil, fmt.Errorf("error getting process info by inode: %w", err)
 	}
-	return nil
+	procInfo.UID = socket.UID
+	procInfo.SrcAddr = client.IP.String()
+	procInfo.SrcPort = strconv.Itoa(client.Port)
+	// The socket tables know the pre-NAT destination, just like conntrack
+	procInfo.DstAddr = socket.RemoteAddr.IP.String()
+	procInfo.DstPort = strconv.Itoa(socket.RemoteAddr.Port)
+	procInfo.DstHost = dstHost
+	return procInfo, nil
 }
 
 func (s *Server) DumpRequest(req *http.Request) {
@@ -122,32 +169,19 @@ func (s *Server) DumpResponse(rsp *http.Response) {
 }
 
 func (s *Server) RegisterRoutes(e *echo.Echo) {
-	e.GET("/", s.HandlePath)
-	e.GET("/:path", s.HandlePath)
-	//
-	e.POST("/", s.HandlePath)
-	e.POST("/:path", s.HandlePath)
-	//
-	e.PUT("/", s.HandlePath)
-	e.PUT("/:path", s.HandlePath)
-	//
-	e.DELETE("/", s.HandlePath)
-	e.DELETE("/:path", s.HandlePath)
-	//
-	e.PATCH("/", s.HandlePath)
-	e.PATCH("/:path", s.HandlePath)
-	//
-	e.HEAD("/", s.HandlePath)
-	e.HEAD("/:path", s.HandlePath)
-	//
+	// Any covers the standard and common WebDAV methods on every path, including "/".
+	// Methods echo doesn't know about (MKCOL, COPY, LOCK, ...) end up in the not found
+	// handler, so it is pointed at the proxy as well.
+	e.Any("/*", s.HandlePath)
+	e.RouteNotFound("/*", s.HandlePath)
 }
 
-func (s *Server) Setup() {
+// Setup picks the ports to listen on and installs the firewall rules redirecting traffic to them
+func (s *Server) Setup() error {
 	// Get a free port for the redirect
 	redirectPort, err := utils.GetFreePort()
 	if err != nil {
-		fmt.Println("Error getting free port:", err)
-		return
+		return fmt.Errorf("error getting free port: %w", err)
 	}
 	// Set the server port to the redirect port
 	s.Port = redirectPort
@@ -155,8 +189,7 @@ func (s *Server) Setup() {
 	// Get a free port for HTTPS
 	httpsPort, err := utils.GetFreePort()
 	if err != nil {
-		fmt.Println("Error getting free port for HTTPS:", err)
-		return
+		return fmt.Errorf("error getting free port for HTTPS: %w", err)
 	}
 	s.HTTPSPort = httpsPort
 	s.logger.Info().Msgf("HTTP server will listen on port %d", s.Port)
@@ -164,9 +197,9 @@ func (s *Server) Setup() {
 
 	// Create firewall rules to redirect traffic
 	if err := s.fw.InstallRules(redirectPort, httpsPort); err != nil {
-		s.logger.Error().Err(err).Msg("Error installing firewall rules")
-		return
+		return fmt.Errorf("error installing firewall rules: %w", err)
 	}
+	return nil
 }
 
 func (s *Server) Cleanup() {
@@ -177,11 +210,18 @@ func (s *Server) Cleanup() {
 }
 
 func New(logger zerolog.Logger, dump bool) *Server {
-	procLister := proc.New(logger)
-	return &Server{
-		fw:         nft.New(logger),
-		dump:       dump,
-		logger:     logger,
-		procLister: procLister,
+	s := &Server{
+		fw:          netlink.New(logger),
+		dump:        dump,
+		logger:      logger,
+		serverHooks: &hooks.EmptyHookImpl{},
+		blockPage:   DefaultBlockPage(),
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
 	}
+	s.SetProcRoot(proc.DefaultRoot)
+	s.client = s.newUpstreamClient()
+	return s
 }
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tb0hdan/go-webfilter/pkg/hooks"
+	"github.com/tb0hdan/go-webfilter/pkg/proc"
+)
+
+func TestRegisterRoutes(t *testing.T) {
+	// The origin echoes back what it has received
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Request-URI", r.RequestURI)
+		w.Header().Set("X-Host", r.Host)
+		_, _ = w.Write(body)
+	}))
+	defer origin.Close()
+	originURL, err := url.Parse(origin.URL)
+	require.NoError(t, err)
+
+	srv := New(zerolog.Nop(), false)
+	e := echo.New()
+	srv.RegisterRoutes(e)
+	proxy := httptest.NewServer(e)
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		method     string
+		requestURI string
+		body       string
+	}{
+		{name: "root", method: http.MethodGet, requestURI: "/"},
+		{name: "deep path", method: http.MethodGet, requestURI: "/a/b/c/d.html"},
+		{name: "trailing slash", method: http.MethodGet, requestURI: "/a/b/"},
+		{name: "encoded slash", method: http.MethodGet, requestURI: "/files/a%2Fb/c%20d"},
+		{name: "raw query", method: http.MethodGet, requestURI: "/search?q=a+b&x=%2F&&y=%zz"},
+		{name: "empty query", method: http.MethodGet, requestURI: "/path?"},
+		{name: "post with body", method: http.MethodPost, requestURI: "/api/v1/items", body: "payload"},
+		{name: "options", method: http.MethodOptions, requestURI: "/a/b"},
+		{name: "trace", method: http.MethodTrace, requestURI: "/a/b"},
+		{name: "propfind", method: "PROPFIND", requestURI: "/dav/dir/", body: "<propfind/>"},
+		{name: "mkcol", method: "MKCOL", requestURI: "/dav/new/"},
+		{name: "copy", method: "COPY", requestURI: "/dav/a.txt"},
+		{name: "lock", method: "LOCK", requestURI: "/dav/a.txt"},
+		{name: "custom method", method: "PURGE", requestURI: "/cache/item"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req, err := http.NewRequest(tt.method, proxy.URL, body)
+			require.NoError(t, err)
+			req.URL = &url.URL{Scheme: "http", Host: proxyURL.Host, Opaque: tt.requestURI}
+			// Without NAT the proxy falls back to the Host header
+			req.Host = originURL.Host
+
+			rsp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { _ = rsp.Body.Close() }()
+			received, err := io.ReadAll(rsp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, rsp.StatusCode)
+			assert.Equal(t, tt.method, rsp.Header.Get("X-Method"))
+			assert.Equal(t, tt.requestURI, rsp.Header.Get("X-Request-URI"))
+			assert.Equal(t, originURL.Host, rsp.Header.Get("X-Host"))
+			assert.Equal(t, tt.body, string(received))
+		})
+	}
+}
+
+func TestUpstreamURL(t *testing.T) {
+	req := httptest.NewRequest("OPTIONS", "*", nil)
+	u := upstreamURL("http", "127.0.0.1:80", req)
+	assert.Equal(t, "*", u.RequestURI())
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/a%2Fb?c=d", nil)
+	u = upstreamURL("http", "127.0.0.1:80", req)
+	assert.Equal(t, "/a%2Fb?c=d", u.RequestURI())
+	assert.Equal(t, "127.0.0.1:80", u.Host)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RequestURI = "//double/a%2Fb"
+	u = upstreamURL("http", "127.0.0.1:80", req)
+	assert.Equal(t, "//double/a%2Fb", u.RequestURI())
+}
+
+func TestRewritePath(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/a%2Fb/c?d=e", nil)
+	upstream := httptest.NewRequest(http.MethodGet, "/", nil)
+	upstream.URL = upstreamURL("http", "127.0.0.1:80", req)
+
+	// Rewrites leaving the path alone keep the raw target
+	require.NoError(t, rewrite(upstream, func(r *http.Request) error {
+		r.Header.Set("X-Rewrite", "1")
+		return nil
+	}))
+	assert.Equal(t, "/a%2Fb/c?d=e", upstream.URL.RequestURI())
+
+	require.NoError(t, rewrite(upstream, func(r *http.Request) error {
+		assert.Equal(t, "/a/b/c", r.URL.Path)
+		r.URL.Path = "/new path"
+		r.URL.RawPath = ""
+		return nil
+	}))
+	assert.Equal(t, "/new%20path?d=e", upstream.URL.RequestURI())
+
+	upstream.URL = upstreamURL("http", "127.0.0.1:80", req)
+	require.NoError(t, rewrite(upstream, func(r *http.Request) error {
+		r.URL.Path = "/prefix" + r.URL.Path
+		return nil
+	}))
+	assert.Equal(t, "/prefix/a/b/c?d=e", upstream.URL.RequestURI())
+}
+
+func TestCheckDestination(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Host", r.Host)
+	}))
+	defer origin.Close()
+	originAddr, err := net.ResolveTCPAddr("tcp", origin.Listener.Addr().String())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		host       string
+		remoteAddr string
+		dst        *net.TCPAddr
+		status     int
+	}{
+		{name: "local client", host: origin.Listener.Addr().String(), remoteAddr: "127.0.0.1:40000", status: http.StatusOK},
+		{name: "remote client", host: origin.Listener.Addr().String(), remoteAddr: "192.0.2.1:40000", status: http.StatusForbidden},
+		{name: "no host", remoteAddr: "127.0.0.1:40000", status: http.StatusBadRequest},
+		// Redirected requests go to the original destination whatever Host says
+		{name: "redirected", host: "origin.example.com", remoteAddr: "192.0.2.1:40000", dst: originAddr, status: http.StatusOK},
+		{name: "redirected with other address", host: "192.0.2.9:80", remoteAddr: "192.0.2.1:40000", dst: originAddr, status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := New(zerolog.Nop(), false)
+			e := echo.New()
+			srv.RegisterRoutes(e)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.host
+			req.RemoteAddr = tt.remoteAddr
+			if tt.dst != nil {
+				req = req.WithContext(context.WithValue(req.Context(), originalDstKey{}, tt.dst))
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.status, rec.Code)
+			if tt.status == http.StatusOK {
+				assert.Equal(t, tt.host, rec.Header().Get("X-Host"))
+			}
+		})
+	}
+}
+
+func TestLookupProcess(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration tests in short mode")
+	}
+	srv := New(zerolog.Nop(), false)
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0"} {
+		t.Run(address, func(t *testing.T) {
+			listener, err := net.Listen("tcp", address)
+			if err != nil {
+				t.Skipf("%s is not available: %v", address, err)
+			}
+			defer func() { _ = listener.Close() }()
+			client, err := net.Dial("tcp", listener.Addr().String())
+			require.NoError(t, err)
+			defer func() { _ = client.Close() }()
+
+			procInfo, err := srv.LookupProcess(client.LocalAddr().(*net.TCPAddr), listener.Addr().(*net.TCPAddr), "example.com")
+			require.NoError(t, err)
+			require.NotNil(t, procInfo)
+			assert.Equal(t, strconv.Itoa(os.Getpid()), procInfo.PID)
+			assert.Equal(t, listener.Addr().(*net.TCPAddr).IP.String(), procInfo.DstAddr)
+			assert.Equal(t, "example.com", procInfo.DstHost)
+		})
+	}
+}
+
+func TestLookupProcessFixture(t *testing.T) {
+	tests := []struct {
+		name     string
+		scenario string
+		client   string
+		dst      string
+		expected proc.ProcessInfo
+	}{
+		{
+			name:     "IPv4",
+			scenario: "host",
+			client:   "10.0.0.5:48000",
+			dst:      "93.184.216.34:80",
+			expected: proc.ProcessInfo{
+				PID: "1234", Binary: "/usr/bin/curl", Cmdline: "curl -s http://example.com/", UID: "1000",
+				SrcAddr: "10.0.0.5", SrcPort: "48000", DstAddr: "93.184.216.34", DstPort: "80", DstHost: "example.com",
+			},
+		},
+		{
+			name:     "IPv6",
+			scenario: "host",
+			client:   "[2001:db8::5]:50000",
+			dst:      "[2606:2800:220:1::]:443",
+			expected: proc.ProcessInfo{
+				PID: "2345", Binary: "/usr/lib/firefox/firefox", Cmdline: "/usr/lib/firefox/firefox -P default", UID: "1000",
+				SrcAddr: "2001:db8::5", SrcPort: "50000", DstAddr: "2606:2800:220:1::", DstPort: "443", DstHost: "example.com",
+			},
+		},
+		{
+			name:     "host network container",
+			scenario: "container",
+			client:   "10.0.0.5:40000",
+			dst:      "93.184.216.34:80",
+			expected: proc.ProcessInfo{
+				PID: "4321", Binary: "/usr/local/bin/app", Cmdline: "app --port 8080", UID: "999",
+				SrcAddr: "10.0.0.5", SrcPort: "40000", DstAddr: "93.184.216.34", DstPort: "80", DstHost: "example.com",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := New(zerolog.Nop(), false)
+			// A procfs root other than /proc is only searched through its tables
+			srv.SetProcRoot(filepath.Join("..", "proc", "testdata", "procfs", tt.scenario))
+			client, err := net.ResolveTCPAddr("tcp", tt.client)
+			require.NoError(t, err)
+			dst, err := net.ResolveTCPAddr("tcp", tt.dst)
+			require.NoError(t, err)
+
+			procInfo, err := srv.LookupProcess(client, dst, "example.com")
+			require.NoError(t, err)
+			require.NotNil(t, procInfo)
+			assert.Equal(t, tt.expected, *procInfo)
+		})
+	}
+}
+
+// recordingHook keeps what the hooks saw of the request
+type recordingHook struct {
+	hooks.EmptyHookImpl
+	before *hooks.RequestInfo
+	after  *hooks.RequestInfo
+}
+
+func (h *recordingHook) BeforeRequest(c echo.Context) (hooks.Decision, error) {
+	h.before, _ = hooks.GetRequestInfo(c)
+	return hooks.Allow(), nil
+}
+
+func (h *recordingHook) AfterRequest(c echo.Context, rsp *http.Response) error {
+	h.after, _ = hooks.RequestInfoFromContext(rsp.Request.Context())
+	return nil
+}
+
+func TestHooksReceiveRequestInfo(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration tests in short mode")
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+	originURL, err := url.Parse(origin.URL)
+	require.NoError(t, err)
+
+	recorder := &recordingHook{}
+	srv := New(zerolog.Nop(), false)
+	srv.SetHooks(recorder)
+	e := echo.New()
+	srv.RegisterRoutes(e)
+	proxy := httptest.NewServer(e)
+	defer proxy.Close()
+
+	req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	require.NoError(t, err)
+	req.Host = originURL.Host
+	rsp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = rsp.Body.Close()
+
+	require.NotNil(t, recorder.before)
+	require.NotNil(t, recorder.before.Process)
+	assert.Equal(t, strconv.Itoa(os.Getpid()), recorder.before.Process.PID)
+	assert.Equal(t, originURL.Host, recorder.before.Process.DstHost)
+	// Not redirected and not TLS
+	assert.Nil(t, recorder.before.OriginalDst)
+	assert.Empty(t, recorder.before.ServerName)
+	assert.Same(t, recorder.before, recorder.after)
+}
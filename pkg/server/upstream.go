@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+type serverNameKey struct{}
+
+// newUpstreamClient creates the client used to reach original destinations.
+// Requests are addressed to the original destination IP, so the connection pool is
+// keyed by where the traffic really goes rather than by a client controlled Host header.
+func (s *Server) newUpstreamClient() *http.Client {
+	transport := &http.Transport{
+		DialContext:         s.dialer.DialContext,
+		DialTLSContext:      s.dialUpstreamTLS,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		// Content-Encoding is relayed untouched, the client decodes it
+		DisableCompression: true,
+	}
+	return &http.Client{
+		Transport: transport,
+		// Redirects belong to the client, they must not be followed by the proxy
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// dialUpstreamTLS dials the original destination and verifies it against the name the client asked for
+func (s *Server) dialUpstreamTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := s.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	serverName, _ := ctx.Value(serverNameKey{}).(string)
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: serverName,
+		NextProtos: []string{"http/1.1"},
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// withServerName stores the TLS server name to use for the upstream connection
+func withServerName(ctx context.Context, serverName string) context.Context {
+	return context.WithValue(ctx, serverNameKey{}, serverName)
+}
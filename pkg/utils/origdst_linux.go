@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// ip6tSoOriginalDst is IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h
+const ip6tSoOriginalDst = 80
+
+// OriginalDst returns the pre-NAT destination of a redirected TCP connection.
+// The kernel keeps it in conntrack and exposes it via SO_ORIGINAL_DST (IPv4)
+// and IP6T_SO_ORIGINAL_DST (IPv6) socket options.
+func OriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	// Unwrap *tls.Conn and similar wrappers down to the TCP connection
+	for {
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapper.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("unsupported connection type %T", conn)
+	}
+	local, ok := tcpConn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unsupported local address type %T", tcpConn.LocalAddr())
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("error getting raw connection: %w", err)
+	}
+
+	var (
+		dst    *net.TCPAddr
+		optErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			dst, optErr = originalDst4(int(fd))
+			return
+		}
+		dst, optErr = originalDst6(int(fd))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error accessing raw connection: %w", err)
+	}
+	if optErr != nil {
+		return nil, fmt.Errorf("error reading original destination: %w", optErr)
+	}
+	return dst, nil
+}
+
+func originalDst4(fd int) (*net.TCPAddr, error) {
+	// IPv6Mreq is the only 16 byte getsockopt helper, which is exactly the size of sockaddr_in
+	mreq, err := unix.GetsockoptIPv6Mreq(fd, unix.SOL_IP, unix.SO_ORIGINAL_DST)
+	if err != nil {
+		return nil, err
+	}
+	// sockaddr_in: family (2 bytes), port (2 bytes, big-endian), address (4 bytes)
+	sa := mreq.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+		Port: int(binary.BigEndian.Uint16(sa[2:4])),
+	}, nil
+}
+
+func originalDst6(fd int) (*net.TCPAddr, error) {
+	// IPv6MTUInfo starts with sockaddr_in6, which is what the kernel writes back
+	info, err := unix.GetsockoptIPv6MTUInfo(fd, unix.SOL_IPV6, ip6tSoOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	// Port is stored in network byte order, so undo the native interpretation
+	port := make([]byte, 2)
+	binary.NativeEndian.PutUint16(port, info.Addr.Port)
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, info.Addr.Addr[:])
+	return &net.TCPAddr{
+		IP:   ip,
+		Port: int(binary.BigEndian.Uint16(port)),
+	}, nil
+}
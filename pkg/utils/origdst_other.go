@@ -0,0 +1,13 @@
+//go:build !linux
+
+package utils
+
+import (
+	"errors"
+	"net"
+)
+
+// OriginalDst is only supported on Linux, where the destination is kept by conntrack
+func OriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("original destination lookup is not supported on this platform")
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"encoding/hex"
 	"fmt"
 	"net"
 	"strconv"
@@ -17,7 +18,12 @@ func Index[T any](arr []T, f func(T) bool) int {
 	return -1
 }
 
+// DecodeHex decodes an address in /proc/net/tcp format. IPv4 addresses are a single
+// little-endian word, IPv6 addresses (32 hex digits) are four of them.
 func DecodeHex(s string) (string, error) {
+	if len(s) == 2*net.IPv6len {
+		return decodeHex6(s)
+	}
 	parts := make([]string, 0, len(s)/2)
 	// Convert hex string to byte slice
 	for i := 0; i < len(s); i += 2 {
@@ -35,6 +41,21 @@ func DecodeHex(s string) (string, error) {
 	return strings.Join(parts, "."), nil
 }
 
+// decodeHex6 decodes an IPv6 address written as four little-endian 32-bit words
+func decodeHex6(s string) (string, error) {
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("error converting hex to int: %w", err)
+	}
+	ip := make(net.IP, net.IPv6len)
+	for word := 0; word < net.IPv6len; word += 4 {
+		for i := 0; i < 4; i++ {
+			ip[word+i] = raw[word+3-i]
+		}
+	}
+	return ip.String(), nil
+}
+
 func ParseHexAddr(addr string) (string, int, error) {
 	localIP, localPort, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -52,3 +73,25 @@ func ParseHexAddr(addr string) (string, int, error) {
 	}
 	return decodedIP, int(portNum), nil
 }
+
+// MatchHost reports whether host matches pattern. "*" matches everything,
+// "*.example.com" matches subdomains of example.com and anything else must match exactly.
+func MatchHost(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if pattern == "*" {
+		return true
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok && strings.HasPrefix(suffix, ".") {
+		return strings.HasSuffix(host, suffix)
+	}
+	return pattern == host
+}
+
+// HostOnly strips the port and the trailing dot from a Host header and lowercases it
+func HostOnly(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+}
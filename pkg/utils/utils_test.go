@@ -363,6 +363,36 @@ func TestDecodeHexTableDriven(t *testing.T) {
 			expected: "10.0.0.1",
 			wantErr:  false,
 		},
+		{
+			name:     "IPv6 loopback",
+			input:    "00000000000000000000000001000000",
+			expected: "::1",
+			wantErr:  false,
+		},
+		{
+			name:     "IPv6 link local",
+			input:    "000080FE00000000FF0002023E0400FE",
+			expected: "fe80::202:ff:fe00:43e",
+			wantErr:  false,
+		},
+		{
+			name:     "IPv6 documentation prefix",
+			input:    "B80D0120000000000000000001000000",
+			expected: "2001:db8::1",
+			wantErr:  false,
+		},
+		{
+			name:     "IPv4-mapped IPv6",
+			input:    "0000000000000000FFFF00000100007F",
+			expected: "127.0.0.1",
+			wantErr:  false,
+		},
+		{
+			name:     "invalid IPv6 hex",
+			input:    "0000000000000000000000000100000Z",
+			expected: "",
+			wantErr:  true,
+		},
 		{
 			name:     "invalid hex",
 			input:    "GGGG",
@@ -420,6 +450,13 @@ func TestParseHexAddrTableDriven(t *testing.T) {
 			expectedPort: 443,
 			wantErr:     false,
 		},
+		{
+			name:         "[::1]:8080",
+			input:        "00000000000000000000000001000000:1F90",
+			expectedIP:   "::1",
+			expectedPort: 8080,
+			wantErr:      false,
+		},
 		{
 			name:        "invalid format",
 			input:       "0100007F",
@@ -455,4 +492,97 @@ func TestParseHexAddrTableDriven(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+func TestOriginalDst(t *testing.T) {
+	t.Run("unsupported connection type", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer func() {
+			_ = client.Close()
+			_ = server.Close()
+		}()
+		_, err := OriginalDst(server)
+		assert.Error(t, err)
+	})
+
+	t.Run("connection without NAT", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer func() { _ = listener.Close() }()
+
+		client, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		defer func() { _ = client.Close() }()
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		// Without conntrack the lookup fails, with it the proxy itself is reported
+		dst, err := OriginalDst(conn)
+		if err == nil {
+			assert.Equal(t, listener.Addr().String(), dst.String())
+		}
+	})
+}
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		host     string
+		expected bool
+	}{
+		{pattern: "*", host: "example.com", expected: true},
+		{pattern: "example.com", host: "example.com", expected: true},
+		{pattern: "example.com", host: "EXAMPLE.com.", expected: true},
+		{pattern: "example.com", host: "www.example.com", expected: false},
+		{pattern: "*.example.com", host: "www.example.com", expected: true},
+		{pattern: "*.example.com", host: "a.b.example.com", expected: true},
+		{pattern: "*.example.com", host: "example.com", expected: false},
+		{pattern: "*.example.com", host: "badexample.com", expected: false},
+		{pattern: "*example.com", host: "badexample.com", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.host, func(t *testing.T) {
+			assert.Equal(t, tt.expected, MatchHost(tt.pattern, tt.host))
+		})
+	}
+}
+
+func TestHostOnly(t *testing.T) {
+	tests := map[string]string{
+		"example.com":       "example.com",
+		"Example.COM:8080":  "example.com",
+		"example.com.":      "example.com",
+		"example.com.:443":  "example.com",
+		"[2001:db8::1]:443": "2001:db8::1",
+		"[2001:db8::1]":     "2001:db8::1",
+		"":                  "",
+	}
+
+	for host, expected := range tests {
+		t.Run(host, func(t *testing.T) {
+			assert.Equal(t, expected, HostOnly(host))
+		})
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "data.json")
+
+	require.NoError(t, WriteFile(path, []byte("first")))
+	require.NoError(t, WriteFile(path, []byte("second")))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	assert.NoFileExists(t, path+".tmp")
+}
+
+func TestNewID(t *testing.T) {
+	id := NewID()
+	assert.Len(t, id, 16)
+	assert.NotEqual(t, id, NewID())
+}